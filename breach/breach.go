@@ -0,0 +1,138 @@
+// Package breach looks passwords up in a local copy of a breach corpus such as Have I Been Pwned,
+// without any network calls.
+//
+// The index is a file holding the SHA-1 hashes of the breached passwords as sorted 20 byte records
+// after a short header. Lookups binary search the file on disk, so it is never loaded into memory
+// however large the corpus is. Build it from the raw dump with cmd/breachindex.
+package breach
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// magic starts every index file, and changes with the format.
+const magic = "PWNIDX01"
+
+// recordSize is the size of a SHA-1 hash.
+const recordSize = sha1.Size
+
+// Index is an opened breach index. It is safe for concurrent use.
+type Index struct {
+	file  *os.File
+	count int64
+	// buffers avoids allocating a record buffer for every step of a lookup.
+	buffers sync.Pool
+}
+
+// Open opens the index file at path.
+func Open(path string) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(file, header); err != nil || string(header) != magic {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a breach index", path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	size := info.Size() - int64(len(magic))
+	if size%recordSize != 0 {
+		file.Close()
+		return nil, fmt.Errorf("breach index %s is truncated", path)
+	}
+	index := &Index{file: file, count: size / recordSize}
+	index.buffers.New = func() any { return make([]byte, recordSize) }
+	return index, nil
+}
+
+// Len returns the number of hashes in the index.
+func (i *Index) Len() int64 {
+	return i.count
+}
+
+// Contains reports whether the password appears in the breach corpus.
+func (i *Index) Contains(password string) (bool, error) {
+	digest := sha1.Sum([]byte(password))
+	return i.ContainsHash(digest)
+}
+
+// ContainsHash reports whether the SHA-1 hash of a password appears in the breach corpus.
+func (i *Index) ContainsHash(digest [recordSize]byte) (bool, error) {
+	record := i.buffers.Get().([]byte)
+	defer i.buffers.Put(record)
+
+	low, high := int64(0), i.count
+	for low < high {
+		middle := low + (high-low)/2
+		if _, err := i.file.ReadAt(record, int64(len(magic))+middle*recordSize); err != nil {
+			return false, fmt.Errorf("read breach index: %w", err)
+		}
+		switch bytes.Compare(record, digest[:]) {
+		case 0:
+			return true, nil
+		case -1:
+			low = middle + 1
+		default:
+			high = middle
+		}
+	}
+	return false, nil
+}
+
+// Close closes the index file.
+func (i *Index) Close() error {
+	return i.file.Close()
+}
+
+// ErrUnsorted is returned by Writer.Add when hashes are not added in ascending order.
+var ErrUnsorted = errors.New("hashes must be added in ascending order")
+
+// Writer writes an index file. Hashes must be added in ascending order, which is the order of the
+// HIBP downloads; duplicates are skipped.
+type Writer struct {
+	w     io.Writer
+	last  [recordSize]byte
+	count int64
+}
+
+// NewWriter writes the header of an index to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if _, err := io.WriteString(w, magic); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// Add appends a hash to the index.
+func (w *Writer) Add(digest [recordSize]byte) error {
+	if w.count > 0 {
+		switch bytes.Compare(digest[:], w.last[:]) {
+		case 0:
+			return nil
+		case -1:
+			return fmt.Errorf("%w: %X after %X", ErrUnsorted, digest, w.last)
+		}
+	}
+	if _, err := w.w.Write(digest[:]); err != nil {
+		return err
+	}
+	w.last = digest
+	w.count++
+	return nil
+}
+
+// Count returns the number of hashes written so far.
+func (w *Writer) Count() int64 {
+	return w.count
+}
@@ -0,0 +1,165 @@
+// Package certs loads the TLS certificates of the gRPC server and client, and reloads the server
+// certificates when they are replaced on disk so they can be renewed without a restart.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves the server certificate, and the CAs client certificates must be signed by, from
+// files that are loaded again whenever they change.
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	// modTimes remembers when each file was last changed, to only reload files that did.
+	modTimes map[string]time.Time
+}
+
+// NewReloader loads the certificate and key, and the client CAs when clientCAFile is not empty.
+// With client CAs the server requires every client to present a certificate signed by one of them.
+func NewReloader(certFile string, keyFile string, clientCAFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		modTimes:     make(map[string]time.Time),
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files again if any of them changed since they were last loaded, and reports
+// whether it did. On error the previous certificates stay in use.
+func (r *Reloader) Reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	changed := false
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+		r.mu.RLock()
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			changed = true
+		}
+		r.mu.RUnlock()
+	}
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("load certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		if clientCAs, err = LoadCertPool(r.clientCAFile); err != nil {
+			return false, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return true, nil
+}
+
+// ReloadEvery checks the files for changes every interval until ctx is done. Errors are passed to
+// onError, and the previous certificates stay in use.
+func (r *Reloader) ReloadEvery(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// ServerConfig returns a TLS configuration that always uses the most recently loaded certificates.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Build the configuration per handshake so new connections pick up reloaded certificates.
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate},
+			}
+			if r.clientCAs != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = r.clientCAs
+			}
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig returns the TLS configuration of a client. The server certificate is verified against
+// the CAs in caFile, or the system roots when caFile is empty. certFile and keyFile hold the client
+// certificate for servers that require one, and may be empty otherwise.
+func ClientConfig(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		roots, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = roots
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("a client certificate needs both a certificate and a key file")
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// LoadCertPool reads the PEM encoded CA certificates in file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificates: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
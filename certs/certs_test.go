@@ -0,0 +1,240 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority generated for a test.
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+var serialNumber int64
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serialNumber),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue creates a leaf certificate for commonName signed by the CA, and returns it and its key PEM
+// encoded. Server certificates are valid for localhost.
+func (ca testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) (certPEM []byte, keyPEM []byte, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serialNumber),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		serialNumber
+}
+
+// writeFile writes data to path and moves its modification time forward by age, so a rewrite within
+// the resolution of the file system clock still counts as a change.
+func writeFile(t *testing.T, path string, data []byte, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedSerial returns the serial number of the certificate the server presents to new clients.
+func servedSerial(t *testing.T, r *Reloader) int64 {
+	t.Helper()
+	config, err := r.ServerConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetConfigForClient: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestReloadReplacedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	ca := newTestCA(t)
+	certPEM, keyPEM, first := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM, 0)
+	writeFile(t, keyFile, keyPEM, 0)
+
+	r, err := NewReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("NewReloader: %s", err)
+	}
+	if got := servedSerial(t, r); got != first {
+		t.Fatalf("serving certificate %d, want %d", got, first)
+	}
+	if reloaded, err := r.Reload(); err != nil || reloaded {
+		t.Errorf("Reload without changes: got %v, %v, want false, nil", reloaded, err)
+	}
+
+	certPEM, keyPEM, second := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM, time.Second)
+	writeFile(t, keyFile, keyPEM, time.Second)
+	if reloaded, err := r.Reload(); err != nil || !reloaded {
+		t.Fatalf("Reload after replacing the files: got %v, %v, want true, nil", reloaded, err)
+	}
+	if got := servedSerial(t, r); got != second {
+		t.Errorf("serving certificate %d after the reload, want %d", got, second)
+	}
+}
+
+func TestFailedReloadKeepsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	ca := newTestCA(t)
+	certPEM, keyPEM, serial := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM, 0)
+	writeFile(t, keyFile, keyPEM, 0)
+	r, err := NewReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("NewReloader: %s", err)
+	}
+
+	// A certificate that does not match the key, as while a renewal is half written.
+	otherPEM, _, _ := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, otherPEM, time.Second)
+	if _, err := r.Reload(); err == nil {
+		t.Error("Reload with a certificate not matching the key succeeded")
+	}
+	writeFile(t, certFile, []byte("not a certificate"), 2*time.Second)
+	if _, err := r.Reload(); err == nil {
+		t.Error("Reload with a garbage certificate succeeded")
+	}
+	if got := servedSerial(t, r); got != serial {
+		t.Errorf("serving certificate %d after failed reloads, want the previous %d", got, serial)
+	}
+}
+
+func TestMutualTLSRequiresClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem")
+	certPEM, keyPEM, _ := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM, 0)
+	writeFile(t, keyFile, keyPEM, 0)
+	writeFile(t, caFile, ca.pem, 0)
+	r, err := NewReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("NewReloader: %s", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", r.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// The server handshakes every connection and reports how it went.
+	handshakes := make(chan error)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			err = conn.(*tls.Conn).Handshake()
+			conn.Close()
+			handshakes <- err
+		}
+	}()
+
+	clientCertPEM, clientKeyPEM, _ := ca.issue(t, "admin-tool", x509.ExtKeyUsageClientAuth)
+	strangerCA := newTestCA(t)
+	strangerCertPEM, strangerKeyPEM, _ := strangerCA.issue(t, "stranger", x509.ExtKeyUsageClientAuth)
+	for _, test := range []struct {
+		name      string
+		certPEM   []byte
+		keyPEM    []byte
+		wantError bool
+	}{
+		{"without a certificate", nil, nil, true},
+		{"with a certificate of another CA", strangerCertPEM, strangerKeyPEM, true},
+		{"with a certificate of the client CA", clientCertPEM, clientKeyPEM, false},
+	} {
+		var certificateFile, certificateKeyFile string
+		if test.certPEM != nil {
+			certificateFile, certificateKeyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+			writeFile(t, certificateFile, test.certPEM, 0)
+			writeFile(t, certificateKeyFile, test.keyPEM, 0)
+		}
+		config, err := ClientConfig(caFile, certificateFile, certificateKeyFile, "localhost")
+		if err != nil {
+			t.Fatalf("%s: ClientConfig: %s", test.name, err)
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err == nil {
+			// With TLS 1.3 the client only learns of a refused certificate when it reads.
+			conn.Handshake()
+			conn.Close()
+		}
+		if serverErr := <-handshakes; (serverErr != nil) != test.wantError {
+			t.Errorf("%s: server handshake error %v, want error %v", test.name, serverErr, test.wantError)
+		}
+	}
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 
 	"google.golang.org/grpc"
+	grpccredentials "google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"rahulchhabra.io/certs"
 	userproto "rahulchhabra.io/proto/user"
 )
 
@@ -20,7 +24,7 @@ func createuser(client userproto.UserServiceClient) {
 			Email:     "johnd@mail.com",
 			Username:  "rahulc",
 		},
-		Password: "password",
+		Password: "plum sailboat velvet 42",
 	})
 	//Check for errors
 	if err != nil {
@@ -33,8 +37,8 @@ func createuser(client userproto.UserServiceClient) {
 func loginuser(client userproto.UserServiceClient) {
 	// Call the AuthenticateUser function on the server and pass the request to it using the client we created above.
 	response, err := client.AuthenticateUser(context.Background(), &userproto.AuthenticateUserRequest{
-		Email: "johnd@mail.com",
-		Password: "password",
+		Identifier: "johnd@mail.com",
+		Password:   "plum sailboat velvet 42",
 	})
 	//Check for errors
 	if err != nil {
@@ -42,14 +46,71 @@ func loginuser(client userproto.UserServiceClient) {
 	}
 	// Print the response
 	fmt.Println("User authenticated: ", response.Message);
+	fmt.Println("Access token: ", response.GetAccessToken())
+	fmt.Println("Expires at: ", response.GetExpiresAt().AsTime())
+	fmt.Println("Refresh token: ", response.GetRefreshToken())
 }
+
+func refreshsession(client userproto.UserServiceClient, refreshToken string) {
+	// Call the RefreshSession function on the server to swap the refresh token for a new token pair.
+	response, err := client.RefreshSession(context.Background(), &userproto.RefreshSessionRequest{
+		RefreshToken: refreshToken,
+	})
+	//Check for errors
+	if err != nil {
+		log.Fatalf("Could not refresh session: %v", err)
+	}
+	// Print the response
+	fmt.Println("Access token: ", response.GetAccessToken())
+	fmt.Println("Refresh token: ", response.GetRefreshToken())
+}
+func listsessions(client userproto.UserServiceClient, accessToken string) {
+	// Send the access token as metadata so the server knows who is asking.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+accessToken)
+	response, err := client.ListSessions(ctx, &userproto.ListSessionsRequest{})
+	//Check for errors
+	if err != nil {
+		log.Fatalf("Could not list sessions: %v", err)
+	}
+	// Print the response
+	for _, session := range response.GetSessions() {
+		fmt.Println("Session: ", session.GetId(), session.GetClientIp(), session.GetUserAgent(), session.GetCurrent())
+	}
+}
+
+func logout(client userproto.UserServiceClient, accessToken string) {
+	// Revoke the session the access token belongs to.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+accessToken)
+	if _, err := client.Logout(ctx, &userproto.LogoutRequest{}); err != nil {
+		log.Fatalf("Could not log out: %v", err)
+	}
+	fmt.Println("Logged out")
+}
+
 func main() {
+	// Read the connection settings from the command line
+	addr := flag.String("addr", "localhost:50051", "address of the server")
+	useTLS := flag.Bool("tls", false, "connect over TLS, implied by the other TLS flags")
+	caFile := flag.String("tls-ca", "", "PEM CA certificates to verify the server with instead of the system roots")
+	certFile := flag.String("tls-cert", "", "PEM client certificate, for servers that require mutual TLS")
+	keyFile := flag.String("tls-key", "", "PEM private key of the client certificate")
+	serverName := flag.String("tls-server-name", "", "name expected in the server certificate, defaults to the host of -addr")
+	flag.Parse()
+
+	// Without TLS the password is sent in plaintext, which is only acceptable for local development
+	credentials := insecure.NewCredentials()
+	if *useTLS || *caFile != "" || *certFile != "" || *keyFile != "" || *serverName != "" {
+		tlsConfig, err := certs.ClientConfig(*caFile, *certFile, *keyFile, *serverName)
+		if err != nil {
+			log.Fatalf("Could not load TLS configuration: %v", err)
+		}
+		credentials = grpccredentials.NewTLS(tlsConfig)
+	}
+
 	// Create a connection to the server
 	// grpc.Dial is a function that creates a connection to the server using the gRPC protocol
 	// grpc.Dial takes the address of the server and the credentials
-	// In this case, we are using insecure credentials
-	// This is because we are not using TLS((Transport Layer Security) certificates)
-	connection, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	connection, err := grpc.Dial(*addr, grpc.WithTransportCredentials(credentials))
 	if err != nil {
 		log.Fatalf("Could not connect to the server: %v", err)
 	}
@@ -61,4 +122,7 @@ func main() {
 
 	//createuser(client)
 	loginuser(client)
+	//refreshsession(client, "<refresh token>")
+	//listsessions(client, "<access token>")
+	//logout(client, "<access token>")
 }
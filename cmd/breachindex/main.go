@@ -0,0 +1,157 @@
+// Command breachindex builds the breach index the server checks new passwords against from a Have
+// I Been Pwned SHA-1 dump.
+//
+// It reads either the single "ordered by hash" download, with one HASH:COUNT line per password, or
+// a directory of range files as written by the HIBP downloader, named after the first five hex
+// digits of the hashes they hold and with one SUFFIX:COUNT line per password:
+//
+//	go run ./cmd/breachindex -out breached.idx pwned-passwords-sha1-ordered-by-hash-v8.txt
+//	go run ./cmd/breachindex -out breached.idx -min-count 10 ./pwnedpasswords
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"rahulchhabra.io/breach"
+)
+
+func main() {
+	out := flag.String("out", "breached.idx", "index file to write")
+	minCount := flag.Int64("min-count", 1, "leave out passwords seen fewer times than this in breaches")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <dump file or range directory>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	count, err := build(*out, flag.Args(), *minCount)
+	if err != nil {
+		log.Fatalf("Failed to build index: %s", err)
+	}
+	fmt.Printf("Wrote %d hashes to %s\n", count, *out)
+}
+
+// build writes the index of the inputs to out and returns how many hashes it holds. The index is
+// written next to out and renamed at the end, so the server never sees a partial index.
+func build(out string, inputs []string, minCount int64) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(out), ".breachindex-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buffered := bufio.NewWriterSize(tmp, 1<<20)
+	writer, err := breach.NewWriter(buffered)
+	if err != nil {
+		return 0, err
+	}
+	for _, input := range inputs {
+		if err := addInput(writer, input, minCount); err != nil {
+			return 0, fmt.Errorf("%s: %w", input, err)
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), out); err != nil {
+		return 0, err
+	}
+	return writer.Count(), nil
+}
+
+// addInput adds the hashes of a dump file, or of the range files in a directory, to the index.
+func addInput(writer *breach.Writer, input string, minCount int64) error {
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return addFile(writer, input, "", minCount)
+	}
+
+	entries, err := os.ReadDir(input)
+	if err != nil {
+		return err
+	}
+	// Range files hold ascending hashes when read in the order of their names.
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToUpper(entries[i].Name()) < strings.ToUpper(entries[j].Name())
+	})
+	for _, entry := range entries {
+		prefix := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if entry.IsDir() || len(prefix) != 5 || !isHex(prefix) {
+			continue
+		}
+		if err := addFile(writer, filepath.Join(input, entry.Name()), prefix, minCount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFile adds the hashes of one file. Every line holds a hash, or the rest of one after prefix,
+// optionally followed by a colon and the number of times it was seen.
+func addFile(writer *breach.Writer, path string, prefix string, minCount int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, 1<<20)
+
+	var digest [20]byte
+	for lineNumber := 1; ; lineNumber++ {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			hash, countText, hasCount := strings.Cut(line, ":")
+			count := int64(1)
+			if hasCount {
+				if count, err = strconv.ParseInt(countText, 10, 64); err != nil {
+					return fmt.Errorf("line %d: invalid count %q", lineNumber, countText)
+				}
+			}
+			hash = prefix + hash
+			if len(hash) != 2*len(digest) {
+				return fmt.Errorf("line %d: %q is not a SHA-1 hash", lineNumber, hash)
+			}
+			if _, err := hex.Decode(digest[:], []byte(hash)); err != nil {
+				return fmt.Errorf("line %d: %q is not a SHA-1 hash", lineNumber, hash)
+			}
+			if count >= minCount {
+				if err := writer.Add(digest); err != nil {
+					return fmt.Errorf("line %d: %w (sort the input with LC_ALL=C sort first)", lineNumber, err)
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// isHex reports whether s only holds hex digits.
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s + strings.Repeat("0", len(s)%2))
+	return err == nil
+}
@@ -0,0 +1,24 @@
+package config
+
+// AdminConfig decides who may read and change the accounts of other users.
+type AdminConfig struct {
+	// Scope is the access token scope that makes its holder an admin.
+	Scope string `yaml:"scope"`
+	// UserIds are the hex ids of the users whose access tokens get Scope.
+	UserIds []string `yaml:"user_ids"`
+	// ClientSubjects are the common names of client certificates that act as admin, for tools
+	// calling the service without a user. They only count under mutual TLS.
+	ClientSubjects []string `yaml:"client_subjects"`
+}
+
+// IntrospectionConfig decides which services may introspect tokens. Introspection tells who a token
+// belongs to, so besides admins only these callers may use it.
+type IntrospectionConfig struct {
+	// Scope is the access token scope that lets its holder introspect tokens.
+	Scope string `yaml:"scope"`
+	// UserIds are the hex ids of the users, typically service accounts, whose access tokens get Scope.
+	UserIds []string `yaml:"user_ids"`
+	// ClientSubjects are the common names of client certificates that may introspect tokens without
+	// an access token. They only count under mutual TLS.
+	ClientSubjects []string `yaml:"client_subjects"`
+}
@@ -1,15 +1,126 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+	"rahulchhabra.io/password"
+)
+
+// Password hashing algorithms.
+const (
+	PasswordArgon2id = "argon2id"
+	PasswordBcrypt   = "bcrypt"
+)
+
+// Limits of PasswordConfig.BcryptCost.
+const (
+	MinBcryptCost     = bcrypt.MinCost
+	MaxBcryptCost     = bcrypt.MaxCost
+	DefaultBcryptCost = bcrypt.DefaultCost
+)
+
+// PasswordConfig holds the settings used to hash passwords.
+type PasswordConfig struct {
+	// Algorithm hashes new passwords, "argon2id" or "bcrypt". Hashes made by the other one can still
+	// be verified and are replaced at the next login, as are hashes made with other parameters.
+	Algorithm string `yaml:"algorithm"`
+	// BcryptCost is the work factor of new bcrypt hashes, each step doubles the time it takes.
+	BcryptCost int `yaml:"bcrypt_cost"`
+	// Argon2Memory is the memory cost of new argon2id hashes in KiB.
+	Argon2Memory int `yaml:"argon2_memory"`
+	// Argon2Iterations is the number of passes over the memory.
+	Argon2Iterations int `yaml:"argon2_iterations"`
+	// Argon2Parallelism is the number of threads used.
+	Argon2Parallelism int `yaml:"argon2_parallelism"`
+	// Peppers maps pepper versions to base64 encoded secrets every password is HMACed with before it
+	// is hashed. They are better kept out of the config file, in PASSWORD_PEPPERS_FILE.
+	Peppers map[string]string `yaml:"peppers"`
+	// PepperID is the version of the pepper new hashes use. The other peppers are kept to verify
+	// older hashes, which are replaced at the next login. Empty disables peppering.
+	PepperID string `yaml:"pepper_id"`
+	// Policy decides which passwords users may choose.
+	Policy PasswordPolicyConfig `yaml:"policy"`
+}
+
+// PasswordPolicyConfig holds the rules new passwords must follow. Zero values disable a rule.
+type PasswordPolicyConfig struct {
+	MinLength int `yaml:"min_length"`
+	// MaxLength bounds the work a single password hash can cause.
+	MaxLength int `yaml:"max_length"`
+	// MinCharacterClasses is how many of lower case letters, upper case letters, digits and
+	// symbols a password must contain.
+	MinCharacterClasses int `yaml:"min_character_classes"`
+	// MinStrength is the minimum zxcvbn score, from 0 to 4.
+	MinStrength int `yaml:"min_strength"`
+	// RejectPersonalInfo refuses passwords containing the email, username or name of the user.
+	RejectPersonalInfo bool `yaml:"reject_personal_info"`
+	// BreachIndex is an index built by cmd/breachindex. Passwords found in it are refused.
+	BreachIndex string `yaml:"breach_index"`
+}
+
+// Policy converts the configuration into a password.Policy.
+func (c PasswordPolicyConfig) Policy() password.Policy {
+	return password.Policy{
+		MinLength:           c.MinLength,
+		MaxLength:           c.MaxLength,
+		MinCharacterClasses: c.MinCharacterClasses,
+		MinStrength:         c.MinStrength,
+		RejectPersonalInfo:  c.RejectPersonalInfo,
+	}
+}
+
+// NewPasswordPolicy returns the rules new passwords must follow: those of Policy, and when bcrypt
+// hashes them without a pepper, its limit of 72 bytes, so longer passwords are refused as invalid
+// instead of failing to hash.
+func (c PasswordConfig) NewPasswordPolicy() password.Policy {
+	policy := c.Policy.Policy()
+	if c.Algorithm == PasswordBcrypt && c.PepperID == "" {
+		policy.MaxBytes = password.BcryptMaxLength
+	}
+	return policy
+}
+
+// Manager creates the password hasher described by the configuration.
+func (c PasswordConfig) Manager() (*password.Manager, error) {
+	argon2id := password.DefaultArgon2id()
+	argon2id.Memory = uint32(c.Argon2Memory)
+	argon2id.Iterations = uint32(c.Argon2Iterations)
+	argon2id.Parallelism = uint8(c.Argon2Parallelism)
+	bcryptHasher := password.Bcrypt{Cost: c.BcryptCost}
+	manager := password.NewManager(argon2id, bcryptHasher)
+	if c.Algorithm == PasswordBcrypt {
+		manager = password.NewManager(bcryptHasher, argon2id)
+	}
+	if c.PepperID == "" {
+		return manager, nil
+	}
+
+	peppers := make(map[string][]byte, len(c.Peppers))
+	for id, encoded := range c.Peppers {
+		pepper, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("pepper %q is not valid base64: %w", id, err)
+		}
+		peppers[id] = pepper
+	}
+	return manager.WithPeppers(c.PepperID, peppers)
+}
+
+// defaultPasswords hashes passwords with the default settings, without a pepper.
+var defaultPasswords = password.NewManager(password.DefaultArgon2id(), password.Bcrypt{Cost: DefaultBcryptCost})
 
 // CreateToken is a function that takes a password and returns a hashed version of it
-// It uses the bcrypt.GenerateFromPassword function to hash the password and returns the hashed password and an error if there is one.
+// It hashes the password with the default algorithm (argon2id) and returns the hashed password and an error if there is one.
 func CreateToken(password string) ([]byte, error) {
-	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := defaultPasswords.Hash(password)
+	return []byte(hash), err
 }
 
 // ComparePasswords is a function that takes a hashed password and a password and returns an error
 // if the password does not match the hashed password or nil if the password matches the hashed password.
 func ComparePasswords(hashedPassword string, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	_, err := defaultPasswords.Verify(hashedPassword, password)
+	return err
 }
\ No newline at end of file
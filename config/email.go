@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"rahulchhabra.io/mail"
+)
+
+// Mailers emails can be sent with.
+const (
+	MailerLog  = "log"
+	MailerSMTP = "smtp"
+)
+
+// EmailConfig holds how emails to users are sent, and the settings of the flows that send them.
+type EmailConfig struct {
+	// Mailer is "log" to write emails to the server log, for development, or "smtp" to send them.
+	Mailer string `yaml:"mailer"`
+	// From is the sender of every email, e.g. "User Service <no-reply@example.com>".
+	From          string                  `yaml:"from"`
+	SMTP          SMTPConfig              `yaml:"smtp"`
+	Verification  EmailVerificationConfig `yaml:"verification"`
+	PasswordReset PasswordResetConfig     `yaml:"password_reset"`
+}
+
+// SMTPConfig holds the server emails are sent through.
+type SMTPConfig struct {
+	// Addr is the "host:port" of the SMTP server.
+	Addr string `yaml:"addr"`
+	// Username and Password authenticate with the server when Username is set.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// EmailVerificationConfig holds the settings of the verification of email addresses.
+type EmailVerificationConfig struct {
+	// Required refuses logins to accounts whose email address is not verified yet.
+	Required bool `yaml:"required"`
+	// TTL is how long a verification link can be used.
+	TTL time.Duration `yaml:"ttl"`
+	// URL is the page of the web app that verifies the address, the token is added to it as the
+	// "token" query parameter. Without it the email holds only the token.
+	URL string `yaml:"url"`
+}
+
+// PasswordResetConfig holds the settings of resetting forgotten passwords.
+type PasswordResetConfig struct {
+	// TTL is how long a reset link can be used.
+	TTL time.Duration `yaml:"ttl"`
+	// URL is the page of the web app where users choose their new password, the token is added to
+	// it as the "token" query parameter. Without it the email holds only the token.
+	URL string `yaml:"url"`
+}
+
+// NewMailer returns the configured Mailer.
+func (c EmailConfig) NewMailer() (mail.Mailer, error) {
+	switch c.Mailer {
+	case MailerLog:
+		return mail.NewLogMailer(), nil
+	case MailerSMTP:
+		return mail.NewSMTPMailer(c.SMTP.Addr, c.From, c.SMTP.Username, c.SMTP.Password)
+	}
+	return nil, fmt.Errorf("unknown mailer %q", c.Mailer)
+}
+
+// validateLinkURL checks that a link URL, when set, is absolute so it can be opened from an email.
+func validateLinkURL(name string, link string) string {
+	if link == "" {
+		return ""
+	}
+	if parsed, err := url.Parse(link); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return fmt.Sprintf("%s must be an absolute URL, got %q", name, link)
+	}
+	return ""
+}
@@ -0,0 +1,622 @@
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"rahulchhabra.io/password"
+)
+
+// Config holds every setting of the user service.
+type Config struct {
+	Server        ServerConfig        `yaml:"server"`
+	Store         StoreConfig         `yaml:"store"`
+	Token         TokenConfig         `yaml:"token"`
+	Admin         AdminConfig         `yaml:"admin"`
+	Introspection IntrospectionConfig `yaml:"introspection"`
+	Password      PasswordConfig      `yaml:"password"`
+	Lockout       LockoutConfig       `yaml:"lockout"`
+	RateLimit     RateLimitConfig     `yaml:"rate_limit"`
+	Privacy       PrivacyConfig       `yaml:"privacy"`
+	MFA           MFAConfig           `yaml:"mfa"`
+	Passkeys      PasskeyConfig       `yaml:"passkeys"`
+	Email         EmailConfig         `yaml:"email"`
+}
+
+// Default returns the configuration used for every setting that is not configured.
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			ListenAddr: "localhost:50051",
+			TLS: TLSConfig{
+				ReloadInterval: time.Minute,
+			},
+		},
+		Store: StoreConfig{
+			Backend: StoreMongo,
+			Mongo: MongoConfig{
+				URI:                      "mongodb://localhost:27017",
+				Database:                 "testdb",
+				UsersCollection:          "users",
+				SessionsCollection:       "sessions",
+				RefreshTokensCollection:  "refresh_tokens",
+				CredentialsCollection:    "credentials",
+				IPFailuresCollection:     "ip_failures",
+				UsedChallengesCollection: "used_challenges",
+			},
+		},
+		Token: TokenConfig{
+			SigningAlgorithm: "ES256",
+			KeyRotation:      24 * time.Hour,
+			TTL:              15 * time.Minute,
+			RefreshTTL:       30 * 24 * time.Hour,
+			Issuer:           "user-service",
+			Audience:         "user-service",
+			Scopes:           []string{"profile"},
+			JWKSAddr:         "localhost:8080",
+		},
+		Admin: AdminConfig{
+			Scope: "admin",
+		},
+		Introspection: IntrospectionConfig{
+			Scope: "introspect",
+		},
+		Password: PasswordConfig{
+			Algorithm:         PasswordArgon2id,
+			BcryptCost:        DefaultBcryptCost,
+			Argon2Memory:      int(password.DefaultArgon2id().Memory),
+			Argon2Iterations:  int(password.DefaultArgon2id().Iterations),
+			Argon2Parallelism: int(password.DefaultArgon2id().Parallelism),
+			Policy: PasswordPolicyConfig{
+				MinLength:          8,
+				MaxLength:          128,
+				MinStrength:        2,
+				RejectPersonalInfo: true,
+			},
+		},
+		Lockout: LockoutConfig{
+			Threshold:   5,
+			IPThreshold: 50,
+			Duration:    15 * time.Minute,
+			BaseDelay:   time.Second,
+			MaxDelay:    30 * time.Second,
+			Window:      time.Hour,
+		},
+		RateLimit: RateLimitConfig{
+			Backend: RateLimitMemory,
+			Redis: RedisConfig{
+				Addr: "localhost:6379",
+			},
+			Default: RateLimit{Rate: 10, Burst: 20},
+			// Signups and logins are what attackers automate, so they get much tighter limits.
+			Methods: map[string]RateLimit{
+				"CreateUser":         {Rate: 0.05, Burst: 3},
+				"AuthenticateUser":   {Rate: 0.5, Burst: 10},
+				"VerifySecondFactor": {Rate: 0.5, Burst: 10},
+				"FinishPasskeyLogin": {Rate: 0.5, Burst: 10},
+				// Every call sends an email.
+				"ResendVerificationEmail": {Rate: 0.05, Burst: 3},
+				"RequestPasswordReset":    {Rate: 0.05, Burst: 3},
+				"ResetPassword":           {Rate: 0.5, Burst: 10},
+			},
+		},
+		MFA: MFAConfig{
+			Issuer:        "User Service",
+			ChallengeTTL:  5 * time.Minute,
+			TOTPSkew:      1,
+			RecoveryCodes: 10,
+			FreshLogin:    10 * time.Minute,
+		},
+		Passkeys: PasskeyConfig{
+			RPName:  "User Service",
+			Timeout: 5 * time.Minute,
+		},
+		Email: EmailConfig{
+			Mailer: MailerLog,
+			From:   "User Service <no-reply@localhost>",
+			Verification: EmailVerificationConfig{
+				TTL: 24 * time.Hour,
+			},
+			PasswordReset: PasswordResetConfig{
+				TTL: time.Hour,
+			},
+		},
+	}
+}
+
+// Load is a function that builds the configuration from, in increasing order of precedence, the
+// defaults, a YAML file, environment variables and command line flags in args.
+//
+// The file is given with the -config flag or the CONFIG_FILE environment variable. Every environment
+// variable can instead be read from a file named by the same variable with a _FILE suffix, e.g.
+// MONGO_URI_FILE=/run/secrets/mongo-uri, which keeps secrets out of the environment. When args
+// contains -h, Load prints the flags and returns flag.ErrHelp.
+func Load(args []string) (Config, error) {
+	cfg := Default()
+
+	// Parse the flags first to find the config file, but only apply them at the end so they take
+	// precedence over the file and the environment.
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagValues []flagValue
+	configFile, _, err := lookupEnv("CONFIG_FILE")
+	if err != nil {
+		return Config{}, err
+	}
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", configFile, "YAML configuration file (env CONFIG_FILE)")
+	for _, s := range settings {
+		s := s
+		flags.Func(s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env), func(value string) error {
+			flagValues = append(flagValues, flagValue{setting: s, value: value})
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments %q", flags.Args())
+	}
+
+	if configFile != "" {
+		if err := cfg.loadFile(configFile); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, s := range settings {
+		value, ok, err := lookupEnv(s.env)
+		if err != nil {
+			return Config{}, err
+		}
+		if !ok {
+			continue
+		}
+		if err := s.set(&cfg, value); err != nil {
+			// The value is left out, it may be a secret. Parse errors quote it when it is not.
+			return Config{}, fmt.Errorf("invalid %s: %w", s.env, err)
+		}
+	}
+	for _, f := range flagValues {
+		if err := f.setting.set(&cfg, f.value); err != nil {
+			return Config{}, fmt.Errorf("invalid -%s: %w", f.setting.flag, err)
+		}
+	}
+
+	// SQLite needs no server, so it gets a database file in the working directory by default.
+	if cfg.Store.Backend == StoreSQLite && cfg.Store.DSN == "" {
+		cfg.Store.DSN = "users.db"
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// loadFile overrides the configuration with the settings in the YAML file at path. Unknown keys are
+// an error, so a typo does not silently leave a setting at its default.
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks that the configuration is complete and consistent.
+func (cfg Config) Validate() error {
+	var problems []string
+	if cfg.Server.ListenAddr == "" {
+		problems = append(problems, "server.listen_addr is required")
+	}
+	if (cfg.Server.TLS.CertFile == "") != (cfg.Server.TLS.KeyFile == "") {
+		problems = append(problems, "server.tls.cert_file and server.tls.key_file must be set together")
+	}
+	if cfg.Server.TLS.ClientCAFile != "" && cfg.Server.TLS.CertFile == "" {
+		problems = append(problems, "server.tls.client_ca_file requires server.tls.cert_file and server.tls.key_file")
+	}
+	if cfg.Server.TLS.ReloadInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("server.tls.reload_interval must be positive, got %s", cfg.Server.TLS.ReloadInterval))
+	}
+
+	switch cfg.Store.Backend {
+	case StoreMemory:
+	case StoreMongo:
+		mongo := cfg.Store.Mongo
+		if mongo.URI == "" {
+			problems = append(problems, "store.mongo.uri is required for the mongo backend")
+		}
+		if mongo.Database == "" || mongo.UsersCollection == "" || mongo.SessionsCollection == "" || mongo.RefreshTokensCollection == "" || mongo.CredentialsCollection == "" ||
+			mongo.IPFailuresCollection == "" || mongo.UsedChallengesCollection == "" {
+			problems = append(problems, "store.mongo database and collection names can not be empty")
+		}
+	case StoreSQLite, StorePostgres:
+		if cfg.Store.DSN == "" {
+			problems = append(problems, fmt.Sprintf("store.dsn is required for the %s backend", cfg.Store.Backend))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("store.backend must be one of %q, %q, %q or %q, got %q", StoreMongo, StoreSQLite, StorePostgres, StoreMemory, cfg.Store.Backend))
+	}
+
+	switch cfg.Token.SigningAlgorithm {
+	case "RS256", "ES256", "EdDSA":
+	default:
+		problems = append(problems, fmt.Sprintf("token.signing_alg must be RS256, ES256 or EdDSA, got %q", cfg.Token.SigningAlgorithm))
+	}
+	if cfg.Token.GeneratesKeys() {
+		if len(cfg.Token.SigningKeys) > 0 {
+			problems = append(problems, "token.signing_keys requires token.signing_key_id")
+		}
+	} else if _, err := cfg.Token.KeySet(); err != nil {
+		problems = append(problems, fmt.Sprintf("token.signing_keys: %s", err))
+	}
+	if cfg.Admin.Scope == "" {
+		problems = append(problems, "admin.scope is required")
+	}
+	for _, scope := range cfg.Token.Scopes {
+		if scope == cfg.Admin.Scope {
+			problems = append(problems, fmt.Sprintf("admin.scope %q can not be in token.scopes, every user would be an admin", scope))
+		}
+	}
+	for _, id := range cfg.Admin.UserIds {
+		if raw, err := hex.DecodeString(id); err != nil || len(raw) != 12 {
+			problems = append(problems, fmt.Sprintf("admin.user_ids must hold hex user ids, got %q", id))
+		}
+	}
+	if len(cfg.Admin.ClientSubjects) > 0 && cfg.Server.TLS.ClientCAFile == "" {
+		problems = append(problems, "admin.client_subjects requires server.tls.client_ca_file")
+	}
+	if cfg.Introspection.Scope == "" {
+		problems = append(problems, "introspection.scope is required")
+	}
+	for _, scope := range cfg.Token.Scopes {
+		if scope == cfg.Introspection.Scope {
+			problems = append(problems, fmt.Sprintf("introspection.scope %q can not be in token.scopes, every user could introspect tokens", scope))
+		}
+	}
+	for _, id := range cfg.Introspection.UserIds {
+		if raw, err := hex.DecodeString(id); err != nil || len(raw) != 12 {
+			problems = append(problems, fmt.Sprintf("introspection.user_ids must hold hex user ids, got %q", id))
+		}
+	}
+	if len(cfg.Introspection.ClientSubjects) > 0 && cfg.Server.TLS.ClientCAFile == "" {
+		problems = append(problems, "introspection.client_subjects requires server.tls.client_ca_file")
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"token.key_rotation", cfg.Token.KeyRotation},
+		{"token.ttl", cfg.Token.TTL},
+		{"token.refresh_token_ttl", cfg.Token.RefreshTTL},
+		{"lockout.duration", cfg.Lockout.Duration},
+		{"lockout.base_delay", cfg.Lockout.BaseDelay},
+		{"lockout.max_delay", cfg.Lockout.MaxDelay},
+		{"lockout.window", cfg.Lockout.Window},
+		{"mfa.challenge_ttl", cfg.MFA.ChallengeTTL},
+		{"mfa.fresh_login", cfg.MFA.FreshLogin},
+		{"passkeys.timeout", cfg.Passkeys.Timeout},
+		{"email.verification.ttl", cfg.Email.Verification.TTL},
+		{"email.password_reset.ttl", cfg.Email.PasswordReset.TTL},
+	} {
+		if d.value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive, got %s", d.name, d.value))
+		}
+	}
+	// Challenges are signed with the keys of access tokens, which are only kept for as long as those live.
+	if cfg.MFA.ChallengeTTL > cfg.Token.KeyRetention() {
+		problems = append(problems, fmt.Sprintf("mfa.challenge_ttl can not be longer than token.ttl plus a minute, %s", cfg.Token.KeyRetention()))
+	}
+	if cfg.Lockout.Threshold < 0 || cfg.Lockout.IPThreshold < 0 {
+		problems = append(problems, "lockout.threshold and lockout.ip_threshold can not be negative")
+	}
+	if cfg.Lockout.MaxDelay < cfg.Lockout.BaseDelay {
+		problems = append(problems, "lockout.max_delay can not be shorter than lockout.base_delay")
+	}
+	switch cfg.RateLimit.Backend {
+	case RateLimitMemory:
+	case RateLimitRedis:
+		if cfg.RateLimit.Redis.Addr == "" {
+			problems = append(problems, "rate_limit.redis.addr is required for the redis backend")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("rate_limit.backend must be %q or %q, got %q", RateLimitMemory, RateLimitRedis, cfg.RateLimit.Backend))
+	}
+	rateLimits := map[string]RateLimit{"default": cfg.RateLimit.Default}
+	for method, limit := range cfg.RateLimit.Methods {
+		rateLimits["methods."+method] = limit
+	}
+	for _, name := range sortedKeys(rateLimits) {
+		if limit := rateLimits[name]; limit.Rate < 0 || (limit.Rate > 0 && limit.Burst < 1) {
+			problems = append(problems, fmt.Sprintf("rate_limit.%s needs a positive burst, or a rate of 0 to not limit", name))
+		}
+	}
+	if cfg.MFA.TOTPSkew < 0 || cfg.MFA.TOTPSkew > 10 {
+		problems = append(problems, fmt.Sprintf("mfa.totp_skew must be between 0 and 10, got %d", cfg.MFA.TOTPSkew))
+	}
+	if cfg.MFA.RecoveryCodes < 1 || cfg.MFA.RecoveryCodes > 100 {
+		problems = append(problems, fmt.Sprintf("mfa.recovery_codes must be between 1 and 100, got %d", cfg.MFA.RecoveryCodes))
+	}
+	if _, err := cfg.MFA.Keyring(); err != nil {
+		problems = append(problems, fmt.Sprintf("mfa.encryption_keys: %s", err))
+	}
+	if cfg.Passkeys.RPID != "" {
+		if len(cfg.Passkeys.Origins) == 0 {
+			problems = append(problems, "passkeys.origins is required with passkeys.rp_id")
+		} else if _, err := cfg.Passkeys.WebAuthn(); err != nil {
+			problems = append(problems, fmt.Sprintf("passkeys: %s", err))
+		}
+		// The state of a registration or login is handed to the client encrypted until it finishes.
+		if cfg.MFA.EncryptionKeyID == "" {
+			problems = append(problems, "passkeys need mfa.encryption_keys and mfa.encryption_key_id")
+		}
+	}
+	switch cfg.Email.Mailer {
+	case MailerLog:
+	case MailerSMTP:
+		if cfg.Email.SMTP.Addr == "" {
+			problems = append(problems, "email.smtp.addr is required for the smtp mailer")
+		} else if _, err := cfg.Email.NewMailer(); err != nil {
+			problems = append(problems, fmt.Sprintf("email: %s", err))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("email.mailer must be %q or %q, got %q", MailerLog, MailerSMTP, cfg.Email.Mailer))
+	}
+	if problem := validateLinkURL("email.verification.url", cfg.Email.Verification.URL); problem != "" {
+		problems = append(problems, problem)
+	}
+	if problem := validateLinkURL("email.password_reset.url", cfg.Email.PasswordReset.URL); problem != "" {
+		problems = append(problems, problem)
+	}
+	if cfg.Token.JWKSAddr == "" {
+		problems = append(problems, "token.jwks_addr is required")
+	}
+
+	passwordConfig := cfg.Password
+	switch passwordConfig.Algorithm {
+	case PasswordArgon2id, PasswordBcrypt:
+	default:
+		problems = append(problems, fmt.Sprintf("password.algorithm must be %q or %q, got %q", PasswordArgon2id, PasswordBcrypt, passwordConfig.Algorithm))
+	}
+	if passwordConfig.BcryptCost < MinBcryptCost || passwordConfig.BcryptCost > MaxBcryptCost {
+		problems = append(problems, fmt.Sprintf("password.bcrypt_cost must be between %d and %d, got %d", MinBcryptCost, MaxBcryptCost, passwordConfig.BcryptCost))
+	}
+	if passwordConfig.Argon2Parallelism < 1 || passwordConfig.Argon2Parallelism > 255 {
+		problems = append(problems, fmt.Sprintf("password.argon2_parallelism must be between 1 and 255, got %d", passwordConfig.Argon2Parallelism))
+	}
+	if passwordConfig.Argon2Iterations < 1 {
+		problems = append(problems, fmt.Sprintf("password.argon2_iterations must be positive, got %d", passwordConfig.Argon2Iterations))
+	}
+	// argon2 needs at least 8 KiB per lane.
+	if passwordConfig.Argon2Memory < 8*passwordConfig.Argon2Parallelism || passwordConfig.Argon2Memory > math.MaxUint32 {
+		problems = append(problems, fmt.Sprintf("password.argon2_memory must be at least 8 KiB per thread, got %d", passwordConfig.Argon2Memory))
+	}
+	policy := passwordConfig.Policy
+	if policy.MinLength < 0 || policy.MaxLength < 0 || (policy.MaxLength > 0 && policy.MaxLength < policy.MinLength) {
+		problems = append(problems, fmt.Sprintf("password.policy length bounds are inconsistent: min %d, max %d", policy.MinLength, policy.MaxLength))
+	}
+	if policy.MinCharacterClasses < 0 || policy.MinCharacterClasses > 4 {
+		problems = append(problems, fmt.Sprintf("password.policy.min_character_classes must be between 0 and 4, got %d", policy.MinCharacterClasses))
+	}
+	if policy.MinStrength < 0 || policy.MinStrength > 4 {
+		problems = append(problems, fmt.Sprintf("password.policy.min_strength must be between 0 and 4, got %d", policy.MinStrength))
+	}
+	if passwordConfig.PepperID != "" {
+		if _, err := passwordConfig.Manager(); err != nil {
+			problems = append(problems, fmt.Sprintf("password.peppers: %s", err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// setting is a configuration value that can be set from the environment or a flag.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+// settings lists everything that can be configured outside of the config file.
+var settings = []setting{
+	{"LISTEN_ADDR", "listen-addr", "address the gRPC server listens on", setString(func(c *Config) *string { return &c.Server.ListenAddr })},
+	{"TLS_CERT_FILE", "tls-cert", "PEM certificate chain of the server", setString(func(c *Config) *string { return &c.Server.TLS.CertFile })},
+	{"TLS_KEY_FILE", "tls-key", "PEM private key of the server certificate", setString(func(c *Config) *string { return &c.Server.TLS.KeyFile })},
+	{"TLS_CLIENT_CA_FILE", "tls-client-ca", "PEM CA certificates client certificates must be signed by", setString(func(c *Config) *string { return &c.Server.TLS.ClientCAFile })},
+	{"TLS_RELOAD_INTERVAL", "tls-reload-interval", "how often the TLS files are checked for changes", setDuration(func(c *Config) *time.Duration { return &c.Server.TLS.ReloadInterval })},
+
+	{"STORE_BACKEND", "store", "storage backend: mongo, sqlite, postgres or memory", setString(func(c *Config) *string { return &c.Store.Backend })},
+	{"STORE_DSN", "store-dsn", "SQLite file or PostgreSQL connection URL", setString(func(c *Config) *string { return &c.Store.DSN })},
+	{"MONGO_URI", "mongo-uri", "MongoDB connection URI", setString(func(c *Config) *string { return &c.Store.Mongo.URI })},
+	{"MONGO_DATABASE", "mongo-database", "MongoDB database", setString(func(c *Config) *string { return &c.Store.Mongo.Database })},
+	{"MONGO_USERS_COLLECTION", "mongo-users-collection", "MongoDB collection of users", setString(func(c *Config) *string { return &c.Store.Mongo.UsersCollection })},
+	{"MONGO_SESSIONS_COLLECTION", "mongo-sessions-collection", "MongoDB collection of sessions", setString(func(c *Config) *string { return &c.Store.Mongo.SessionsCollection })},
+	{"MONGO_REFRESH_TOKENS_COLLECTION", "mongo-refresh-tokens-collection", "MongoDB collection of refresh tokens", setString(func(c *Config) *string { return &c.Store.Mongo.RefreshTokensCollection })},
+	{"MONGO_CREDENTIALS_COLLECTION", "mongo-credentials-collection", "MongoDB collection of passkeys", setString(func(c *Config) *string { return &c.Store.Mongo.CredentialsCollection })},
+	{"MONGO_IP_FAILURES_COLLECTION", "mongo-ip-failures-collection", "MongoDB collection of failed logins per source IP", setString(func(c *Config) *string { return &c.Store.Mongo.IPFailuresCollection })},
+	{"MONGO_USED_CHALLENGES_COLLECTION", "mongo-used-challenges-collection", "MongoDB collection of used login challenges", setString(func(c *Config) *string { return &c.Store.Mongo.UsedChallengesCollection })},
+
+	{"TOKEN_SIGNING_ALG", "token-signing-alg", "access token signing algorithm: RS256, ES256 or EdDSA", setString(func(c *Config) *string { return &c.Token.SigningAlgorithm })},
+	{"TOKEN_KEY_ROTATION", "token-key-rotation", "how often the signing key is replaced", setDuration(func(c *Config) *time.Duration { return &c.Token.KeyRotation })},
+	{"TOKEN_SIGNING_KEYS", "token-signing-keys", "space separated id=base64 PKCS #8 private keys access tokens are signed with", setMap(func(c *Config) *map[string]string { return &c.Token.SigningKeys })},
+	{"TOKEN_SIGNING_KEY_ID", "token-signing-key-id", "id of the key new access tokens are signed with, empty generates keys", setString(func(c *Config) *string { return &c.Token.SigningKeyID })},
+	{"TOKEN_TTL", "token-ttl", "access token lifetime", setDuration(func(c *Config) *time.Duration { return &c.Token.TTL })},
+	{"REFRESH_TOKEN_TTL", "refresh-token-ttl", "refresh token lifetime", setDuration(func(c *Config) *time.Duration { return &c.Token.RefreshTTL })},
+	{"TOKEN_ISSUER", "token-issuer", "iss claim of access tokens", setString(func(c *Config) *string { return &c.Token.Issuer })},
+	{"TOKEN_AUDIENCE", "token-audience", "aud claim of access tokens", setString(func(c *Config) *string { return &c.Token.Audience })},
+	{"TOKEN_SCOPES", "token-scopes", "space separated scopes granted to every access token", setFields(func(c *Config) *[]string { return &c.Token.Scopes })},
+	{"ADMIN_SCOPE", "admin-scope", "access token scope that makes its holder an admin", setString(func(c *Config) *string { return &c.Admin.Scope })},
+	{"ADMIN_USER_IDS", "admin-user-ids", "space separated ids of the users whose access tokens get the admin scope", setFields(func(c *Config) *[]string { return &c.Admin.UserIds })},
+	{"ADMIN_CLIENT_SUBJECTS", "admin-client-subjects", "space separated common names of client certificates that act as admin under mutual TLS", setFields(func(c *Config) *[]string { return &c.Admin.ClientSubjects })},
+	{"INTROSPECTION_SCOPE", "introspection-scope", "access token scope that lets its holder introspect tokens", setString(func(c *Config) *string { return &c.Introspection.Scope })},
+	{"INTROSPECTION_USER_IDS", "introspection-user-ids", "space separated ids of the users whose access tokens get the introspection scope", setFields(func(c *Config) *[]string { return &c.Introspection.UserIds })},
+	{"INTROSPECTION_CLIENT_SUBJECTS", "introspection-client-subjects", "space separated common names of client certificates that may introspect tokens under mutual TLS", setFields(func(c *Config) *[]string { return &c.Introspection.ClientSubjects })},
+	{"JWKS_ADDR", "jwks-addr", "address of the HTTP server publishing the public keys", setString(func(c *Config) *string { return &c.Token.JWKSAddr })},
+
+	{"PASSWORD_ALGORITHM", "password-algorithm", "password hashing algorithm: argon2id or bcrypt", setString(func(c *Config) *string { return &c.Password.Algorithm })},
+	{"BCRYPT_COST", "bcrypt-cost", "bcrypt cost of new password hashes", setInt(func(c *Config) *int { return &c.Password.BcryptCost })},
+	{"ARGON2_MEMORY", "argon2-memory", "argon2id memory cost in KiB", setInt(func(c *Config) *int { return &c.Password.Argon2Memory })},
+	{"ARGON2_ITERATIONS", "argon2-iterations", "argon2id passes over the memory", setInt(func(c *Config) *int { return &c.Password.Argon2Iterations })},
+	{"ARGON2_PARALLELISM", "argon2-parallelism", "argon2id threads", setInt(func(c *Config) *int { return &c.Password.Argon2Parallelism })},
+	{"PASSWORD_PEPPERS", "password-peppers", "space separated version=base64 secrets passwords are HMACed with", setMap(func(c *Config) *map[string]string { return &c.Password.Peppers })},
+	{"PASSWORD_PEPPER_ID", "password-pepper-id", "version of the pepper new password hashes use", setString(func(c *Config) *string { return &c.Password.PepperID })},
+	{"PASSWORD_MIN_LENGTH", "password-min-length", "minimum password length", setInt(func(c *Config) *int { return &c.Password.Policy.MinLength })},
+	{"PASSWORD_MAX_LENGTH", "password-max-length", "maximum password length, 0 for none", setInt(func(c *Config) *int { return &c.Password.Policy.MaxLength })},
+	{"PASSWORD_MIN_CHARACTER_CLASSES", "password-min-character-classes", "how many of lower, upper, digit and symbol characters a password needs", setInt(func(c *Config) *int { return &c.Password.Policy.MinCharacterClasses })},
+	{"PASSWORD_MIN_STRENGTH", "password-min-strength", "minimum zxcvbn score of a password, 0 to 4", setInt(func(c *Config) *int { return &c.Password.Policy.MinStrength })},
+	{"PASSWORD_REJECT_PERSONAL_INFO", "password-reject-personal-info", "refuse passwords containing the email, username or name", setBool(func(c *Config) *bool { return &c.Password.Policy.RejectPersonalInfo })},
+	{"PASSWORD_BREACH_INDEX", "password-breach-index", "index of breached passwords built by cmd/breachindex", setString(func(c *Config) *string { return &c.Password.Policy.BreachIndex })},
+
+	{"LOCKOUT_THRESHOLD", "lockout-threshold", "failed logins in a row that lock an account, 0 disables", setInt(func(c *Config) *int { return &c.Lockout.Threshold })},
+	{"LOCKOUT_IP_THRESHOLD", "lockout-ip-threshold", "failed logins in a row that lock out a source IP, 0 disables", setInt(func(c *Config) *int { return &c.Lockout.IPThreshold })},
+	{"LOCKOUT_DURATION", "lockout-duration", "how long a lockout lasts", setDuration(func(c *Config) *time.Duration { return &c.Lockout.Duration })},
+	{"LOCKOUT_BASE_DELAY", "lockout-base-delay", "wait after the second failed login in a row, doubling with every further one", setDuration(func(c *Config) *time.Duration { return &c.Lockout.BaseDelay })},
+	{"LOCKOUT_MAX_DELAY", "lockout-max-delay", "longest wait between failed logins before the lockout", setDuration(func(c *Config) *time.Duration { return &c.Lockout.MaxDelay })},
+	{"LOCKOUT_WINDOW", "lockout-window", "failed logins further apart than this do not add up", setDuration(func(c *Config) *time.Duration { return &c.Lockout.Window })},
+
+	{"RATE_LIMIT_BACKEND", "rate-limit-backend", "where rate limits are kept: memory or redis", setString(func(c *Config) *string { return &c.RateLimit.Backend })},
+	{"REDIS_ADDR", "redis-addr", "address of Redis", setString(func(c *Config) *string { return &c.RateLimit.Redis.Addr })},
+	{"REDIS_PASSWORD", "redis-password", "password of Redis", setString(func(c *Config) *string { return &c.RateLimit.Redis.Password })},
+	{"REDIS_DB", "redis-db", "Redis database number", setInt(func(c *Config) *int { return &c.RateLimit.Redis.DB })},
+
+	{"MFA_ISSUER", "mfa-issuer", "name of the service in authenticator apps", setString(func(c *Config) *string { return &c.MFA.Issuer })},
+	{"MFA_ENCRYPTION_KEYS", "mfa-encryption-keys", "space separated version=base64 keys TOTP secrets are encrypted with", setMap(func(c *Config) *map[string]string { return &c.MFA.EncryptionKeys })},
+	{"MFA_ENCRYPTION_KEY_ID", "mfa-encryption-key-id", "version of the key new TOTP secrets are encrypted with", setString(func(c *Config) *string { return &c.MFA.EncryptionKeyID })},
+	{"MFA_CHALLENGE_TTL", "mfa-challenge-ttl", "how long the second factor can be given after the password", setDuration(func(c *Config) *time.Duration { return &c.MFA.ChallengeTTL })},
+	{"MFA_TOTP_SKEW", "mfa-totp-skew", "steps of 30 seconds a TOTP code may be early or late", setInt(func(c *Config) *int { return &c.MFA.TOTPSkew })},
+	{"MFA_RECOVERY_CODES", "mfa-recovery-codes", "number of recovery codes a user gets", setInt(func(c *Config) *int { return &c.MFA.RecoveryCodes })},
+	{"MFA_FRESH_LOGIN", "mfa-fresh-login", "how recently a user must have logged in to turn on TOTP, regenerate recovery codes, register a passkey or change their email", setDuration(func(c *Config) *time.Duration { return &c.MFA.FreshLogin })},
+	{"PASSKEY_RP_ID", "passkey-rp-id", "domain passkeys are bound to, passkeys are disabled without it", setString(func(c *Config) *string { return &c.Passkeys.RPID })},
+	{"PASSKEY_RP_NAME", "passkey-rp-name", "name of the service shown when creating a passkey", setString(func(c *Config) *string { return &c.Passkeys.RPName })},
+	{"PASSKEY_ORIGINS", "passkey-origins", "space separated origins of the web apps allowed to use passkeys", setFields(func(c *Config) *[]string { return &c.Passkeys.Origins })},
+	{"PASSKEY_TIMEOUT", "passkey-timeout", "how long a passkey registration or login can take", setDuration(func(c *Config) *time.Duration { return &c.Passkeys.Timeout })},
+
+	{"EMAIL_MAILER", "email-mailer", "how emails are sent: log or smtp", setString(func(c *Config) *string { return &c.Email.Mailer })},
+	{"EMAIL_FROM", "email-from", "sender of the emails to users", setString(func(c *Config) *string { return &c.Email.From })},
+	{"SMTP_ADDR", "smtp-addr", "host:port of the SMTP server", setString(func(c *Config) *string { return &c.Email.SMTP.Addr })},
+	{"SMTP_USERNAME", "smtp-username", "username of the SMTP server", setString(func(c *Config) *string { return &c.Email.SMTP.Username })},
+	{"SMTP_PASSWORD", "smtp-password", "password of the SMTP server", setString(func(c *Config) *string { return &c.Email.SMTP.Password })},
+	{"EMAIL_VERIFICATION_REQUIRED", "email-verification-required", "refuse logins until the email address is verified", setBool(func(c *Config) *bool { return &c.Email.Verification.Required })},
+	{"EMAIL_VERIFICATION_TTL", "email-verification-ttl", "how long a verification link can be used", setDuration(func(c *Config) *time.Duration { return &c.Email.Verification.TTL })},
+	{"EMAIL_VERIFICATION_URL", "email-verification-url", "page of the web app verifying email addresses, the token is added as ?token=", setString(func(c *Config) *string { return &c.Email.Verification.URL })},
+	{"PASSWORD_RESET_TTL", "password-reset-ttl", "how long a password reset link can be used", setDuration(func(c *Config) *time.Duration { return &c.Email.PasswordReset.TTL })},
+	{"PASSWORD_RESET_URL", "password-reset-url", "page of the web app choosing a new password, the token is added as ?token=", setString(func(c *Config) *string { return &c.Email.PasswordReset.URL })},
+
+	{"HIDE_ACCOUNT_EXISTENCE", "hide-account-existence", "answer logins and signups the same whether or not the account exists", setBool(func(c *Config) *bool { return &c.Privacy.HideAccountExistence })},
+}
+
+// sortedKeys returns the keys of m in order, for messages that do not change from run to run.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+func setFields(field func(*Config) *[]string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = strings.Fields(value)
+		return nil
+	}
+}
+
+func setMap(field func(*Config) *map[string]string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		parsed := make(map[string]string)
+		for _, pair := range strings.Fields(value) {
+			key, val, ok := strings.Cut(pair, "=")
+			if !ok || key == "" {
+				return errors.New("expected space separated key=value pairs")
+			}
+			parsed[key] = val
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+func setDuration(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+// lookupEnv returns the value of the environment variable key. When key is not set but key_FILE is,
+// the value is read from the file that names, without its trailing newline.
+func lookupEnv(key string) (string, bool, error) {
+	value, ok := os.LookupEnv(key)
+	file, fileOk := os.LookupEnv(key + "_FILE")
+	ok, fileOk = ok && value != "", fileOk && file != ""
+	if ok && fileOk {
+		return "", false, fmt.Errorf("only one of %s and %s_FILE can be set", key, key)
+	}
+	if ok {
+		return value, true, nil
+	}
+	if !fileOk {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("read %s_FILE: %w", key, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
@@ -0,0 +1,360 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every variable Load reads, so the environment of the test run does not leak in.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range []string{"CONFIG_FILE", "CONFIG_FILE_FILE"} {
+		t.Setenv(key, "")
+	}
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+		t.Setenv(s.env+"_FILE", "")
+	}
+}
+
+// writeFile writes content to a file in a temporary directory and returns its path.
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := `
+server:
+  listen_addr: file:1
+token:
+  ttl: 10m
+  scopes: [profile, email]
+mfa:
+  issuer: File
+`
+	for _, test := range []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		listen string
+		ttl    time.Duration
+		scopes string
+	}{
+		{"the file overrides the defaults", nil, nil, "file:1", 10 * time.Minute, "profile email"},
+		{"the environment overrides the file", map[string]string{"LISTEN_ADDR": "env:2", "TOKEN_SCOPES": "profile"}, nil, "env:2", 10 * time.Minute, "profile"},
+		{"flags override the environment", map[string]string{"LISTEN_ADDR": "env:2", "TOKEN_TTL": "20m"}, []string{"-listen-addr", "flag:3"}, "flag:3", 20 * time.Minute, "profile email"},
+		{"the last of repeated flags wins", nil, []string{"-token-ttl", "5m", "-token-ttl", "6m"}, "file:1", 6 * time.Minute, "profile email"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := Load(append([]string{"-config", writeFile(t, "config.yaml", file)}, test.args...))
+			if err != nil {
+				t.Fatalf("Load: %s", err)
+			}
+			if cfg.Server.ListenAddr != test.listen || cfg.Token.TTL != test.ttl || strings.Join(cfg.Token.Scopes, " ") != test.scopes {
+				t.Errorf("got listen_addr %q, ttl %s and scopes %q, want %q, %s and %q", cfg.Server.ListenAddr, cfg.Token.TTL, cfg.Token.Scopes, test.listen, test.ttl, test.scopes)
+			}
+			// Settings no layer sets keep the file or default value.
+			if cfg.MFA.Issuer != "File" || cfg.Token.RefreshTTL != Default().Token.RefreshTTL {
+				t.Errorf("got mfa.issuer %q and refresh_token_ttl %s, want File and the default", cfg.MFA.Issuer, cfg.Token.RefreshTTL)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	clearEnv(t)
+	fromEnv := writeFile(t, "env.yaml", "server:\n  listen_addr: env-file:1\n")
+	fromFlag := writeFile(t, "flag.yaml", "server:\n  listen_addr: flag-file:1\n")
+
+	t.Setenv("CONFIG_FILE", fromEnv)
+	if cfg, err := Load(nil); err != nil || cfg.Server.ListenAddr != "env-file:1" {
+		t.Errorf("Load with CONFIG_FILE: got %q, %v", cfg.Server.ListenAddr, err)
+	}
+	if cfg, err := Load([]string{"-config", fromFlag}); err != nil || cfg.Server.ListenAddr != "flag-file:1" {
+		t.Errorf("Load with CONFIG_FILE and -config: got %q, %v, want the file of the flag", cfg.Server.ListenAddr, err)
+	}
+	// An empty file leaves every setting at its default.
+	if cfg, err := Load([]string{"-config", writeFile(t, "empty.yaml", "")}); err != nil || cfg.Server.ListenAddr != Default().Server.ListenAddr {
+		t.Errorf("Load with an empty file: got %q, %v", cfg.Server.ListenAddr, err)
+	}
+}
+
+func TestLoadFromFiles(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("MONGO_URI_FILE", writeFile(t, "mongo-uri", "mongodb://secret@db:27017\r\n"))
+	t.Setenv("TOKEN_SCOPES_FILE", writeFile(t, "scopes", "profile\nemail\n"))
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if cfg.Store.Mongo.URI != "mongodb://secret@db:27017" {
+		t.Errorf("got mongo uri %q, want the file without its trailing newline", cfg.Store.Mongo.URI)
+	}
+	if got := strings.Join(cfg.Token.Scopes, " "); got != "profile email" {
+		t.Errorf("got scopes %q, want %q", got, "profile email")
+	}
+
+	// A flag still overrides a value read from a file.
+	if cfg, err := Load([]string{"-mongo-uri", "mongodb://flag:27017"}); err != nil || cfg.Store.Mongo.URI != "mongodb://flag:27017" {
+		t.Errorf("Load with MONGO_URI_FILE and -mongo-uri: got %q, %v", cfg.Store.Mongo.URI, err)
+	}
+
+	// An empty variable counts as not set.
+	t.Setenv("MONGO_URI", "")
+	if _, err := Load(nil); err != nil {
+		t.Errorf("Load with an empty MONGO_URI and MONGO_URI_FILE: %s", err)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		env  map[string]string
+		file string
+		args []string
+		want string
+	}{
+		{"a variable and its file", map[string]string{"MONGO_URI": "mongodb://env:27017", "MONGO_URI_FILE": "/run/secrets/mongo-uri"}, "", nil, "only one of MONGO_URI and MONGO_URI_FILE can be set"},
+		{"a missing file", map[string]string{"MONGO_URI_FILE": "/nonexistent/mongo-uri"}, "", nil, "read MONGO_URI_FILE"},
+		{"a missing config file", nil, "", []string{"-config", "/nonexistent/config.yaml"}, "read config file"},
+		{"an unknown key", nil, "server:\n  listen_adr: localhost:1\n", nil, "field listen_adr not found"},
+		{"an invalid duration in the environment", map[string]string{"TOKEN_TTL": "soon"}, "", nil, "invalid TOKEN_TTL"},
+		{"an invalid number flag", nil, "", []string{"-bcrypt-cost", "high"}, "invalid -bcrypt-cost"},
+		{"an invalid map", map[string]string{"PASSWORD_PEPPERS": "v1"}, "", nil, "expected space separated key=value pairs"},
+		{"an unknown flag", nil, "", []string{"-listen", "localhost:1"}, "flag provided but not defined"},
+		{"arguments", nil, "", []string{"serve"}, "unexpected arguments"},
+		{"an invalid configuration", map[string]string{"STORE_BACKEND": "cassandra"}, "", nil, "store.backend must be one of"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			args := test.args
+			if test.file != "" {
+				args = append([]string{"-config", writeFile(t, "config.yaml", test.file)}, args...)
+			}
+			if _, err := Load(args); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadSQLiteDefaultDSN(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("STORE_BACKEND", StoreSQLite)
+	if cfg, err := Load(nil); err != nil || cfg.Store.DSN != "users.db" {
+		t.Errorf("got dsn %q, %v, want users.db", cfg.Store.DSN, err)
+	}
+}
+
+// signingKey returns a base64 encoded PKCS #8 Ed25519 private key.
+func signingKey(t *testing.T) string {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("the defaults are invalid: %s", err)
+	}
+
+	secret := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	userId := "65f1a2b3c4d5e6f708192a3b"
+	for _, test := range []struct {
+		name   string
+		change func(cfg *Config)
+		want   string
+	}{
+		// Valid configurations, which must not report a problem.
+		{"configured signing keys", func(c *Config) {
+			c.Token.SigningKeys = map[string]string{"a": signingKey(t), "b": signingKey(t)}
+			c.Token.SigningKeyID = "b"
+		}, ""},
+		{"mutual TLS with admin and introspection clients", func(c *Config) {
+			c.Server.TLS = TLSConfig{CertFile: "server.pem", KeyFile: "server-key.pem", ClientCAFile: "ca.pem", ReloadInterval: time.Minute}
+			c.Admin.ClientSubjects = []string{"ops"}
+			c.Introspection.ClientSubjects = []string{"gateway"}
+		}, ""},
+		{"admin and introspection users", func(c *Config) {
+			c.Admin.UserIds = []string{userId}
+			c.Introspection.UserIds = []string{userId}
+		}, ""},
+		{"passkeys", func(c *Config) {
+			c.Passkeys.RPID = "example.com"
+			c.Passkeys.Origins = []string{"https://example.com"}
+			c.MFA.EncryptionKeys = map[string]string{"1": secret}
+			c.MFA.EncryptionKeyID = "1"
+		}, ""},
+		{"peppers", func(c *Config) {
+			c.Password.Peppers = map[string]string{"1": secret}
+			c.Password.PepperID = "1"
+		}, ""},
+		{"a disabled rate limit", func(c *Config) { c.RateLimit.Methods["CreateUser"] = RateLimit{} }, ""},
+
+		{"no listen address", func(c *Config) { c.Server.ListenAddr = "" }, "server.listen_addr is required"},
+		{"a certificate without a key", func(c *Config) { c.Server.TLS.CertFile = "server.pem" }, "server.tls.cert_file and server.tls.key_file must be set together"},
+		{"a client CA without TLS", func(c *Config) { c.Server.TLS.ClientCAFile = "ca.pem" }, "server.tls.client_ca_file requires"},
+		{"no TLS reload interval", func(c *Config) { c.Server.TLS.ReloadInterval = 0 }, "server.tls.reload_interval must be positive"},
+
+		{"no MongoDB URI", func(c *Config) { c.Store.Mongo.URI = "" }, "store.mongo.uri is required"},
+		{"no MongoDB collection", func(c *Config) { c.Store.Mongo.UsedChallengesCollection = "" }, "store.mongo database and collection names can not be empty"},
+		{"no PostgreSQL DSN", func(c *Config) { c.Store.Backend = StorePostgres }, "store.dsn is required for the postgres backend"},
+		{"an unknown store", func(c *Config) { c.Store.Backend = "cassandra" }, "store.backend must be one of"},
+
+		{"an unknown signing algorithm", func(c *Config) { c.Token.SigningAlgorithm = "HS256" }, "token.signing_alg must be RS256, ES256 or EdDSA"},
+		{"signing keys without an id", func(c *Config) { c.Token.SigningKeys = map[string]string{"a": signingKey(t)} }, "token.signing_keys requires token.signing_key_id"},
+		{"an unknown signing key id", func(c *Config) {
+			c.Token.SigningKeys = map[string]string{"a": signingKey(t)}
+			c.Token.SigningKeyID = "b"
+		}, "token.signing_keys"},
+		{"a signing key that is not base64", func(c *Config) {
+			c.Token.SigningKeys = map[string]string{"a": "not base64!"}
+			c.Token.SigningKeyID = "a"
+		}, `signing key "a" is not valid base64`},
+		{"a signing key that is not a key", func(c *Config) {
+			c.Token.SigningKeys = map[string]string{"a": secret}
+			c.Token.SigningKeyID = "a"
+		}, "token.signing_keys"},
+		{"no JWKS address", func(c *Config) { c.Token.JWKSAddr = "" }, "token.jwks_addr is required"},
+
+		{"no admin scope", func(c *Config) { c.Admin.Scope = "" }, "admin.scope is required"},
+		{"the admin scope for everyone", func(c *Config) { c.Token.Scopes = append(c.Token.Scopes, "admin") }, `admin.scope "admin" can not be in token.scopes`},
+		{"an admin user id that is not hex", func(c *Config) { c.Admin.UserIds = []string{"alice"} }, `admin.user_ids must hold hex user ids, got "alice"`},
+		{"admin clients without a client CA", func(c *Config) { c.Admin.ClientSubjects = []string{"ops"} }, "admin.client_subjects requires server.tls.client_ca_file"},
+		{"no introspection scope", func(c *Config) { c.Introspection.Scope = "" }, "introspection.scope is required"},
+		{"the introspection scope for everyone", func(c *Config) { c.Token.Scopes = append(c.Token.Scopes, "introspect") }, `introspection.scope "introspect" can not be in token.scopes`},
+		{"an introspection user id that is too short", func(c *Config) { c.Introspection.UserIds = []string{"65f1a2b3"} }, "introspection.user_ids must hold hex user ids"},
+		{"introspection clients without a client CA", func(c *Config) { c.Introspection.ClientSubjects = []string{"gateway"} }, "introspection.client_subjects requires server.tls.client_ca_file"},
+
+		{"no token lifetime", func(c *Config) { c.Token.TTL = 0 }, "token.ttl must be positive"},
+		{"a negative key rotation", func(c *Config) { c.Token.KeyRotation = -time.Hour }, "token.key_rotation must be positive"},
+		{"no refresh token lifetime", func(c *Config) { c.Token.RefreshTTL = 0 }, "token.refresh_token_ttl must be positive"},
+		{"no lockout duration", func(c *Config) { c.Lockout.Duration = 0 }, "lockout.duration must be positive"},
+		{"no lockout window", func(c *Config) { c.Lockout.Window = 0 }, "lockout.window must be positive"},
+		{"no fresh login", func(c *Config) { c.MFA.FreshLogin = 0 }, "mfa.fresh_login must be positive"},
+		{"no passkey timeout", func(c *Config) { c.Passkeys.Timeout = 0 }, "passkeys.timeout must be positive"},
+		{"no verification lifetime", func(c *Config) { c.Email.Verification.TTL = 0 }, "email.verification.ttl must be positive"},
+		{"no password reset lifetime", func(c *Config) { c.Email.PasswordReset.TTL = 0 }, "email.password_reset.ttl must be positive"},
+		{"challenges outliving their keys", func(c *Config) { c.MFA.ChallengeTTL = c.Token.TTL + 2*time.Minute }, "mfa.challenge_ttl can not be longer than token.ttl plus a minute"},
+
+		{"a negative lockout threshold", func(c *Config) { c.Lockout.IPThreshold = -1 }, "lockout.threshold and lockout.ip_threshold can not be negative"},
+		{"a maximum delay below the base delay", func(c *Config) { c.Lockout.MaxDelay = c.Lockout.BaseDelay / 2 }, "lockout.max_delay can not be shorter than lockout.base_delay"},
+
+		{"no Redis address", func(c *Config) {
+			c.RateLimit.Backend = RateLimitRedis
+			c.RateLimit.Redis.Addr = ""
+		}, "rate_limit.redis.addr is required"},
+		{"an unknown rate limit backend", func(c *Config) { c.RateLimit.Backend = "memcached" }, "rate_limit.backend must be"},
+		{"a rate limit without a burst", func(c *Config) { c.RateLimit.Methods["CreateUser"] = RateLimit{Rate: 1} }, "rate_limit.methods.CreateUser needs a positive burst"},
+		{"a negative default rate", func(c *Config) { c.RateLimit.Default.Rate = -1 }, "rate_limit.default needs a positive burst"},
+
+		{"a TOTP skew too large", func(c *Config) { c.MFA.TOTPSkew = 11 }, "mfa.totp_skew must be between 0 and 10"},
+		{"no recovery codes", func(c *Config) { c.MFA.RecoveryCodes = 0 }, "mfa.recovery_codes must be between 1 and 100"},
+		{"an unknown encryption key id", func(c *Config) {
+			c.MFA.EncryptionKeys = map[string]string{"1": secret}
+			c.MFA.EncryptionKeyID = "2"
+		}, "mfa.encryption_keys"},
+		{"a short encryption key", func(c *Config) {
+			c.MFA.EncryptionKeys = map[string]string{"1": base64.StdEncoding.EncodeToString(make([]byte, 16))}
+			c.MFA.EncryptionKeyID = "1"
+		}, `encryption key "1" must be 32 bytes`},
+
+		{"passkeys without origins", func(c *Config) {
+			c.Passkeys.RPID = "example.com"
+			c.MFA.EncryptionKeys = map[string]string{"1": secret}
+			c.MFA.EncryptionKeyID = "1"
+		}, "passkeys.origins is required with passkeys.rp_id"},
+		{"passkeys without encryption keys", func(c *Config) {
+			c.Passkeys.RPID = "example.com"
+			c.Passkeys.Origins = []string{"https://example.com"}
+		}, "passkeys need mfa.encryption_keys and mfa.encryption_key_id"},
+
+		{"SMTP without an address", func(c *Config) { c.Email.Mailer = MailerSMTP }, "email.smtp.addr is required for the smtp mailer"},
+		{"SMTP with an invalid sender", func(c *Config) {
+			c.Email.Mailer = MailerSMTP
+			c.Email.SMTP.Addr = "smtp.example.com:587"
+			c.Email.From = "not an address"
+		}, "email: invalid sender"},
+		{"an unknown mailer", func(c *Config) { c.Email.Mailer = "pigeon" }, "email.mailer must be"},
+		{"a relative verification URL", func(c *Config) { c.Email.Verification.URL = "/verify" }, `email.verification.url must be an absolute URL, got "/verify"`},
+		{"a password reset URL without a host", func(c *Config) { c.Email.PasswordReset.URL = "https:///reset" }, "email.password_reset.url must be an absolute URL"},
+
+		{"an unknown password algorithm", func(c *Config) { c.Password.Algorithm = "md5" }, "password.algorithm must be"},
+		{"a bcrypt cost too low", func(c *Config) { c.Password.BcryptCost = MinBcryptCost - 1 }, "password.bcrypt_cost must be between"},
+		{"no argon2 parallelism", func(c *Config) { c.Password.Argon2Parallelism = 0 }, "password.argon2_parallelism must be between 1 and 255"},
+		{"no argon2 iterations", func(c *Config) { c.Password.Argon2Iterations = 0 }, "password.argon2_iterations must be positive"},
+		{"too little argon2 memory", func(c *Config) {
+			c.Password.Argon2Parallelism = 4
+			c.Password.Argon2Memory = 31
+		}, "password.argon2_memory must be at least 8 KiB per thread"},
+		{"a maximum length below the minimum", func(c *Config) { c.Password.Policy.MaxLength = c.Password.Policy.MinLength - 1 }, "password.policy length bounds are inconsistent"},
+		{"too many character classes", func(c *Config) { c.Password.Policy.MinCharacterClasses = 5 }, "password.policy.min_character_classes must be between 0 and 4"},
+		{"a strength above 4", func(c *Config) { c.Password.Policy.MinStrength = 5 }, "password.policy.min_strength must be between 0 and 4"},
+		{"an unknown pepper id", func(c *Config) {
+			c.Password.Peppers = map[string]string{"1": secret}
+			c.Password.PepperID = "2"
+		}, "password.peppers"},
+		{"a short pepper", func(c *Config) {
+			c.Password.Peppers = map[string]string{"1": base64.StdEncoding.EncodeToString([]byte("short"))}
+			c.Password.PepperID = "1"
+		}, `pepper "1" must be at least`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Default()
+			test.change(&cfg)
+
+			err := cfg.Validate()
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("got %s, want no problem", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want a problem containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := Default()
+	cfg.Server.ListenAddr = ""
+	cfg.Token.JWKSAddr = ""
+	cfg.MFA.TOTPSkew = -1
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate succeeded")
+	}
+	for _, want := range []string{"server.listen_addr is required", "token.jwks_addr is required", "mfa.totp_skew must be between 0 and 10"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %s, missing %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package config
+
+import "time"
+
+// LockoutConfig slows down and then locks out clients that keep failing to log in.
+//
+// After the second failure in a row on an account a client has to wait BaseDelay before trying
+// again, and the wait doubles with every further failure up to MaxDelay. Once an account reaches
+// Threshold failures it is locked for Duration. A source IP reaching IPThreshold failures, across
+// all accounts, is refused for Duration as well; IPs are not slowed down before that, as many users
+// can share one. Failures more than Window apart do not add up.
+type LockoutConfig struct {
+	// Threshold is the number of failures that locks an account, 0 disables tracking accounts.
+	Threshold int `yaml:"threshold"`
+	// IPThreshold is the number of failures that locks out a source IP, 0 disables tracking IPs.
+	IPThreshold int           `yaml:"ip_threshold"`
+	Duration    time.Duration `yaml:"duration"`
+	BaseDelay   time.Duration `yaml:"base_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+	Window      time.Duration `yaml:"window"`
+}
+
+// Delay returns how long a client has to wait before trying again after the given number of
+// failures in a row, when threshold failures lock it out.
+func (c LockoutConfig) Delay(failures int, threshold int) time.Duration {
+	if threshold > 0 && failures >= threshold {
+		return c.Duration
+	}
+	if failures < 2 {
+		return 0
+	}
+	delay := c.BaseDelay
+	for i := 2; i < failures && delay < c.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxDelay {
+		delay = c.MaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"rahulchhabra.io/encryption"
+)
+
+// MFAConfig holds the settings of two-factor authentication with TOTP authenticator apps.
+type MFAConfig struct {
+	// Issuer names the service in authenticator apps.
+	Issuer string `yaml:"issuer"`
+	// EncryptionKeys maps versions to the base64 encoded 32 byte keys TOTP secrets are encrypted
+	// and recovery codes hashed with. New secrets use the key with version EncryptionKeyID; older
+	// keys must stay configured for as long as secrets and recovery codes made with them are stored.
+	// TOTP can not be enrolled without a key.
+	EncryptionKeys  map[string]string `yaml:"encryption_keys"`
+	EncryptionKeyID string            `yaml:"encryption_key_id"`
+	// ChallengeTTL is how long a user has to give the second factor after the password. Challenges
+	// are signed like access tokens, so it can not be longer than TokenConfig.KeyRetention.
+	ChallengeTTL time.Duration `yaml:"challenge_ttl"`
+	// TOTPSkew is how many steps of 30 seconds a code may be early or late, for clocks that drift.
+	TOTPSkew int `yaml:"totp_skew"`
+	// RecoveryCodes is how many single use recovery codes a user gets when enrolling TOTP.
+	RecoveryCodes int `yaml:"recovery_codes"`
+	// FreshLogin is how recently a user must have logged in to turn on TOTP, regenerate the recovery
+	// codes, register a passkey or change their email address.
+	FreshLogin time.Duration `yaml:"fresh_login"`
+}
+
+// Keyring returns the keys TOTP secrets are encrypted with, or nil when none are configured.
+func (c MFAConfig) Keyring() (*encryption.Keyring, error) {
+	if c.EncryptionKeyID == "" {
+		return nil, nil
+	}
+	keys := make(map[string][]byte, len(c.EncryptionKeys))
+	for id, encoded := range c.EncryptionKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q is not valid base64: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return encryption.NewKeyring(c.EncryptionKeyID, keys)
+}
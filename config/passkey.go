@@ -0,0 +1,40 @@
+package config
+
+import (
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// PasskeyConfig holds the WebAuthn relying party settings passkeys are registered and used with.
+type PasskeyConfig struct {
+	// RPID is the domain passkeys are bound to, e.g. "example.com". Passkeys are disabled without it.
+	RPID string `yaml:"rp_id"`
+	// RPName names the service when the browser asks to create a passkey.
+	RPName string `yaml:"rp_name"`
+	// Origins are the origins of the web apps allowed to use the passkeys, e.g. "https://example.com".
+	Origins []string `yaml:"origins"`
+	// Timeout is how long a registration or login can take from begin to finish.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// WebAuthn returns the relying party passkeys are checked with, or nil when passkeys are disabled.
+func (c PasskeyConfig) WebAuthn() (*webauthn.WebAuthn, error) {
+	if c.RPID == "" {
+		return nil, nil
+	}
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: c.Timeout, TimeoutUVD: c.Timeout}
+	return webauthn.New(&webauthn.Config{
+		RPID:          c.RPID,
+		RPDisplayName: c.RPName,
+		RPOrigins:     c.Origins,
+		// Passkeys replace the password, so the authenticator has to verify the user, e.g. with a
+		// fingerprint or PIN, and has to keep the credential itself so no username is needed.
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+}
@@ -0,0 +1,12 @@
+package config
+
+// PrivacyConfig controls what the service lets callers learn about which accounts exist.
+type PrivacyConfig struct {
+	// HideAccountExistence makes logins and signups answer the same, and take as long, whether or
+	// not an account exists. Locked accounts then refuse logins with the usual invalid credentials
+	// error, and signups no longer return the new user. Usernames are public, so a taken username is
+	// still reported. Logins with the right password of an account whose email address is not
+	// verified yet are still told so, see email.verification.required. Looking up accounts by id or
+	// email needs no setting, only the account itself or an admin can do it.
+	HideAccountExistence bool `yaml:"hide_account_existence"`
+}
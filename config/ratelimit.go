@@ -0,0 +1,33 @@
+package config
+
+// Rate limit backends.
+const (
+	RateLimitMemory = "memory"
+	RateLimitRedis  = "redis"
+)
+
+// RateLimitConfig limits how often clients can call each method.
+type RateLimitConfig struct {
+	// Backend keeps the token buckets: "memory" limits every replica on its own, "redis" shares
+	// the buckets between replicas.
+	Backend string      `yaml:"backend"`
+	Redis   RedisConfig `yaml:"redis"`
+	// Default applies to every method without a limit in Methods.
+	Default RateLimit `yaml:"default"`
+	// Methods maps method names of UserService, like "CreateUser", to their limit.
+	Methods map[string]RateLimit `yaml:"methods"`
+}
+
+// RateLimit lets a client make Burst calls at once, refilled at Rate calls per second. A zero Rate
+// does not limit.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// RedisConfig says how to connect to Redis.
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
@@ -0,0 +1,20 @@
+package config
+
+import "time"
+
+// ServerConfig holds the settings of the gRPC server.
+type ServerConfig struct {
+	ListenAddr string    `yaml:"listen_addr"`
+	TLS        TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig enables TLS when CertFile and KeyFile are set. Setting ClientCAFile as well requires
+// clients to present a certificate signed by one of its CAs (mutual TLS).
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ReloadInterval is how often the files are checked for changes, so renewed certificates are
+	// picked up without a restart.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
@@ -0,0 +1,33 @@
+package config
+
+// Storage backends.
+const (
+	StoreMongo    = "mongo"
+	StoreMemory   = "memory"
+	StoreSQLite   = "sqlite"
+	StorePostgres = "postgres"
+)
+
+// StoreConfig selects where users and sessions are stored. The memory backend keeps everything in
+// the server process and is only meant for tests and local development.
+type StoreConfig struct {
+	// Backend is "mongo", "sqlite", "postgres" or "memory".
+	Backend string `yaml:"backend"`
+	// DSN is the SQLite file name or PostgreSQL connection URL of the SQL backends.
+	DSN   string      `yaml:"dsn"`
+	Mongo MongoConfig `yaml:"mongo"`
+}
+
+// MongoConfig says where the mongo backend keeps its data.
+type MongoConfig struct {
+	URI                     string `yaml:"uri"`
+	Database                string `yaml:"database"`
+	UsersCollection         string `yaml:"users_collection"`
+	SessionsCollection      string `yaml:"sessions_collection"`
+	RefreshTokensCollection string `yaml:"refresh_tokens_collection"`
+	CredentialsCollection   string `yaml:"credentials_collection"`
+	// IPFailuresCollection and UsedChallengesCollection hold the failed logins per source IP and the
+	// used second factor and passkey challenges, shared by every replica of the service.
+	IPFailuresCollection     string `yaml:"ip_failures_collection"`
+	UsedChallengesCollection string `yaml:"used_challenges_collection"`
+}
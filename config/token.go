@@ -0,0 +1,62 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"rahulchhabra.io/token"
+)
+
+// TokenConfig holds the settings used to sign and verify access tokens.
+type TokenConfig struct {
+	// SigningAlgorithm is one of RS256, ES256 or EdDSA. It only applies to generated keys, configured
+	// keys sign with the algorithm of their type.
+	SigningAlgorithm string `yaml:"signing_alg"`
+	// KeyRotation is how often a new signing key is generated. Configured keys are rotated by
+	// changing SigningKeyID instead.
+	KeyRotation time.Duration `yaml:"key_rotation"`
+	// SigningKeys maps key ids to base64 encoded PKCS #8 DER private keys, RSA, P-256 or Ed25519.
+	// They are better kept out of the config file, in TOKEN_SIGNING_KEYS_FILE. Every replica of the
+	// service must be configured with the same keys to accept the tokens of the others.
+	SigningKeys map[string]string `yaml:"signing_keys"`
+	// SigningKeyID is the id of the key new tokens are signed with. The other keys are published to
+	// verify older tokens. Empty generates the keys in memory instead, which only works with a single
+	// replica and logs every user out when the service restarts.
+	SigningKeyID string        `yaml:"signing_key_id"`
+	TTL          time.Duration `yaml:"ttl"`
+	RefreshTTL   time.Duration `yaml:"refresh_token_ttl"`
+	Issuer       string        `yaml:"issuer"`
+	Audience     string        `yaml:"audience"`
+	// Scopes are granted to every access token.
+	Scopes []string `yaml:"scopes"`
+	// JWKSAddr is the address of the HTTP server publishing /.well-known/jwks.json.
+	JWKSAddr string `yaml:"jwks_addr"`
+}
+
+// KeyRetention is how long a retired signing key stays published: one token lifetime, plus a minute
+// of slack for clock skew, so every token it signed can still be verified.
+func (c TokenConfig) KeyRetention() time.Duration {
+	return c.TTL + time.Minute
+}
+
+// GeneratesKeys reports whether the signing keys are generated by the service rather than configured.
+func (c TokenConfig) GeneratesKeys() bool {
+	return c.SigningKeyID == ""
+}
+
+// KeySet returns the configured signing keys, or a freshly generated key when none are configured.
+func (c TokenConfig) KeySet() (*token.KeySet, error) {
+	if c.GeneratesKeys() {
+		return token.NewKeySet(c.SigningAlgorithm, c.KeyRetention())
+	}
+	keys := make(map[string][]byte, len(c.SigningKeys))
+	for id, encoded := range c.SigningKeys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q is not valid base64: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return token.NewStaticKeySet(c.SigningKeyID, keys)
+}
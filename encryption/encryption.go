@@ -0,0 +1,139 @@
+// Package encryption encrypts the secrets the user service has to keep in the database but must be
+// able to read back, like TOTP secrets. Secrets are sealed with AES-256-GCM under a versioned key,
+// so keys can be rotated: new secrets use the current key, and the older keys stay configured for
+// as long as secrets sealed with them are around. Secrets it only has to recognize, like recovery
+// codes, are digested with HMAC-SHA256 under keys derived from the same ones.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrUnknownKey is returned for a secret sealed with a key version that is not configured.
+	ErrUnknownKey = errors.New("unknown encryption key version")
+	// ErrMalformed is returned for a sealed secret that can not be parsed or was tampered with.
+	ErrMalformed = errors.New("malformed sealed secret")
+)
+
+// KeyLength is the length of an encryption key in bytes.
+const KeyLength = 32
+
+// digestKeyLabel derives the HMAC key of Digest from an encryption key, so no key is used for both.
+const digestKeyLabel = "encryption.Keyring digest"
+
+// Keyring seals secrets with its current key and opens secrets sealed with any of its keys.
+type Keyring struct {
+	currentID  string
+	keys       map[string]cipher.AEAD
+	digestKeys map[string][]byte
+}
+
+// NewKeyring creates a Keyring sealing with the key of version currentID. Every key must be
+// KeyLength bytes long.
+func NewKeyring(currentID string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, currentID)
+	}
+	keyring := &Keyring{
+		currentID:  currentID,
+		keys:       make(map[string]cipher.AEAD, len(keys)),
+		digestKeys: make(map[string][]byte, len(keys)),
+	}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, "$") {
+			return nil, fmt.Errorf("invalid encryption key version %q", id)
+		}
+		if len(key) != KeyLength {
+			return nil, fmt.Errorf("encryption key %q must be %d bytes", id, KeyLength)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[id] = aead
+		derive := hmac.New(sha256.New, key)
+		derive.Write([]byte(digestKeyLabel))
+		keyring.digestKeys[id] = derive.Sum(nil)
+	}
+	return keyring, nil
+}
+
+// Seal encrypts plaintext with the current key and returns it as "<key version>$<base64 of nonce
+// and ciphertext>". associatedData, e.g. the id of the owner, is authenticated but not stored: the
+// secret only opens with the same associatedData, so it can not be copied to another record.
+func (k *Keyring) Seal(plaintext []byte, associatedData []byte) (string, error) {
+	aead := k.keys[k.currentID]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, associatedData)
+	return k.currentID + "$" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a secret made by Seal with the same associatedData.
+func (k *Keyring) Open(sealed string, associatedData []byte) ([]byte, error) {
+	id, encoded, ok := strings.Cut(sealed, "$")
+	if !ok {
+		return nil, ErrMalformed
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	data, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], associatedData)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	return plaintext, nil
+}
+
+// Digest returns a keyed hash of secret under the current key as "<key version>$<base64 of
+// HMAC-SHA256>", for secrets that only have to be recognized later. It is fast, unlike a password
+// hash, which is fine for random secrets: without the key a leaked digest can not be brute forced.
+// Like with Seal, the digest only matches with the same associatedData.
+func (k *Keyring) Digest(secret []byte, associatedData []byte) string {
+	return k.currentID + "$" + base64.RawStdEncoding.EncodeToString(k.digest(k.digestKeys[k.currentID], secret, associatedData))
+}
+
+// DigestMatches reports whether digest was made by Digest from secret and associatedData, with any
+// of the keys.
+func (k *Keyring) DigestMatches(digest string, secret []byte, associatedData []byte) bool {
+	id, encoded, ok := strings.Cut(digest, "$")
+	if !ok {
+		return false
+	}
+	key, ok := k.digestKeys[id]
+	if !ok {
+		return false
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(encoded)
+	return err == nil && hmac.Equal(sum, k.digest(key, secret, associatedData))
+}
+
+func (k *Keyring) digest(key []byte, secret []byte, associatedData []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	// The length keeps the associated data and the secret apart.
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(associatedData))))
+	mac.Write(associatedData)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,189 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testKeys are two key versions.
+var testKeys = map[string][]byte{
+	"1": bytes.Repeat([]byte{1}, KeyLength),
+	"2": bytes.Repeat([]byte{2}, KeyLength),
+}
+
+// newTestKeyring returns a Keyring of keys sealing with the key of version currentID.
+func newTestKeyring(t *testing.T, currentID string, keys map[string][]byte) *Keyring {
+	t.Helper()
+	keyring, err := NewKeyring(currentID, keys)
+	if err != nil {
+		t.Fatalf("NewKeyring: %s", err)
+	}
+	return keyring
+}
+
+func TestSealAndOpen(t *testing.T) {
+	keyring := newTestKeyring(t, "1", testKeys)
+	sealed, err := keyring.Seal([]byte("totp secret"), []byte("user-1"))
+	if err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	if !strings.HasPrefix(sealed, "1$") || strings.Contains(sealed, "totp secret") {
+		t.Errorf("got %q, want the key version and the ciphertext", sealed)
+	}
+	opened, err := keyring.Open(sealed, []byte("user-1"))
+	if err != nil || string(opened) != "totp secret" {
+		t.Errorf("Open: got %q, %v", opened, err)
+	}
+	if again, err := keyring.Seal([]byte("totp secret"), []byte("user-1")); err != nil || again == sealed {
+		t.Errorf("sealing twice gave %q and %q, want different nonces", sealed, again)
+	}
+}
+
+func TestOpenRequiresAssociatedData(t *testing.T) {
+	keyring := newTestKeyring(t, "1", testKeys)
+	sealed, err := keyring.Seal([]byte("totp secret"), []byte("user-1"))
+	if err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	// A secret copied to the record of another user does not open there.
+	for _, associatedData := range [][]byte{[]byte("user-2"), nil, []byte("user-1 ")} {
+		if _, err := keyring.Open(sealed, associatedData); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Open with associated data %q: got %v, want ErrMalformed", associatedData, err)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := newTestKeyring(t, "1", testKeys)
+	sealed, err := old.Seal([]byte("totp secret"), []byte("user-1"))
+	if err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+
+	rotated := newTestKeyring(t, "2", testKeys)
+	if opened, err := rotated.Open(sealed, []byte("user-1")); err != nil || string(opened) != "totp secret" {
+		t.Errorf("Open of a secret of the old key after the rotation: got %q, %v", opened, err)
+	}
+	resealed, err := rotated.Seal([]byte("totp secret"), []byte("user-1"))
+	if err != nil || !strings.HasPrefix(resealed, "2$") {
+		t.Errorf("Seal after the rotation: got %q, %v, want the new key version", resealed, err)
+	}
+
+	// Once the old key is dropped its secrets can not be opened.
+	withoutOld := newTestKeyring(t, "2", map[string][]byte{"2": testKeys["2"]})
+	if _, err := withoutOld.Open(sealed, []byte("user-1")); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Open with the key dropped: got %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	keyring := newTestKeyring(t, "1", testKeys)
+	sealed, err := keyring.Seal([]byte("totp secret"), []byte("user-1"))
+	if err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(sealed, "1$"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)-1] ^= 1
+
+	for name, tampered := range map[string]string{
+		"a flipped bit":        "1$" + base64.RawStdEncoding.EncodeToString(flipped),
+		"a truncated secret":   "1$" + base64.RawStdEncoding.EncodeToString(data[:len(data)-1]),
+		"only part of a nonce": "1$" + base64.RawStdEncoding.EncodeToString(data[:4]),
+		"no key version":       strings.TrimPrefix(sealed, "1$"),
+		"invalid base64":       "1$not*base64",
+		"another key version":  "2$" + strings.TrimPrefix(sealed, "1$"),
+	} {
+		if _, err := keyring.Open(tampered, []byte("user-1")); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Open of %s: got %v, want ErrMalformed", name, err)
+		}
+	}
+	if _, err := keyring.Open("9$"+strings.TrimPrefix(sealed, "1$"), []byte("user-1")); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Open of an unknown key version: got %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestNewKeyringRejects(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		currentID string
+		keys      map[string][]byte
+	}{
+		{"an unknown current version", "3", testKeys},
+		{"a short key", "1", map[string][]byte{"1": make([]byte, 16)}},
+		{"an empty version", "1", map[string][]byte{"1": testKeys["1"], "": testKeys["2"]}},
+		{"a version with a $", "1", map[string][]byte{"1": testKeys["1"], "2$": testKeys["2"]}},
+	} {
+		if _, err := NewKeyring(test.currentID, test.keys); err == nil {
+			t.Errorf("NewKeyring with %s succeeded", test.name)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	keyring := newTestKeyring(t, "1", testKeys)
+	digest := keyring.Digest([]byte("recovery code"), []byte("user-1"))
+	if !strings.HasPrefix(digest, "1$") || strings.Contains(digest, "recovery code") {
+		t.Errorf("got %q, want the key version and the HMAC", digest)
+	}
+	if digest != keyring.Digest([]byte("recovery code"), []byte("user-1")) {
+		t.Error("Digest is not deterministic, so stored digests can not be looked up")
+	}
+	if !keyring.DigestMatches(digest, []byte("recovery code"), []byte("user-1")) {
+		t.Error("DigestMatches refused the secret")
+	}
+	for _, test := range []struct {
+		name           string
+		digest         string
+		secret         string
+		associatedData string
+	}{
+		{"another secret", digest, "recovery codf", "user-1"},
+		{"other associated data", digest, "recovery code", "user-2"},
+		// The length prefix keeps bytes from moving between the associated data and the secret.
+		{"a shifted boundary", digest, "r-1recovery code", "use"},
+		{"an unknown key version", "9$" + strings.TrimPrefix(digest, "1$"), "recovery code", "user-1"},
+		{"another key version", "2$" + strings.TrimPrefix(digest, "1$"), "recovery code", "user-1"},
+		{"no key version", strings.TrimPrefix(digest, "1$"), "recovery code", "user-1"},
+		{"invalid base64", "1$not*base64", "recovery code", "user-1"},
+	} {
+		if keyring.DigestMatches(test.digest, []byte(test.secret), []byte(test.associatedData)) {
+			t.Errorf("DigestMatches accepted %s", test.name)
+		}
+	}
+
+	// Digests are not the ciphertexts of Seal, and the digest key is not the encryption key.
+	if sealed, err := keyring.Seal([]byte("recovery code"), []byte("user-1")); err != nil || keyring.DigestMatches(sealed, []byte("recovery code"), []byte("user-1")) {
+		t.Errorf("DigestMatches accepted a sealed secret (err %v)", err)
+	}
+}
+
+func TestDigestRotation(t *testing.T) {
+	old := newTestKeyring(t, "1", testKeys)
+	digest := old.Digest([]byte("recovery code"), []byte("user-1"))
+
+	// Recovery codes digested before a rotation keep working until they are regenerated.
+	rotated := newTestKeyring(t, "2", testKeys)
+	if !rotated.DigestMatches(digest, []byte("recovery code"), []byte("user-1")) {
+		t.Error("DigestMatches refused a digest of the old key after the rotation")
+	}
+	redigested := rotated.Digest([]byte("recovery code"), []byte("user-1"))
+	if !strings.HasPrefix(redigested, "2$") || !old.DigestMatches(redigested, []byte("recovery code"), []byte("user-1")) {
+		t.Errorf("Digest after the rotation made %q, want the new key version, known to the old keyring too", redigested)
+	}
+	if strings.TrimPrefix(redigested, "2$") == strings.TrimPrefix(digest, "1$") {
+		t.Error("both key versions give the same HMAC")
+	}
+
+	// Once the old key is dropped its digests no longer match.
+	withoutOld := newTestKeyring(t, "2", map[string][]byte{"2": testKeys["2"]})
+	if withoutOld.DigestMatches(digest, []byte("recovery code"), []byte("user-1")) {
+		t.Error("DigestMatches accepted a digest of a dropped key")
+	}
+}
@@ -0,0 +1,101 @@
+// Package mail sends the emails of the user service, like address verification links, through a
+// pluggable Mailer.
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email to one recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// LogMailer writes messages to the log instead of sending them, for development.
+type LogMailer struct{}
+
+// NewLogMailer creates a LogMailer.
+func NewLogMailer() *LogMailer {
+	return &LogMailer{}
+}
+
+func (m *LogMailer) Send(ctx context.Context, message Message) error {
+	log.Printf("Email to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
+
+// SMTPMailer sends messages through an SMTP server. The connection is upgraded with STARTTLS when
+// the server offers it.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates an SMTPMailer sending as from through the server at addr ("host:port").
+// Without a username it does not authenticate. The password is only ever sent over TLS, or to
+// localhost.
+func NewSMTPMailer(addr string, from string, username string, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %w", addr, err)
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+	mailer := &SMTPMailer{addr: addr, from: from}
+	if username != "" {
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	to, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q: %w", message.To, err)
+	}
+	from, _ := mail.ParseAddress(m.from)
+	// Header values come from users, a line break would let them add headers of their own.
+	if strings.ContainsAny(message.Subject, "\r\n") {
+		return errors.New("subject can not contain line breaks")
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", from.String())
+	fmt.Fprintf(&body, "To: %s\r\n", to.String())
+	fmt.Fprintf(&body, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", message.Subject))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	body.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	// net/smtp does not take a context, so the send is abandoned instead of cancelled.
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, m.auth, from.Address, []string{to.Address}, []byte(body.String()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,33 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Credential is a WebAuthn public key credential, a passkey, its user can log in with instead of a
+// password.
+type Credential struct {
+	Id     primitive.ObjectID `bson:"_id,omitempty"`
+	UserId primitive.ObjectID `bson:"userid"`
+	// CredentialId is the id the authenticator gave the credential, unique across all users.
+	CredentialId []byte `bson:"credentialid"`
+	// PublicKey is the COSE encoded key the signatures of the authenticator are verified with.
+	PublicKey []byte `bson:"publickey"`
+	// AttestationType is the attestation format of the registration, e.g. "none" or "packed".
+	AttestationType string `bson:"attestationtype,omitempty"`
+	// AAGUID identifies the model of the authenticator.
+	AAGUID []byte `bson:"aaguid,omitempty"`
+	// SignCount is the signature counter of the authenticator at the last login. Authenticators
+	// that count increase it with every signature, so a lower count points to a cloned credential.
+	SignCount uint32 `bson:"signcount"`
+	// Transports are how clients can reach the authenticator, e.g. "usb" or "internal".
+	Transports []string `bson:"transports,omitempty"`
+	// BackupEligible and BackupState tell whether the credential can be, and is, synced to other
+	// devices of the user.
+	BackupEligible bool       `bson:"backupeligible,omitempty"`
+	BackupState    bool       `bson:"backupstate,omitempty"`
+	CreatedAt      time.Time  `bson:"createdat"`
+	LastUsedAt     *time.Time `bson:"lastusedat,omitempty"`
+}
@@ -1,6 +1,10 @@
 package model
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type User struct {
 	Id        primitive.ObjectID `bson:"_id,omitempty"`
@@ -9,4 +13,37 @@ type User struct {
 	Email     string             `bson:"email,omitempty"`
 	Username  string             `bson:"username,omitempty"`
 	Password  string             `bson:"password,omitempty"`
+	Status    string             `bson:"status,omitempty"`
+	// EmailVerified is set once the user followed the verification link sent to Email.
+	EmailVerified bool `bson:"emailverified,omitempty"`
+	// FailedLogins counts the failed logins in a row, the last one at LastFailedLoginAt.
+	FailedLogins      int        `bson:"failedlogins,omitempty"`
+	LastFailedLoginAt *time.Time `bson:"lastfailedloginat,omitempty"`
+	// LockedUntil refuses logins until it has passed.
+	LockedUntil *time.Time `bson:"lockeduntil,omitempty"`
+	// TOTPSecret is the encrypted secret of the TOTP authenticator of the user, empty without one.
+	TOTPSecret string `bson:"totpsecret,omitempty"`
+	// TOTPPendingSecret is the encrypted secret of an enrollment that was not confirmed yet.
+	TOTPPendingSecret string `bson:"totppendingsecret,omitempty"`
+	// TOTPLastStep is the time step of the last accepted code, so no code can be used twice.
+	TOTPLastStep int64 `bson:"totplaststep,omitempty"`
+	// RecoveryCodes are the hashes of the unused recovery codes, each of which can stand in for a
+	// TOTP code once.
+	RecoveryCodes []string `bson:"recoverycodes,omitempty"`
+}
+
+// IsLocked reports whether logins to the user are refused at now.
+func (u User) IsLocked(now time.Time) bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(now)
 }
+
+// HasTOTP reports whether logins of the user need a TOTP code after the password.
+func (u User) HasTOTP() bool {
+	return u.TOTPSecret != ""
+}
+
+// Account statuses. Users stored before the status was introduced have none and count as active.
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+)
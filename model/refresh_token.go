@@ -0,0 +1,21 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RefreshToken is a single-use refresh token. Only the SHA-256 hash of the token is stored.
+// Every token obtained by rotating another one belongs to the same Session, so a whole login can be
+// revoked at once.
+type RefreshToken struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty"`
+	UserId    primitive.ObjectID `bson:"userid"`
+	SessionId primitive.ObjectID `bson:"sessionid"`
+	TokenHash string             `bson:"tokenhash"`
+	CreatedAt time.Time          `bson:"createdat"`
+	ExpiresAt time.Time          `bson:"expiresat"`
+	RotatedAt *time.Time         `bson:"rotatedat,omitempty"`
+	RevokedAt *time.Time         `bson:"revokedat,omitempty"`
+}
@@ -0,0 +1,20 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Session is created by every successful login. Its Id is shared by all the refresh tokens issued
+// for that login and is carried in the sid claim of the access tokens.
+type Session struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	UserId     primitive.ObjectID `bson:"userid"`
+	CreatedAt  time.Time          `bson:"createdat"`
+	LastUsedAt time.Time          `bson:"lastusedat"`
+	ExpiresAt  time.Time          `bson:"expiresat"`
+	ClientIP   string             `bson:"clientip,omitempty"`
+	UserAgent  string             `bson:"useragent,omitempty"`
+	RevokedAt  *time.Time         `bson:"revokedat,omitempty"`
+}
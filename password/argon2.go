@@ -0,0 +1,115 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id hashes passwords with argon2id, the algorithm recommended by RFC 9106 and OWASP.
+type Argon2id struct {
+	// Memory is the memory cost in KiB.
+	Memory uint32
+	// Iterations is the number of passes over the memory.
+	Iterations uint32
+	// Parallelism is the number of lanes, and threads, used.
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2id returns the parameters used when none are configured: 64 MiB of memory, three
+// passes and four lanes.
+func DefaultArgon2id() Argon2id {
+	return Argon2id{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 4,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+// argon2idParams are the parameters parsed from an encoded hash.
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (a Argon2id) Identifies(encoded string) bool {
+	return algorithm(encoded) == "argon2id"
+}
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a Argon2id) Verify(encoded string, password string) error {
+	params, err := parseArgon2id(encoded)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(password), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.key)))
+	if subtle.ConstantTimeCompare(key, params.key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func (a Argon2id) NeedsRehash(encoded string) bool {
+	params, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.memory != a.Memory ||
+		params.iterations != a.Iterations ||
+		params.parallelism != a.Parallelism ||
+		uint32(len(params.salt)) != a.SaltLength ||
+		uint32(len(params.key)) != a.KeyLength
+}
+
+// parseArgon2id parses a hash in the PHC string format written by Hash.
+func parseArgon2id(encoded string) (argon2idParams, error) {
+	var params argon2idParams
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 || fields[0] != "" || fields[1] != "argon2id" {
+		return params, ErrMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil {
+		return params, ErrMalformedHash
+	}
+	if version != argon2.Version {
+		return params, fmt.Errorf("%w: unsupported argon2 version %d", ErrMalformedHash, version)
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, ErrMalformedHash
+	}
+	if params.iterations == 0 || params.parallelism == 0 {
+		return params, ErrMalformedHash
+	}
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(fields[4]); err != nil {
+		return params, ErrMalformedHash
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(fields[5]); err != nil || len(params.key) == 0 {
+		return params, ErrMalformedHash
+	}
+	return params, nil
+}
@@ -0,0 +1,43 @@
+package password
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BcryptMaxLength is the longest password in bytes bcrypt can hash.
+const BcryptMaxLength = 72
+
+// Bcrypt hashes passwords with bcrypt. Its hashes ($2a$, $2b$ and $2y$) predate the PHC string
+// format but are just as self-describing. bcrypt only uses the first 72 bytes of a password, so Hash
+// refuses longer ones instead of silently ignoring the rest.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b Bcrypt) Verify(encoded string, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrMismatch
+	}
+	return err
+}
+
+func (b Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
@@ -0,0 +1,115 @@
+// Package password hashes passwords for storage and verifies them at login. Hashes are stored as
+// self-describing strings in the PHC string format, e.g.
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+//
+// so the algorithm and parameters of every stored hash are known, and hashes made with older
+// settings can be upgraded the next time the user logs in. Passwords can also be peppered, see
+// Manager.WithPeppers.
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrMismatch is returned when a password does not match the hash.
+	ErrMismatch = errors.New("password does not match")
+	// ErrUnknownAlgorithm is returned for a hash made by an algorithm no Hasher handles.
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+	// ErrMalformedHash is returned for a hash that can not be parsed.
+	ErrMalformedHash = errors.New("malformed password hash")
+)
+
+// Hasher is a password hashing algorithm.
+type Hasher interface {
+	// Identifies reports whether the encoded hash was made by this algorithm.
+	Identifies(encoded string) bool
+	// Hash hashes the password with a new random salt.
+	Hash(password string) (string, error)
+	// Verify returns nil when password matches the encoded hash, and ErrMismatch when it does not.
+	Verify(encoded string, password string) error
+	// NeedsRehash reports whether the encoded hash was made with other parameters than Hash uses now.
+	NeedsRehash(encoded string) bool
+}
+
+// Manager hashes new passwords with the current algorithm, and can still verify the hashes made by
+// the algorithms it replaced.
+type Manager struct {
+	current Hasher
+	others  []Hasher
+
+	// pepperID is the version of the pepper new hashes use, empty when passwords are not peppered.
+	pepperID string
+	peppers  map[string][]byte
+}
+
+// NewManager creates a Manager hashing with current. Hashes of the legacy algorithms can be
+// verified, and are reported as needing a rehash.
+func NewManager(current Hasher, legacy ...Hasher) *Manager {
+	return &Manager{current: current, others: legacy}
+}
+
+// Hash hashes the password with the current algorithm and pepper.
+func (m *Manager) Hash(password string) (string, error) {
+	if m.pepperID == "" {
+		return m.current.Hash(password)
+	}
+	peppered, err := m.pepper(m.pepperID, password)
+	if err != nil {
+		return "", err
+	}
+	hash, err := m.current.Hash(peppered)
+	if err != nil {
+		return "", err
+	}
+	return pepperPrefix + m.pepperID + hash, nil
+}
+
+// Verify checks password against the encoded hash. When it matches, needsRehash reports whether the
+// hash should be replaced by m.Hash(password) because it was made by another algorithm, with
+// outdated parameters or with another pepper.
+func (m *Manager) Verify(encoded string, password string) (needsRehash bool, err error) {
+	pepperID, inner, peppered := splitPeppered(encoded)
+	if peppered {
+		if password, err = m.pepper(pepperID, password); err != nil {
+			return false, err
+		}
+		encoded = inner
+	}
+	needsRehash, err = m.verify(encoded, password)
+	if err != nil {
+		return false, err
+	}
+	return needsRehash || pepperID != m.pepperID, nil
+}
+
+// verify checks password against a hash without a pepper prefix.
+func (m *Manager) verify(encoded string, password string) (needsRehash bool, err error) {
+	if m.current.Identifies(encoded) {
+		if err := m.current.Verify(encoded, password); err != nil {
+			return false, err
+		}
+		return m.current.NeedsRehash(encoded), nil
+	}
+	for _, hasher := range m.others {
+		if hasher.Identifies(encoded) {
+			if err := hasher.Verify(encoded, password); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algorithm(encoded))
+}
+
+// algorithm returns the algorithm identifier of a PHC string, without the rest of the hash.
+func algorithm(encoded string) string {
+	fields := strings.SplitN(encoded, "$", 3)
+	if len(fields) < 3 || fields[0] != "" {
+		return ""
+	}
+	return fields[1]
+}
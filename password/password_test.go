@@ -0,0 +1,170 @@
+package password
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// testArgon2id is cheap enough to hash many passwords in tests.
+var testArgon2id = Argon2id{Memory: 64, Iterations: 1, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+
+// testBcrypt is the cheapest bcrypt cost.
+var testBcrypt = Bcrypt{Cost: 4}
+
+// mustHash hashes password with hasher.
+func mustHash(t *testing.T, hasher interface{ Hash(string) (string, error) }, password string) string {
+	t.Helper()
+	hash, err := hasher.Hash(password)
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+	return hash
+}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	hash := mustHash(t, testArgon2id, "correct horse")
+	phc := regexp.MustCompile(`^\$argon2id\$v=19\$m=64,t=1,p=2\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`)
+	if !phc.MatchString(hash) {
+		t.Fatalf("got %q, want a PHC string with the parameters, a 16 byte salt and a 32 byte key", hash)
+	}
+	if !testArgon2id.Identifies(hash) || testBcrypt.Identifies(hash) {
+		t.Error("the argon2id hash is not identified as argon2id only")
+	}
+	if err := testArgon2id.Verify(hash, "correct horse"); err != nil {
+		t.Errorf("Verify of the password: %s", err)
+	}
+	for _, wrong := range []string{"correct horsE", "correct horse ", ""} {
+		if err := testArgon2id.Verify(hash, wrong); !errors.Is(err, ErrMismatch) {
+			t.Errorf("Verify of %q: got %v, want ErrMismatch", wrong, err)
+		}
+	}
+	if again := mustHash(t, testArgon2id, "correct horse"); again == hash {
+		t.Error("two hashes of the same password are equal, the salt is not random")
+	}
+
+	// The parameters come from the hash, so other parameters still verify it.
+	other := DefaultArgon2id()
+	if err := other.Verify(hash, "correct horse"); err != nil {
+		t.Errorf("Verify with other parameters: %s", err)
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	hash := mustHash(t, testArgon2id, "correct horse")
+	if testArgon2id.NeedsRehash(hash) {
+		t.Error("a hash of the current parameters needs a rehash")
+	}
+	for name, change := range map[string]func(a *Argon2id){
+		"memory":      func(a *Argon2id) { a.Memory *= 2 },
+		"iterations":  func(a *Argon2id) { a.Iterations++ },
+		"parallelism": func(a *Argon2id) { a.Parallelism++ },
+		"salt length": func(a *Argon2id) { a.SaltLength = 32 },
+		"key length":  func(a *Argon2id) { a.KeyLength = 64 },
+	} {
+		changed := testArgon2id
+		change(&changed)
+		if !changed.NeedsRehash(hash) {
+			t.Errorf("a hash of another %s does not need a rehash", name)
+		}
+	}
+}
+
+func TestArgon2idMalformed(t *testing.T) {
+	valid := mustHash(t, testArgon2id, "correct horse")
+	fields := strings.Split(valid, "$")
+	with := func(i int, field string) string {
+		changed := append([]string(nil), fields...)
+		changed[i] = field
+		return strings.Join(changed, "$")
+	}
+	for name, encoded := range map[string]string{
+		"too few fields":      strings.Join(fields[:5], "$"),
+		"too many fields":     valid + "$extra",
+		"another algorithm":   with(1, "argon2i"),
+		"no version":          with(2, "19"),
+		"another version":     with(2, "v=16"),
+		"no parameters":       with(3, "m=64"),
+		"no iterations":       with(3, "m=64,t=0,p=2"),
+		"no parallelism":      with(3, "m=64,t=1,p=0"),
+		"a salt not base64":   with(4, "not*base64"),
+		"a key not base64":    with(5, "not*base64"),
+		"no key":              with(5, ""),
+		"padded base64":       with(5, fields[5]+"="),
+		"leading characters":  "x" + valid,
+		"parameters as words": with(3, "m=lots,t=1,p=2"),
+	} {
+		if err := testArgon2id.Verify(encoded, "correct horse"); !errors.Is(err, ErrMalformedHash) {
+			t.Errorf("Verify of a hash with %s: got %v, want ErrMalformedHash", name, err)
+		}
+		if !testArgon2id.NeedsRehash(encoded) {
+			t.Errorf("a hash with %s does not need a rehash", name)
+		}
+	}
+}
+
+func TestBcryptLengthLimit(t *testing.T) {
+	longest := strings.Repeat("a", BcryptMaxLength)
+	hash := mustHash(t, testBcrypt, longest)
+	if err := testBcrypt.Verify(hash, longest); err != nil {
+		t.Errorf("Verify of a %d byte password: %s", BcryptMaxLength, err)
+	}
+	// bcrypt ignores everything after 72 bytes, so a longer password must not be hashed at all.
+	if _, err := testBcrypt.Hash(longest + "b"); err == nil {
+		t.Errorf("Hash of a %d byte password succeeded", BcryptMaxLength+1)
+	}
+	if _, err := testBcrypt.Hash(strings.Repeat("é", BcryptMaxLength/2+1)); err == nil {
+		t.Errorf("Hash of %d two byte characters succeeded", BcryptMaxLength/2+1)
+	}
+}
+
+func TestManagerRehashesLegacyHashes(t *testing.T) {
+	manager := NewManager(testArgon2id, testBcrypt)
+	legacy := mustHash(t, testBcrypt, "correct horse")
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if !testBcrypt.Identifies(prefix + strings.TrimPrefix(legacy, "$2a$")) {
+			t.Errorf("a %s hash is not identified as bcrypt", prefix)
+		}
+	}
+
+	needsRehash, err := manager.Verify(legacy, "correct horse")
+	if err != nil || !needsRehash {
+		t.Fatalf("Verify of a bcrypt hash: got %v, %v, want a rehash", needsRehash, err)
+	}
+	if _, err := manager.Verify(legacy, "wrong horse"); !errors.Is(err, ErrMismatch) {
+		t.Errorf("Verify of a bcrypt hash with the wrong password: got %v, want ErrMismatch", err)
+	}
+
+	rehashed := mustHash(t, manager, "correct horse")
+	if !strings.HasPrefix(rehashed, "$argon2id$") {
+		t.Fatalf("Hash made %q, want an argon2id hash", rehashed)
+	}
+	if needsRehash, err := manager.Verify(rehashed, "correct horse"); err != nil || needsRehash {
+		t.Errorf("Verify of the rehashed password: got %v, %v, want no rehash", needsRehash, err)
+	}
+
+	// Stronger parameters of the current algorithm also ask for a rehash.
+	stronger := testArgon2id
+	stronger.Iterations++
+	if needsRehash, err := NewManager(stronger).Verify(rehashed, "correct horse"); err != nil || !needsRehash {
+		t.Errorf("Verify with stronger parameters: got %v, %v, want a rehash", needsRehash, err)
+	}
+	if needsRehash, err := NewManager(Bcrypt{Cost: 5}).Verify(legacy, "correct horse"); err != nil || !needsRehash {
+		t.Errorf("Verify with a higher bcrypt cost: got %v, %v, want a rehash", needsRehash, err)
+	}
+}
+
+func TestManagerUnknownAlgorithm(t *testing.T) {
+	manager := NewManager(testArgon2id)
+	for _, encoded := range []string{
+		mustHash(t, testBcrypt, "correct horse"), // bcrypt is not configured as a legacy hasher
+		"$scrypt$ln=15,r=8,p=1$c2FsdA$aGFzaA",
+		"correct horse",
+		"",
+	} {
+		if _, err := manager.Verify(encoded, "correct horse"); !errors.Is(err, ErrUnknownAlgorithm) {
+			t.Errorf("Verify of %q: got %v, want ErrUnknownAlgorithm", encoded, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownPepper is returned for a hash made with a pepper version that is no longer configured.
+var ErrUnknownPepper = errors.New("unknown pepper version")
+
+// pepperPrefix starts every peppered hash. The pepper version and the hash of the peppered password
+// follow, e.g. $pepper$v=2$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+const pepperPrefix = "$pepper$v="
+
+// MinPepperLength is the minimum length of a pepper in bytes.
+const MinPepperLength = 16
+
+// WithPeppers returns a copy of m that HMACs every password with a secret pepper before hashing it.
+// The pepper is kept out of the database, so a leaked users table can not be brute forced without
+// it as well. New hashes use the pepper with version currentID; the others stay usable for verifying
+// older hashes, which are reported as needing a rehash just like hashes made without a pepper.
+func (m *Manager) WithPeppers(currentID string, peppers map[string][]byte) (*Manager, error) {
+	if _, ok := peppers[currentID]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPepper, currentID)
+	}
+	for id, pepper := range peppers {
+		if id == "" || strings.Contains(id, "$") {
+			return nil, fmt.Errorf("invalid pepper version %q", id)
+		}
+		if len(pepper) < MinPepperLength {
+			return nil, fmt.Errorf("pepper %q must be at least %d bytes", id, MinPepperLength)
+		}
+	}
+	peppered := *m
+	peppered.pepperID = currentID
+	peppered.peppers = peppers
+	return &peppered, nil
+}
+
+// pepper returns the password HMACed with the pepper of the given version. The result is base64
+// encoded so it stays well within the input limit of bcrypt.
+func (m *Manager) pepper(id string, password string) (string, error) {
+	key, ok := m.peppers[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownPepper, id)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(password))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// splitPeppered splits a peppered hash into its pepper version and the inner hash.
+func splitPeppered(encoded string) (id string, inner string, ok bool) {
+	if !strings.HasPrefix(encoded, pepperPrefix) {
+		return "", "", false
+	}
+	rest := encoded[len(pepperPrefix):]
+	end := strings.Index(rest, "$")
+	if end <= 0 {
+		return "", "", false
+	}
+	return rest[:end], rest[end:], true
+}
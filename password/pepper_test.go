@@ -0,0 +1,114 @@
+package password
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testPeppers are two pepper versions of the minimum length.
+var testPeppers = map[string][]byte{
+	"1": bytes.Repeat([]byte{1}, MinPepperLength),
+	"2": bytes.Repeat([]byte{2}, MinPepperLength),
+}
+
+// peppered returns a Manager of hasher using the pepper with version currentID of peppers.
+func peppered(t *testing.T, hasher Hasher, currentID string, peppers map[string][]byte) *Manager {
+	t.Helper()
+	manager, err := NewManager(hasher).WithPeppers(currentID, peppers)
+	if err != nil {
+		t.Fatalf("WithPeppers: %s", err)
+	}
+	return manager
+}
+
+func TestPepperRoundTrip(t *testing.T) {
+	manager := peppered(t, testArgon2id, "1", testPeppers)
+	hash := mustHash(t, manager, "correct horse")
+	if !strings.HasPrefix(hash, "$pepper$v=1$argon2id$") {
+		t.Fatalf("got %q, want a hash with pepper version 1", hash)
+	}
+	if needsRehash, err := manager.Verify(hash, "correct horse"); err != nil || needsRehash {
+		t.Errorf("Verify: got %v, %v, want no rehash", needsRehash, err)
+	}
+	if _, err := manager.Verify(hash, "wrong horse"); !errors.Is(err, ErrMismatch) {
+		t.Errorf("Verify of the wrong password: got %v, want ErrMismatch", err)
+	}
+
+	// The inner hash is of the HMAC, not of the password, so it is useless without the pepper.
+	inner := strings.TrimPrefix(hash, "$pepper$v=1")
+	if err := testArgon2id.Verify(inner, "correct horse"); !errors.Is(err, ErrMismatch) {
+		t.Errorf("Verify of the inner hash without the pepper: got %v, want ErrMismatch", err)
+	}
+}
+
+func TestPepperRotation(t *testing.T) {
+	old := mustHash(t, peppered(t, testArgon2id, "1", testPeppers), "correct horse")
+	unpeppered := mustHash(t, testArgon2id, "correct horse")
+	rotated := peppered(t, testArgon2id, "2", testPeppers)
+
+	// Hashes of the old pepper and without one still verify, and are upgraded to the new pepper.
+	for name, hash := range map[string]string{"the old pepper": old, "no pepper": unpeppered} {
+		if needsRehash, err := rotated.Verify(hash, "correct horse"); err != nil || !needsRehash {
+			t.Errorf("Verify of a hash of %s: got %v, %v, want a rehash", name, needsRehash, err)
+		}
+		if _, err := rotated.Verify(hash, "wrong horse"); !errors.Is(err, ErrMismatch) {
+			t.Errorf("Verify of a hash of %s with the wrong password: got %v, want ErrMismatch", name, err)
+		}
+	}
+	if hash := mustHash(t, rotated, "correct horse"); !strings.HasPrefix(hash, "$pepper$v=2$") {
+		t.Errorf("Hash after the rotation made %q, want pepper version 2", hash)
+	}
+}
+
+func TestUnknownPepper(t *testing.T) {
+	hash := mustHash(t, peppered(t, testArgon2id, "1", testPeppers), "correct horse")
+
+	// Once the old pepper is dropped its hashes can not be verified, whatever the password.
+	withoutOld := peppered(t, testArgon2id, "2", map[string][]byte{"2": testPeppers["2"]})
+	if _, err := withoutOld.Verify(hash, "correct horse"); !errors.Is(err, ErrUnknownPepper) {
+		t.Errorf("Verify with the pepper dropped: got %v, want ErrUnknownPepper", err)
+	}
+	if _, err := NewManager(testArgon2id).Verify(hash, "correct horse"); !errors.Is(err, ErrUnknownPepper) {
+		t.Errorf("Verify without peppers: got %v, want ErrUnknownPepper", err)
+	}
+	if _, err := peppered(t, testArgon2id, "1", testPeppers).Verify("$pepper$v=9"+strings.TrimPrefix(hash, "$pepper$v=1"), "correct horse"); !errors.Is(err, ErrUnknownPepper) {
+		t.Errorf("Verify of an unknown version: got %v, want ErrUnknownPepper", err)
+	}
+	// A prefix without a version is no peppered hash at all.
+	if _, err := peppered(t, testArgon2id, "1", testPeppers).Verify("$pepper$v="+strings.TrimPrefix(hash, "$pepper$v=1"), "correct horse"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("Verify of a hash without a pepper version: got %v, want ErrUnknownAlgorithm", err)
+	}
+}
+
+func TestWithPeppersRejects(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		currentID string
+		peppers   map[string][]byte
+	}{
+		{"an unknown current version", "3", testPeppers},
+		{"no peppers", "1", nil},
+		{"a short pepper", "1", map[string][]byte{"1": bytes.Repeat([]byte{1}, MinPepperLength-1)}},
+		{"an empty version", "1", map[string][]byte{"1": testPeppers["1"], "": testPeppers["2"]}},
+		{"a version with a $", "1", map[string][]byte{"1": testPeppers["1"], "2$": testPeppers["2"]}},
+	} {
+		if _, err := NewManager(testArgon2id).WithPeppers(test.currentID, test.peppers); err == nil {
+			t.Errorf("WithPeppers with %s succeeded", test.name)
+		}
+	}
+}
+
+func TestPepperLiftsBcryptLengthLimit(t *testing.T) {
+	manager := peppered(t, testBcrypt, "1", testPeppers)
+	long := strings.Repeat("a", 2*BcryptMaxLength)
+	hash := mustHash(t, manager, long)
+	if _, err := manager.Verify(hash, long); err != nil {
+		t.Errorf("Verify of a %d byte password: %s", len(long), err)
+	}
+	// The HMAC covers the whole password, so a change past 72 bytes is not ignored.
+	if _, err := manager.Verify(hash, long[:len(long)-1]+"b"); !errors.Is(err, ErrMismatch) {
+		t.Errorf("Verify of a password differing in its last byte: got %v, want ErrMismatch", err)
+	}
+}
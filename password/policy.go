@@ -0,0 +1,135 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nbutton23/zxcvbn-go"
+)
+
+// Policy decides which passwords users may choose. Zero fields do not restrict.
+type Policy struct {
+	// MinLength and MaxLength bound the length in characters.
+	MinLength int
+	MaxLength int
+	// MaxBytes bounds the length in bytes, for hashes that can not take longer passwords.
+	MaxBytes int
+	// MinCharacterClasses is how many of lower case letters, upper case letters, digits and symbols
+	// a password must contain.
+	MinCharacterClasses int
+	// MinStrength is the minimum zxcvbn score, from 0 (guessable in moments) to 4 (very unguessable).
+	MinStrength int
+	// RejectPersonalInfo refuses passwords containing the email, username or name of the user.
+	RejectPersonalInfo bool
+}
+
+// Violation is one way a password breaks a Policy.
+type Violation struct {
+	// Rule identifies the rule, e.g. "min_length", for clients that want to show their own message.
+	Rule string
+	// Description explains the rule to the user.
+	Description string
+}
+
+// personalInfoMinLength is the shortest piece of personal information that is looked for in a
+// password. Shorter ones, like a two letter last name, would reject too many good passwords.
+const personalInfoMinLength = 3
+
+// maxStrengthInput bounds the part of a password zxcvbn looks at, its cost grows quickly with length.
+const maxStrengthInput = 100
+
+// Check returns every rule of the policy the password breaks, or nil when it is acceptable.
+// personalInfo holds the email, username and names of the user the password is for.
+func (p Policy) Check(password string, personalInfo ...string) []Violation {
+	var violations []Violation
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, Violation{
+			Rule:        "min_length",
+			Description: fmt.Sprintf("Password must be at least %d characters long", p.MinLength),
+		})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, Violation{
+			Rule:        "max_length",
+			Description: fmt.Sprintf("Password must be at most %d characters long", p.MaxLength),
+		})
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		violations = append(violations, Violation{
+			Rule:        "max_bytes",
+			Description: fmt.Sprintf("Password must be at most %d bytes long, letters outside the English alphabet and symbols can take up to 4 bytes each", p.MaxBytes),
+		})
+	}
+	if classes := characterClasses(password); classes < p.MinCharacterClasses {
+		violations = append(violations, Violation{
+			Rule:        "character_classes",
+			Description: fmt.Sprintf("Password must contain at least %d of: lower case letters, upper case letters, digits and symbols", p.MinCharacterClasses),
+		})
+	}
+
+	var inputs []string
+	for _, info := range personalInfo {
+		inputs = append(inputs, personalTokens(info)...)
+	}
+	if p.RejectPersonalInfo {
+		lower := strings.ToLower(password)
+		for _, token := range inputs {
+			if strings.Contains(lower, token) {
+				violations = append(violations, Violation{
+					Rule:        "personal_info",
+					Description: "Password can not contain your email, username or name",
+				})
+				break
+			}
+		}
+	}
+
+	if p.MinStrength > 0 && password != "" {
+		input := password
+		if length > maxStrengthInput {
+			input = string([]rune(input)[:maxStrengthInput])
+		}
+		if result := zxcvbn.PasswordStrength(input, inputs); result.Score < p.MinStrength {
+			violations = append(violations, Violation{
+				Rule:        "strength",
+				Description: "Password is too easy to guess, try a longer passphrase of unrelated words",
+			})
+		}
+	}
+	return violations
+}
+
+// characterClasses counts which of lower case letters, upper case letters, digits and symbols s contains.
+func characterClasses(s string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// personalTokens returns the lower cased parts of a piece of personal information worth looking for
+// in a password. An email address also yields its local part.
+func personalTokens(info string) []string {
+	info = strings.ToLower(strings.TrimSpace(info))
+	var tokens []string
+	if utf8.RuneCountInString(info) >= personalInfoMinLength {
+		tokens = append(tokens, info)
+	}
+	if local, _, ok := strings.Cut(info, "@"); ok && utf8.RuneCountInString(local) >= personalInfoMinLength {
+		tokens = append(tokens, local)
+	}
+	return tokens
+}
@@ -0,0 +1,84 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+// rules returns the rules of violations in order.
+func rules(violations []Violation) []string {
+	names := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		names = append(names, violation.Rule)
+	}
+	return names
+}
+
+func TestPolicyCheck(t *testing.T) {
+	personal := []string{"ada.lovelace@example.com", "countess", "Ada", "Lovelace"}
+	for _, test := range []struct {
+		name     string
+		policy   Policy
+		password string
+		want     []string
+	}{
+		{"the zero policy accepts anything", Policy{}, "", nil},
+		{"too short", Policy{MinLength: 8}, "short", []string{"min_length"}},
+		{"the minimum length", Policy{MinLength: 8}, "exactly8", nil},
+		// Lengths count characters, not bytes.
+		{"short in characters but long in bytes", Policy{MinLength: 8}, "ééééééé", []string{"min_length"}},
+		{"too long", Policy{MaxLength: 10}, "much too long", []string{"max_length"}},
+		{"no maximum length", Policy{MinLength: 1}, strings.Repeat("a", 1000), nil},
+		{"too many bytes", Policy{MaxBytes: 72}, strings.Repeat("é", 37), []string{"max_bytes"}},
+		{"the maximum bytes", Policy{MaxBytes: 72}, strings.Repeat("é", 36), nil},
+		{"one character class", Policy{MinCharacterClasses: 2}, "lowercase", []string{"character_classes"}},
+		{"two character classes", Policy{MinCharacterClasses: 2}, "lowercase7", nil},
+		{"every character class", Policy{MinCharacterClasses: 4}, "Aa1!", nil},
+		{"non-ASCII letters count as letters", Policy{MinCharacterClasses: 2}, "Ünal", nil},
+		{"the email", Policy{RejectPersonalInfo: true}, "x ada.lovelace@example.com x", []string{"personal_info"}},
+		{"the local part of the email", Policy{RejectPersonalInfo: true}, "my ada.lovelace pass", []string{"personal_info"}},
+		{"the username in another case", Policy{RejectPersonalInfo: true}, "COUNTESS of code", []string{"personal_info"}},
+		{"the last name", Policy{RejectPersonalInfo: true}, "lovelace1815", []string{"personal_info"}},
+		{"personal info allowed", Policy{}, "lovelace1815", nil},
+		{"a guessable password", Policy{MinStrength: 2}, "password1", []string{"strength"}},
+		{"a passphrase", Policy{MinStrength: 3}, "plum sailboat velvet 42", nil},
+		// zxcvbn is told about the user, so a password built from their name is weak.
+		{"a password made of personal info", Policy{MinStrength: 3}, "adalovelace", []string{"strength"}},
+		{"a very long password", Policy{MinStrength: 3}, strings.Repeat("plum sailboat velvet 42 ", 100), nil},
+		{"every rule at once", Policy{MinLength: 12, MinCharacterClasses: 3, MinStrength: 2, RejectPersonalInfo: true}, "countess", []string{"min_length", "character_classes", "personal_info", "strength"}},
+	} {
+		got := rules(test.policy.Check(test.password, personal...))
+		if !equalRules(got, test.want) {
+			t.Errorf("%s: Check(%q) broke %v, want %v", test.name, test.password, got, test.want)
+		}
+	}
+
+	// A two letter name is too common a part of good passwords to refuse.
+	if got := (Policy{RejectPersonalInfo: true}).Check("jolly jolly", "Jo"); len(got) != 0 {
+		t.Errorf("Check with a two letter name broke %v", rules(got))
+	}
+}
+
+func TestPolicyDescriptions(t *testing.T) {
+	policy := Policy{MinLength: 12, MaxBytes: 4, MinCharacterClasses: 3}
+	for _, violation := range policy.Check("ééé") {
+		if violation.Description == "" {
+			t.Errorf("rule %s has no description", violation.Rule)
+		}
+	}
+	if got := policy.Check("ééé")[0].Description; !strings.Contains(got, "12") {
+		t.Errorf("got %q, want the minimum length in the description", got)
+	}
+}
+
+func equalRules(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
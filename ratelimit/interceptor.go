@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Rules says how often each method may be called.
+type Rules struct {
+	// Default applies to the methods without a limit of their own.
+	Default Limit
+	// Methods maps full method names, like "/userproto.UserService/CreateUser", to their limit.
+	Methods map[string]Limit
+}
+
+// limit returns the limit of a method.
+func (r Rules) limit(method string) Limit {
+	if limit, ok := r.Methods[method]; ok {
+		return limit
+	}
+	return r.Default
+}
+
+// UnaryServerInterceptor limits calls per method, by peer IP and, when identify returns a user for
+// the call, by user as well. Every method has buckets of its own, so a client running out of
+// logins can still call the other methods.
+//
+// A refused call gets ResourceExhausted with errdetails.RetryInfo. When the backend fails the call
+// is let through and the error passed to onError: an outage of the backend must not take the
+// service down with it.
+func UnaryServerInterceptor(backend Backend, rules Rules, identify func(ctx context.Context) string, onError func(error)) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		limit := rules.limit(info.FullMethod)
+		if limit.Unlimited() {
+			return handler(ctx, request)
+		}
+
+		keys := []string{"ip:" + peerIP(ctx) + ":" + info.FullMethod}
+		if identify != nil {
+			if user := identify(ctx); user != "" {
+				keys = append(keys, "user:"+user+":"+info.FullMethod)
+			}
+		}
+		for _, key := range keys {
+			allowed, retryAfter, err := backend.Take(ctx, key, limit)
+			if err != nil {
+				if onError != nil {
+					onError(err)
+				}
+				continue
+			}
+			if !allowed {
+				return nil, rateLimited(retryAfter)
+			}
+		}
+		return handler(ctx, request)
+	}
+}
+
+// rateLimited is the error of a refused call.
+func rateLimited(retryAfter time.Duration) error {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("Rate limit exceeded, retry in %s", retryAfter.Round(time.Millisecond)))
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// peerIP returns the IP address of the client, without the port.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxBuckets bounds the memory of a MemoryBackend. Past it, buckets that have refilled completely,
+// and so are the same as a new bucket, are dropped.
+const maxBuckets = 100000
+
+// bucket is the state of one token bucket.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// MemoryBackend keeps the buckets in the memory of the process, so each server replica limits on
+// its own.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewMemoryBackend creates an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{buckets: make(map[string]*bucket)}
+}
+
+func (b *MemoryBackend) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.buckets[key]
+	if !ok {
+		if len(b.buckets) >= maxBuckets {
+			b.prune(now)
+		}
+		state = &bucket{tokens: float64(limit.Burst), updated: now}
+		b.buckets[key] = state
+	}
+	state.tokens = refill(state.tokens, now.Sub(state.updated), limit)
+	state.updated = now
+	state.limit = limit
+	if state.tokens < 1 {
+		return false, untilNextToken(state.tokens, limit), nil
+	}
+	state.tokens--
+	return true, 0, nil
+}
+
+// prune drops the buckets that are full again. It must be called with b.mu held.
+func (b *MemoryBackend) prune(now time.Time) {
+	for key, state := range b.buckets {
+		if refill(state.tokens, now.Sub(state.updated), state.limit) >= float64(state.limit.Burst) {
+			delete(b.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Package ratelimit limits how often clients can call gRPC methods, with a token bucket per method
+// and client. The buckets live in a Backend: in memory for a single server, or in Redis so every
+// replica of the service shares them.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limit is a token bucket: it holds up to Burst tokens, refilled at Rate tokens per second, and
+// every call takes one. A zero Rate does not limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited reports whether the limit lets every call through.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+// Backend stores token buckets.
+type Backend interface {
+	// Take takes a token from the bucket of key, which starts out full. When the bucket is empty the
+	// call is refused, and retryAfter says when the next token will be there.
+	Take(ctx context.Context, key string, limit Limit) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// refill returns the tokens of a bucket that held tokens elapsed ago, capped at its burst.
+func refill(tokens float64, elapsed time.Duration, limit Limit) float64 {
+	if elapsed > 0 {
+		tokens += elapsed.Seconds() * limit.Rate
+	}
+	if tokens > float64(limit.Burst) {
+		tokens = float64(limit.Burst)
+	}
+	return tokens
+}
+
+// untilNextToken returns how long a bucket holding tokens takes to hold one whole token.
+func untilNextToken(tokens float64, limit Limit) time.Duration {
+	return time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript updates a token bucket stored as a Redis hash atomically. It uses the clock of Redis,
+// so replicas with skewed clocks still agree. The bucket expires once it would be full again.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+	tokens = burst
+	updated = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - updated) / 1000000 * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate * 1000000)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, retry}
+`)
+
+// RedisBackend keeps the buckets in Redis, so every replica of the service shares them.
+type RedisBackend struct {
+	client redis.Scripter
+	prefix string
+}
+
+// NewRedisBackend stores buckets with client, under keys starting with prefix.
+func NewRedisBackend(client redis.Scripter, prefix string) *RedisBackend {
+	return &RedisBackend{client: client, prefix: prefix}
+}
+
+func (b *RedisBackend) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	result, err := takeScript.Run(ctx, b.client, []string{b.prefix + key}, limit.Rate, limit.Burst).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if result[0] == 1 {
+		return true, 0, nil
+	}
+	return false, time.Duration(result[1]) * time.Microsecond, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/token"
+)
+
+// caller is who makes a call that acts on accounts: a user identified by their access token, or an
+// admin.
+type caller struct {
+	// claims of the access token, nil for an admin identified by its client certificate
+	claims *token.Claims
+	admin  bool
+}
+
+// mayAccess reports whether the caller may read or change the account of the user with id.
+func (c caller) mayAccess(id primitive.ObjectID) bool {
+	return c.admin || (c.claims != nil && c.claims.Subject == id.Hex())
+}
+
+// identifyCaller finds out who makes the call. An allow-listed client certificate is enough for an
+// admin, everybody else needs an access token.
+func (s *userService) identifyCaller(ctx context.Context) (caller, error) {
+	if s.isAdminClient(ctx) {
+		return caller{admin: true}, nil
+	}
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return caller{}, err
+	}
+	return caller{claims: claims, admin: hasScope(claims, s.admin.Scope)}, nil
+}
+
+// requireAdmin refuses callers that are not admins.
+func (s *userService) requireAdmin(ctx context.Context) error {
+	c, err := s.identifyCaller(ctx)
+	if err != nil {
+		return err
+	}
+	if !c.admin {
+		return status.Errorf(codes.PermissionDenied, "Only admins can do this")
+	}
+	return nil
+}
+
+// isAdminClient reports whether the caller presented a verified client certificate whose common
+// name is allow-listed in admin.client_subjects.
+func (s *userService) isAdminClient(ctx context.Context) bool {
+	return isAllowedClient(ctx, s.admin.ClientSubjects)
+}
+
+// requireIntrospector refuses callers that may not introspect tokens: admins, and the callers
+// allow-listed in introspection by their client certificate or through the introspection scope.
+func (s *userService) requireIntrospector(ctx context.Context) error {
+	if isAllowedClient(ctx, s.introspection.ClientSubjects) {
+		return nil
+	}
+	c, err := s.identifyCaller(ctx)
+	if err != nil {
+		return err
+	}
+	if !c.admin && !hasScope(c.claims, s.introspection.Scope) {
+		return status.Errorf(codes.PermissionDenied, "Only admins and allowed services can introspect tokens")
+	}
+	return nil
+}
+
+// isAllowedClient reports whether the caller presented a verified client certificate whose common
+// name is one of subjects.
+func isAllowedClient(ctx context.Context, subjects []string) bool {
+	if len(subjects) == 0 {
+		return false
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	// Only chains verified against the client CAs count, a certificate alone proves nothing.
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return false
+	}
+	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	for _, allowed := range subjects {
+		if subject == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// hasScope reports whether the access token grants scope.
+func hasScope(claims *token.Claims, scope string) bool {
+	for _, granted := range strings.Fields(claims.Scope) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopesOf returns the scopes the access tokens of the user get.
+func (s *userService) scopesOf(userId primitive.ObjectID) []string {
+	scopes := s.scopes
+	for _, id := range s.admin.UserIds {
+		if id == userId.Hex() {
+			scopes = append(append([]string(nil), scopes...), s.admin.Scope)
+		}
+	}
+	for _, id := range s.introspection.UserIds {
+		if id == userId.Hex() {
+			scopes = append(append([]string(nil), scopes...), s.introspection.Scope)
+		}
+	}
+	return scopes
+}
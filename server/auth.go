@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/store"
+	"rahulchhabra.io/token"
+)
+
+// authenticate verifies the bearer access token sent in the "authorization" metadata of the call,
+// checks that its session is still active and returns its claims. The signature alone would keep
+// the token working after a logout or a password reset, until it expires.
+func (s *userService) authenticate(ctx context.Context) (*token.Claims, error) {
+	claims, err := s.verifyAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userId, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid access token")
+	}
+	sessionId, err := primitive.ObjectIDFromHex(claims.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid access token")
+	}
+	session, err := s.sessions.GetSession(ctx, sessionId)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "Session has ended, log in again")
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not look up session: %s", err),
+		)
+	}
+	if session.UserId != userId || session.RevokedAt != nil || !session.ExpiresAt.After(time.Now()) {
+		return nil, status.Errorf(codes.Unauthenticated, "Session has ended, log in again")
+	}
+	return claims, nil
+}
+
+// verifyAccessToken verifies the bearer access token sent in the "authorization" metadata of the
+// call and returns its claims, without looking up its session.
+func (s *userService) verifyAccessToken(ctx context.Context) (*token.Claims, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "Missing access token")
+	}
+	scheme, accessToken, found := strings.Cut(values[0], " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return nil, status.Errorf(codes.Unauthenticated, "Authorization must use the Bearer scheme")
+	}
+	claims, err := s.verifier.Verify(strings.TrimSpace(accessToken))
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid access token")
+	}
+	return claims, nil
+}
+
+// requireFreshLogin refuses sensitive changes, named by action, unless the session of the access
+// token started recently. A stolen access token alone is then not enough to make them.
+func (s *userService) requireFreshLogin(ctx context.Context, claims *token.Claims, action string) error {
+	sessionId, err := primitive.ObjectIDFromHex(claims.SessionId)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "Invalid access token")
+	}
+	session, err := s.sessions.GetSession(ctx, sessionId)
+	if err != nil || session.RevokedAt != nil || time.Since(session.CreatedAt) > s.mfa.FreshLogin {
+		return status.Errorf(
+			codes.PermissionDenied,
+			fmt.Sprintf("Log in again to %s, the login must be less than %s old", action, s.mfa.FreshLogin),
+		)
+	}
+	return nil
+}
+
+// clientIP returns the IP address of the caller taken from the gRPC peer information.
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// userAgent returns the user agent the caller sent in its metadata.
+func userAgent(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("user-agent"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
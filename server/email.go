@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/encryption"
+	"rahulchhabra.io/mail"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+// emailVerification is the purpose of the tokens in verification links. A token is sealed with its
+// purpose as associated data, so it can not be used for anything else.
+const emailVerification = "email-verification"
+
+// emailSendTimeout bounds how long sending one email may take.
+const emailSendTimeout = 30 * time.Second
+
+// verificationEmailSent answers every ResendVerificationEmail, whether or not an email was sent.
+const verificationEmailSent = "If this email address belongs to an account that is not verified yet, a new verification link has been sent"
+
+// emailToken is what the links emailed to users carry. It is sealed, so users can neither read nor
+// forge it.
+type emailToken struct {
+	UserId  string    `json:"sub"`
+	Email   string    `json:"email"`
+	Expires time.Time `json:"exp"`
+	// Password fingerprints the password hash the token was issued for, see passwordFingerprint.
+	Password string `json:"pwd,omitempty"`
+}
+
+// newLinkKeyring returns the keys emailed links are sealed with: the configured keys, or else a
+// random key that only lasts as long as the server runs.
+func newLinkKeyring(configured *encryption.Keyring) (*encryption.Keyring, error) {
+	if configured != nil {
+		return configured, nil
+	}
+	key := make([]byte, encryption.KeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	log.Printf("No mfa encryption key configured, emailed links stop working when the server restarts")
+	return encryption.NewKeyring("ephemeral", map[string][]byte{"ephemeral": key})
+}
+
+// sealEmailToken creates the token of a link for purpose, sent to the current email address of
+// the user and valid for ttl.
+func (s *userService) sealEmailToken(purpose string, user model.User, ttl time.Duration) (string, error) {
+	return s.sealToken(purpose, emailToken{
+		UserId:  user.Id.Hex(),
+		Email:   user.Email,
+		Expires: time.Now().Add(ttl).UTC(),
+	})
+}
+
+// sealToken seals token for purpose.
+func (s *userService) sealToken(purpose string, token emailToken) (string, error) {
+	content, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return s.links.Seal(content, []byte(purpose))
+}
+
+// openEmailToken reads a token made by sealEmailToken for purpose, and refuses it once expired.
+func (s *userService) openEmailToken(purpose string, sealed string) (emailToken, error) {
+	content, err := s.links.Open(sealed, []byte(purpose))
+	if err != nil {
+		return emailToken{}, err
+	}
+	var token emailToken
+	if err := json.Unmarshal(content, &token); err != nil {
+		return emailToken{}, err
+	}
+	if token.Expires.Before(time.Now()) {
+		return emailToken{}, errors.New("token expired")
+	}
+	return token, nil
+}
+
+// emailLink adds the token to the page of the web app handling it. Without a page the token is
+// sent on its own, for the user to paste.
+func emailLink(page string, token string) string {
+	if page == "" {
+		return token
+	}
+	link, err := url.Parse(page)
+	if err != nil {
+		return token
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String()
+}
+
+// greeting is how emails address the user.
+func greeting(user model.User) string {
+	if user.FirstName != "" {
+		return "Hi " + user.FirstName + ","
+	}
+	return "Hi,"
+}
+
+// readableDuration writes d the way an email would, e.g. "24 hours" rather than "24h0m0s".
+func readableDuration(d time.Duration) string {
+	count, unit := int64(d/time.Minute), "minute"
+	switch {
+	case d >= 48*time.Hour && d%(24*time.Hour) == 0:
+		count, unit = int64(d/(24*time.Hour)), "day"
+	case d >= time.Hour && d%time.Hour == 0:
+		count, unit = int64(d/time.Hour), "hour"
+	case d < time.Minute:
+		return d.String()
+	}
+	if count != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", count, unit)
+}
+
+// sendEmail sends the message in the background and logs when it fails. Callers do not wait for
+// the mail server, and answer as fast whether or not they had an email to send.
+func (s *userService) sendEmail(message mail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emailSendTimeout)
+		defer cancel()
+		if err := s.mailer.Send(ctx, message); err != nil {
+			log.Printf("Failed to send %q email to %s: %s", message.Subject, message.To, err)
+		}
+	}()
+}
+
+// sendVerificationEmail sends the user a link verifying their current email address.
+func (s *userService) sendVerificationEmail(user model.User) {
+	if user.Email == "" {
+		return
+	}
+	ttl := s.email.Verification.TTL
+	token, err := s.sealEmailToken(emailVerification, user, ttl)
+	if err != nil {
+		log.Printf("Failed to create verification link of user %s: %s", user.Id.Hex(), err)
+		return
+	}
+	s.sendEmail(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("%s\n\nConfirm that this is your email address with this link, within %s:\n\n%s\n\nIf you did not sign up, you can ignore this email.\n",
+			greeting(user), readableDuration(ttl), emailLink(s.email.Verification.URL, token)),
+	})
+}
+
+// requireVerifiedEmail refuses logins of users whose email address is not verified, when the
+// configuration requires it. It is only called once the password or passkey proved who the caller
+// is, so its distinct error is kept even while account existence is hidden: it tells the owner of
+// the account what to do, and nobody else ever sees it.
+func (s *userService) requireVerifiedEmail(user model.User) error {
+	if !s.email.Verification.Required || user.EmailVerified {
+		return nil
+	}
+	st := status.New(codes.FailedPrecondition, "Email address is not verified, follow the link sent to it or ask for a new one")
+	detailed, err := st.WithDetails(&errdetails.PreconditionFailure{
+		Violations: []*errdetails.PreconditionFailure_Violation{
+			{
+				Type:        "EMAIL_NOT_VERIFIED",
+				Subject:     "user.email",
+				Description: "The email address of the account must be verified before logging in",
+			},
+		},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// Responsible for verifying an email address with the token from the link sent to it.
+func (s *userService) VerifyEmail(ctx context.Context, request *userproto.VerifyEmailRequest) (*userproto.VerifyEmailResponse, error) {
+	invalid := status.Errorf(codes.InvalidArgument, "Verification link is invalid or expired, ask for a new one")
+	token, err := s.openEmailToken(emailVerification, request.GetToken())
+	if err != nil {
+		return nil, invalid
+	}
+	oid, err := primitive.ObjectIDFromHex(token.UserId)
+	if err != nil {
+		return nil, invalid
+	}
+	// A link sent before the email address changed no longer verifies anything.
+	err = s.users.MarkEmailVerified(ctx, oid, token.Email)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not verify email: %s", err),
+		)
+	}
+	user, err := s.users.GetByID(ctx, oid)
+	if err != nil {
+		return nil, storeError(err, model.User{})
+	}
+	return &userproto.VerifyEmailResponse{User: userToProto(user)}, nil
+}
+
+// Responsible for sending a new verification link. The answer is the same for every address, so it
+// does not tell which accounts exist or are verified.
+func (s *userService) ResendVerificationEmail(ctx context.Context, request *userproto.ResendVerificationEmailRequest) (*userproto.ResendVerificationEmailResponse, error) {
+	if request.GetEmail() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Field \"email\" is required")
+	}
+	user, err := s.users.GetByEmail(ctx, request.GetEmail())
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not look up user: %s", err),
+		)
+	}
+	if err == nil && !user.EmailVerified {
+		s.sendVerificationEmail(user)
+	}
+	return &userproto.ResendVerificationEmailResponse{Message: verificationEmailSent}, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"rahulchhabra.io/model"
+	"rahulchhabra.io/password"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+// signupReceived answers every signup while the service hides which accounts exist, whether an
+// account was created or the email address was already registered.
+const signupReceived = "If this email address was not registered yet, the account has been created"
+
+// newDummyHash hashes a random password with the current settings. Verifying passwords against it
+// costs as much as verifying them against the hash of a real user.
+func newDummyHash(passwords *password.Manager) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return passwords.Hash(hex.EncodeToString(random))
+}
+
+// verifyDummy spends as long as checking a password of a real user, so the response time does not
+// tell that there was no user to check it against. It does nothing unless account existence is hidden.
+func (s *userService) verifyDummy(plaintext string) {
+	if s.dummyHash == "" {
+		return
+	}
+	s.passwords.Verify(s.dummyHash, plaintext)
+}
+
+// createUserQuietly stores a new user without telling whether its email address was already
+// registered: both get the same response, and the owner of the existing account is left alone.
+func (s *userService) createUserQuietly(ctx context.Context, newUser model.User) (*userproto.CreateUserResponse, error) {
+	// Usernames are shown to other users anyway, so a taken one is reported. Looking it up first
+	// keeps the store from only reporting it for email addresses that are not registered.
+	if newUser.Username != "" {
+		_, err := s.users.GetByUsername(ctx, newUser.Username)
+		if err == nil {
+			return nil, storeError(&store.DuplicateError{Field: "username"}, newUser)
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			return nil, storeError(err, newUser)
+		}
+	}
+
+	var duplicate *store.DuplicateError
+	err := s.users.Create(ctx, &newUser)
+	if err != nil && !errors.As(err, &duplicate) {
+		return nil, storeError(err, newUser)
+	}
+	if err == nil {
+		s.sendVerificationEmail(newUser)
+	}
+	return &userproto.CreateUserResponse{Message: signupReceived}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+	"rahulchhabra.io/token"
+)
+
+// Responsible for telling other services whether a token is currently active. Unlike an offline
+// signature check this also sees logouts, revoked sessions and deleted users. The answer tells who
+// the token belongs to, so only admins and the services allowed in introspection may ask.
+func (s *userService) IntrospectToken(ctx context.Context, request *userproto.IntrospectTokenRequest) (*userproto.IntrospectTokenResponse, error) {
+	if err := s.requireIntrospector(ctx); err != nil {
+		return nil, err
+	}
+	inactive := &userproto.IntrospectTokenResponse{Active: false}
+
+	if request.GetTokenTypeHint() != "refresh_token" {
+		response, err := s.introspectAccessToken(ctx, request.GetToken())
+		if err != nil || response.Active || request.GetTokenTypeHint() == "access_token" {
+			return response, err
+		}
+	}
+	response, err := s.introspectRefreshToken(ctx, request.GetToken())
+	if err != nil || response.Active || request.GetTokenTypeHint() == "refresh_token" {
+		return response, err
+	}
+	return inactive, nil
+}
+
+// introspectAccessToken verifies an access token and checks that its session and user still exist.
+func (s *userService) introspectAccessToken(ctx context.Context, accessToken string) (*userproto.IntrospectTokenResponse, error) {
+	inactive := &userproto.IntrospectTokenResponse{Active: false}
+
+	claims, err := s.verifier.Verify(accessToken)
+	if err != nil {
+		return inactive, nil
+	}
+	userId, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return inactive, nil
+	}
+	sessionId, err := primitive.ObjectIDFromHex(claims.SessionId)
+	if err != nil {
+		return inactive, nil
+	}
+	user, active, err := s.activeSessionUser(ctx, sessionId, userId)
+	if err != nil || !active {
+		return inactive, err
+	}
+
+	response := &userproto.IntrospectTokenResponse{
+		Active:    true,
+		Scope:     claims.Scope,
+		Username:  user.Username,
+		Email:     user.Email,
+		TokenType: "access_token",
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+		Sid:       claims.SessionId,
+	}
+	if claims.ExpiresAt != nil {
+		response.Exp = timestamppb.New(claims.ExpiresAt.Time)
+	}
+	if claims.IssuedAt != nil {
+		response.Iat = timestamppb.New(claims.IssuedAt.Time)
+	}
+	if claims.NotBefore != nil {
+		response.Nbf = timestamppb.New(claims.NotBefore.Time)
+	}
+	return response, nil
+}
+
+// introspectRefreshToken looks up a refresh token, which is active until it is rotated, revoked or expires.
+func (s *userService) introspectRefreshToken(ctx context.Context, refreshToken string) (*userproto.IntrospectTokenResponse, error) {
+	inactive := &userproto.IntrospectTokenResponse{Active: false}
+
+	record, err := s.sessions.GetRefreshToken(ctx, token.HashRefreshToken(refreshToken))
+	if errors.Is(err, store.ErrNotFound) {
+		return inactive, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not look up refresh token: %s", err),
+		)
+	}
+	if record.RotatedAt != nil || record.RevokedAt != nil || !record.ExpiresAt.After(time.Now()) {
+		return inactive, nil
+	}
+	user, active, err := s.activeSessionUser(ctx, record.SessionId, record.UserId)
+	if err != nil || !active {
+		return inactive, err
+	}
+	return &userproto.IntrospectTokenResponse{
+		Active:    true,
+		Username:  user.Username,
+		Email:     user.Email,
+		TokenType: "refresh_token",
+		Sub:       record.UserId.Hex(),
+		Sid:       record.SessionId.Hex(),
+		Exp:       timestamppb.New(record.ExpiresAt),
+		Iat:       timestamppb.New(record.CreatedAt),
+	}, nil
+}
+
+// activeSessionUser reports whether the session exists, belongs to the user and has neither been
+// revoked nor expired, and returns the user it belongs to.
+func (s *userService) activeSessionUser(ctx context.Context, sessionId primitive.ObjectID, userId primitive.ObjectID) (model.User, bool, error) {
+	session, err := s.sessions.GetSession(ctx, sessionId)
+	if errors.Is(err, store.ErrNotFound) {
+		return model.User{}, false, nil
+	}
+	if err != nil {
+		return model.User{}, false, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not look up session: %s", err),
+		)
+	}
+	if session.UserId != userId || session.RevokedAt != nil || !session.ExpiresAt.After(time.Now()) {
+		return model.User{}, false, nil
+	}
+
+	// Same lookup as AuthenticateUser, by id instead of identifier.
+	user, err := s.users.GetByID(ctx, userId)
+	if errors.Is(err, store.ErrNotFound) {
+		return model.User{}, false, nil
+	}
+	if err != nil {
+		return model.User{}, false, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not look up user: %s", err),
+		)
+	}
+	return user, true, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+func TestIntrospectTokenRequiresAllowedCaller(t *testing.T) {
+	s := newTestService(t, store.NewMemoryUserStore())
+	alice := createTestUser(t, s, "alice")
+	root := createTestUser(t, s, "root")
+	gateway := createTestUser(t, s, "gateway")
+	s.admin.UserIds = []string{root.Id.Hex()}
+	s.introspection.UserIds = []string{gateway.Id.Hex()}
+	pair, err := s.startSession(context.Background(), alice)
+	if err != nil {
+		t.Fatalf("startSession: %s", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"without an access token", context.Background(), codes.Unauthenticated},
+		// Any user could otherwise learn who a stolen token belongs to, or probe refresh tokens.
+		{"by a user", loggedIn(t, s, alice), codes.PermissionDenied},
+		{"by an admin", loggedIn(t, s, root), codes.OK},
+		{"by a user with the introspection scope", loggedIn(t, s, gateway), codes.OK},
+	} {
+		for _, request := range []*userproto.IntrospectTokenRequest{
+			{Token: pair.accessToken},
+			{Token: pair.refreshToken, TokenTypeHint: "refresh_token"},
+		} {
+			response, err := s.IntrospectToken(test.ctx, request)
+			if status.Code(err) != test.code {
+				t.Errorf("IntrospectToken %s: got %v, want %s", test.name, err, test.code)
+				continue
+			}
+			if test.code != codes.OK {
+				if response != nil {
+					t.Errorf("IntrospectToken %s answered %v", test.name, response)
+				}
+				continue
+			}
+			if !response.Active || response.Username != "alice" {
+				t.Errorf("IntrospectToken %s: got %v, want the active token of alice", test.name, response)
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+
+	userproto "rahulchhabra.io/proto/user"
+)
+
+// Responsible for publishing the public keys that verify access tokens. The same keys are served
+// over HTTP on /.well-known/jwks.json.
+func (s *userService) GetPublicKeys(ctx context.Context, request *userproto.GetPublicKeysRequest) (*userproto.GetPublicKeysResponse, error) {
+	response := &userproto.GetPublicKeysResponse{}
+	for _, key := range s.keys.JWKS().Keys {
+		response.Keys = append(response.Keys, &userproto.PublicKey{
+			Kty: key.Kty,
+			Kid: key.Kid,
+			Use: key.Use,
+			Alg: key.Alg,
+			N:   key.N,
+			E:   key.E,
+			Crv: key.Crv,
+			X:   key.X,
+			Y:   key.Y,
+		})
+	}
+	return response, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// Responsible for listing users page by page, for admins only. Pages are cut on the id of the users,
+// which is also their creation order, so a page token is simply the id of the last user of the
+// previous page.
+func (s *userService) ListUsers(ctx context.Context, request *userproto.ListUsersRequest) (*userproto.ListUsersResponse, error) {
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	pageSize := int64(request.GetPageSize())
+	if pageSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "pageSize can not be negative")
+	}
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	filter, err := listUsersFilter(request)
+	if err != nil {
+		return nil, err
+	}
+	listOptions := store.ListOptions{
+		Filter:     filter,
+		Descending: request.GetDescending(),
+		// Ask for one extra user to find out whether there is a next page.
+		Limit: pageSize + 1,
+	}
+	if request.GetPageToken() != "" {
+		listOptions.After, err = decodePageToken(request.GetPageToken())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The total is counted without the page token so it stays the same across pages.
+	totalSize, err := s.users.Count(ctx, filter)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not count users: %s", err),
+		)
+	}
+	users, err := s.users.List(ctx, listOptions)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not list users: %s", err),
+		)
+	}
+
+	response := &userproto.ListUsersResponse{TotalSize: totalSize}
+	if int64(len(users)) > pageSize {
+		users = users[:pageSize]
+		response.NextPageToken = encodePageToken(users[len(users)-1].Id)
+	}
+	for _, user := range users {
+		response.Users = append(response.Users, userToProto(user))
+	}
+	return response, nil
+}
+
+// listUsersFilter turns the filters of the request into a store filter.
+func listUsersFilter(request *userproto.ListUsersRequest) (store.UserFilter, error) {
+	filter := store.UserFilter{
+		EmailDomain:    request.GetEmailDomain(),
+		UsernamePrefix: request.GetUsernamePrefix(),
+	}
+	if request.GetCreatedAfter() != nil {
+		filter.CreatedAfter = request.GetCreatedAfter().AsTime()
+	}
+	if request.GetCreatedBefore() != nil {
+		filter.CreatedBefore = request.GetCreatedBefore().AsTime()
+	}
+
+	switch request.GetStatus() {
+	case userproto.UserStatus_USER_STATUS_UNSPECIFIED:
+	case userproto.UserStatus_USER_STATUS_ACTIVE:
+		filter.Status = model.UserStatusActive
+	case userproto.UserStatus_USER_STATUS_DISABLED:
+		filter.Status = model.UserStatusDisabled
+	default:
+		return store.UserFilter{}, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Unknown status %s", request.GetStatus()),
+		)
+	}
+	return filter, nil
+}
+
+// encodePageToken turns the id of the last user of a page into an opaque page token.
+func encodePageToken(id primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+// decodePageToken reverses encodePageToken.
+func decodePageToken(pageToken string) (primitive.ObjectID, error) {
+	var id primitive.ObjectID
+	raw, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil || len(raw) != len(id) {
+		return id, status.Errorf(codes.InvalidArgument, "Invalid page token")
+	}
+	copy(id[:], raw)
+	return id, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"rahulchhabra.io/config"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+// ipThrottle tracks failed logins per source IP, across all accounts. The failures are kept in the
+// session store, so with a shared store every replica of the service sees those of the others.
+type ipThrottle struct {
+	config   config.LockoutConfig
+	sessions store.SessionStore
+}
+
+func newIPThrottle(lockoutConfig config.LockoutConfig, sessions store.SessionStore) *ipThrottle {
+	return &ipThrottle{config: lockoutConfig, sessions: sessions}
+}
+
+// retryAfter returns how long the IP has to wait before it may try to log in again. Failing to look
+// it up is logged and lets the login through, like an outage of the rate limiter.
+func (t *ipThrottle) retryAfter(ctx context.Context, ip string, now time.Time) time.Duration {
+	if t.config.IPThreshold == 0 || ip == "" {
+		return 0
+	}
+	lockedUntil, err := t.sessions.IPLockedUntil(ctx, ip)
+	if err != nil {
+		log.Printf("Failed to look up failed logins from %s: %s", ip, err)
+		return 0
+	}
+	if lockedUntil.After(now) {
+		return lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// fail records a failed login from the IP.
+func (t *ipThrottle) fail(ctx context.Context, ip string, now time.Time) {
+	if t.config.IPThreshold == 0 || ip == "" {
+		return
+	}
+	failures, err := t.sessions.RecordIPFailure(ctx, ip, now, t.config.Window)
+	if err != nil {
+		log.Printf("Failed to record failed login from %s: %s", ip, err)
+		return
+	}
+	// Many users can share an IP behind a NAT, so IPs are not slowed down before the lockout.
+	if failures >= t.config.IPThreshold {
+		if err := t.sessions.LockIP(ctx, ip, now.Add(t.config.Duration)); err != nil {
+			log.Printf("Failed to lock out %s: %s", ip, err)
+		}
+	}
+}
+
+// tooManyAttempts is the error of a login refused because of earlier failures. RetryInfo tells the
+// client when it may try again.
+func tooManyAttempts(retryAfter time.Duration) error {
+	retryAfter = retryAfter.Round(time.Second)
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	st := status.New(
+		codes.ResourceExhausted,
+		fmt.Sprintf("Too many failed login attempts, try again in %s", retryAfter),
+	)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// recordFailedLogin counts a failed login to the user and slows down or locks out further attempts.
+// Failing to record it is logged, it must not turn a wrong password into a different error.
+func (s *userService) recordFailedLogin(ctx context.Context, user model.User, now time.Time) {
+	if s.lockout.Threshold == 0 {
+		return
+	}
+	failures, err := s.users.RecordFailedLogin(ctx, user.Id, now, s.lockout.Window)
+	if err != nil {
+		log.Printf("Failed to record failed login of user %s: %s", user.Id.Hex(), err)
+		return
+	}
+	delay := s.lockout.Delay(failures, s.lockout.Threshold)
+	if delay == 0 {
+		return
+	}
+	if failures >= s.lockout.Threshold {
+		log.Printf("Locking user %s for %s after %d failed logins", user.Id.Hex(), delay, failures)
+	}
+	if err := s.users.LockUntil(ctx, user.Id, now.Add(delay)); err != nil {
+		log.Printf("Failed to lock user %s: %s", user.Id.Hex(), err)
+	}
+}
+
+// forgetFailedLogins resets the failed logins of a user who just logged in successfully.
+func (s *userService) forgetFailedLogins(ctx context.Context, user model.User) {
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return
+	}
+	if err := s.users.ResetFailedLogins(ctx, user.Id); err != nil {
+		log.Printf("Failed to reset failed logins of user %s: %s", user.Id.Hex(), err)
+	}
+}
+
+// Responsible for lifting the lock of a user locked out after too many failed logins. Only admins
+// can do this, anybody else could undo the lockout of an account they are guessing the password of.
+func (s *userService) UnlockUser(ctx context.Context, request *userproto.UnlockUserRequest) (*userproto.UnlockUserResponse, error) {
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	oid, err := parseUserId(request.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.users.ResetFailedLogins(ctx, oid); err != nil {
+		return nil, storeError(err, model.User{})
+	}
+	user, err := s.users.GetByID(ctx, oid)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "User not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not load user: %s", err),
+		)
+	}
+	return &userproto.UnlockUserResponse{User: userToProto(user)}, nil
+}
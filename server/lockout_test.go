@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+func TestUnlockUserRequiresAdmin(t *testing.T) {
+	s := newTestService(t, store.NewMemoryUserStore())
+	alice := createTestUser(t, s, "alice")
+	root := createTestUser(t, s, "root")
+	s.admin.UserIds = []string{root.Id.Hex()}
+	if err := s.users.LockUntil(context.Background(), alice.Id, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("LockUntil: %s", err)
+	}
+	request := &userproto.UnlockUserRequest{Id: alice.Id.Hex()}
+
+	if _, err := s.UnlockUser(context.Background(), request); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("UnlockUser without an access token: got %v, want Unauthenticated", err)
+	}
+	// Not even the locked out user, whose access token may have been stolen, can lift the lock.
+	if _, err := s.UnlockUser(loggedIn(t, s, alice), request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("UnlockUser by the user: got %v, want PermissionDenied", err)
+	}
+	if user, _ := s.users.GetByID(context.Background(), alice.Id); user.LockedUntil == nil {
+		t.Fatal("user was unlocked by a caller who is not an admin")
+	}
+
+	if _, err := s.UnlockUser(loggedIn(t, s, root), request); err != nil {
+		t.Fatalf("UnlockUser by an admin: %s", err)
+	}
+	if user, _ := s.users.GetByID(context.Background(), alice.Id); user.LockedUntil != nil {
+		t.Errorf("user is still locked until %s after UnlockUser", user.LockedUntil)
+	}
+}
+
+func TestIPLockoutIsSharedByReplicas(t *testing.T) {
+	users := store.NewMemoryUserStore()
+	sessions := store.NewMemorySessionStore()
+	replicas := []*userService{newTestService(t, users), newTestService(t, users)}
+	for _, s := range replicas {
+		s.sessions = sessions
+		s.lockout.IPThreshold = 3
+		s.ips = newIPThrottle(s.lockout, sessions)
+	}
+	createTestUser(t, replicas[0], "ada")
+	from := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}})
+	}
+
+	// Guesses spread over the replicas all count against the source IP.
+	for i := range 3 {
+		request := &userproto.AuthenticateUserRequest{Identifier: "nobody", Password: testPassword}
+		if _, err := replicas[i%2].AuthenticateUser(from("203.0.113.7"), request); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("AuthenticateUser of an unknown user: got %v, want Unauthenticated", err)
+		}
+	}
+	request := &userproto.AuthenticateUserRequest{Identifier: "ada", Password: testPassword}
+	for i, s := range replicas {
+		if _, err := s.AuthenticateUser(from("203.0.113.7"), request); status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("AuthenticateUser on replica %d from the locked out IP: got %v, want ResourceExhausted", i, err)
+		}
+	}
+	if _, err := replicas[1].AuthenticateUser(from("198.51.100.1"), request); err != nil {
+		t.Errorf("AuthenticateUser from another IP: %s", err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/config"
+	"rahulchhabra.io/mail"
+	"rahulchhabra.io/model"
+	"rahulchhabra.io/password"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+	"rahulchhabra.io/token"
+)
+
+// testPassword follows the default password policy.
+const testPassword = "plum sailboat velvet 42"
+
+// testMailer keeps the emails sent by the service instead of sending them.
+type testMailer struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, message mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// testUserStores returns a constructor of every user store that runs without a server.
+func testUserStores() map[string]func(t *testing.T) store.UserStore {
+	return map[string]func(t *testing.T) store.UserStore{
+		"memory": func(t *testing.T) store.UserStore {
+			return store.NewMemoryUserStore()
+		},
+		"sqlite": func(t *testing.T) store.UserStore {
+			db, err := store.OpenSQL(context.Background(), store.SQLite, filepath.Join(t.TempDir(), "users.db"))
+			if err != nil {
+				t.Fatalf("open sqlite: %s", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return store.NewSQLUserStore(db, store.SQLite)
+		},
+	}
+}
+
+// newTestService creates a userService on users with the default configuration and its own signing
+// keys, except for cheap password hashing and emails that are kept by a testMailer.
+func newTestService(t *testing.T, users store.UserStore) *userService {
+	t.Helper()
+	cfg := config.Default()
+	links, err := newLinkKeyring(nil)
+	if err != nil {
+		t.Fatalf("link keys: %s", err)
+	}
+	keys, err := token.NewKeySet(cfg.Token.SigningAlgorithm, cfg.Token.KeyRetention())
+	if err != nil {
+		t.Fatalf("signing keys: %s", err)
+	}
+	challengeAudience := cfg.Token.Audience + challengeAudienceSuffix
+	sessions := store.NewMemorySessionStore()
+	return &userService{
+		users:      users,
+		sessions:   sessions,
+		keys:       keys,
+		tokens:     token.NewIssuer(keys, cfg.Token.Issuer, cfg.Token.Audience, cfg.Token.TTL),
+		verifier:   token.NewVerifier(keys, cfg.Token.Issuer, cfg.Token.Audience),
+		refreshTTL: cfg.Token.RefreshTTL,
+		scopes:     cfg.Token.Scopes,
+
+		secrets:           links,
+		challenges:        token.NewIssuer(keys, cfg.Token.Issuer, challengeAudience, cfg.MFA.ChallengeTTL),
+		challengeVerifier: token.NewVerifier(keys, cfg.Token.Issuer, challengeAudience),
+		credentials:       store.NewMemoryCredentialStore(),
+
+		passwords: password.NewManager(password.Argon2id{
+			Memory:      64,
+			Iterations:  1,
+			Parallelism: 1,
+			SaltLength:  16,
+			KeyLength:   32,
+		}),
+		policy:  cfg.Password.NewPasswordPolicy(),
+		lockout: cfg.Lockout,
+		ips:     newIPThrottle(cfg.Lockout, sessions),
+		admin:   cfg.Admin,
+		mfa:     cfg.MFA,
+		mailer:  &testMailer{},
+		links:   links,
+		email:   cfg.Email,
+
+		introspection: cfg.Introspection,
+	}
+}
+
+// createTestUser signs up a user with testPassword.
+func createTestUser(t *testing.T, s *userService, username string) model.User {
+	t.Helper()
+	email := username + "@example.com"
+	_, err := s.CreateUser(context.Background(), &userproto.CreateUserRequest{
+		User:     &userproto.User{Email: email, Username: username},
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %s", username, err)
+	}
+	user, err := s.users.GetByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatalf("GetByEmail(%s): %s", email, err)
+	}
+	return user
+}
+
+// loggedIn returns a context carrying an access token of a new session of the user.
+func loggedIn(t *testing.T, s *userService, user model.User) context.Context {
+	t.Helper()
+	pair, err := s.startSession(context.Background(), user)
+	if err != nil {
+		t.Fatalf("startSession: %s", err)
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+pair.accessToken))
+}
+
+func TestCreateUserConcurrentDuplicates(t *testing.T) {
+	const attempts = 20
+	for name, newUsers := range testUserStores() {
+		t.Run(name, func(t *testing.T) {
+			users := newUsers(t)
+			s := newTestService(t, users)
+			ctx := context.Background()
+
+			// Every signup uses the same address and username, in varying case.
+			errs := make([]error, attempts)
+			var wg sync.WaitGroup
+			for i := range attempts {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					email, username := "race@example.com", "racer"
+					if i%2 == 1 {
+						email, username = strings.ToUpper(email), strings.ToUpper(username)
+					}
+					_, errs[i] = s.CreateUser(ctx, &userproto.CreateUserRequest{
+						User:     &userproto.User{Email: email, Username: username},
+						Password: testPassword,
+					})
+				}()
+			}
+			wg.Wait()
+
+			created := 0
+			for _, err := range errs {
+				switch status.Code(err) {
+				case codes.OK:
+					created++
+				case codes.AlreadyExists:
+				default:
+					t.Errorf("CreateUser: got %v, want OK or AlreadyExists", err)
+				}
+			}
+			if created != 1 {
+				t.Errorf("%d of %d concurrent signups succeeded, want exactly 1", created, attempts)
+			}
+			if count, err := users.Count(ctx, store.UserFilter{}); err != nil || count != 1 {
+				t.Errorf("store holds %d users (err %v), want 1", count, err)
+			}
+		})
+	}
+}
+
+func TestCreateUserValidatesEmailAndUsername(t *testing.T) {
+	s := newTestService(t, store.NewMemoryUserStore())
+	for _, user := range []*userproto.User{
+		{Email: "", Username: "ada"},
+		{Email: "ada", Username: "ada"},
+		{Email: "Ada <ada@example.com>", Username: "ada"},
+		{Email: "ada@example.com, bob@example.com", Username: "ada"},
+		{Email: "ada@example.com", Username: ""},
+		{Email: "ada@example.com", Username: "ada@example.com"},
+	} {
+		_, err := s.CreateUser(context.Background(), &userproto.CreateUserRequest{User: user, Password: testPassword})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateUser(%q, %q): got %v, want InvalidArgument", user.Email, user.Username, err)
+		}
+	}
+	_, err := s.CreateUser(context.Background(), &userproto.CreateUserRequest{
+		User:     &userproto.User{Email: "ada@example.com", Username: "ada"},
+		Password: testPassword,
+	})
+	if err != nil {
+		t.Errorf("CreateUser with a valid email and username: %v", err)
+	}
+}
+
+func TestCreateUserRefusesPasswordsTooLongForBcrypt(t *testing.T) {
+	cfg := config.Default()
+	cfg.Password.Algorithm = config.PasswordBcrypt
+	s := newTestService(t, store.NewMemoryUserStore())
+	s.passwords = password.NewManager(password.Bcrypt{Cost: config.MinBcryptCost})
+	s.policy = cfg.Password.NewPasswordPolicy()
+
+	// 75 characters, but 80 bytes.
+	long := "plum sailboat velvet 42 " + strings.Repeat("é", 5) + strings.Repeat("x", 46)
+	_, err := s.CreateUser(context.Background(), &userproto.CreateUserRequest{
+		User:     &userproto.User{Email: "ada@example.com", Username: "ada"},
+		Password: long,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateUser with an %d byte password: got %v, want InvalidArgument", len(long), err)
+	}
+}
+
+func TestHideAccountExistence(t *testing.T) {
+	s := newTestService(t, store.NewMemoryUserStore())
+	s.hideAccountExistence = true
+	var err error
+	if s.dummyHash, err = newDummyHash(s.passwords); err != nil {
+		t.Fatalf("newDummyHash: %s", err)
+	}
+	ada := createTestUser(t, s, "ada")
+
+	// A taken email address gets the same answer as a new one, a taken username is still reported.
+	for _, user := range []*userproto.User{
+		{Email: "grace@example.com", Username: "grace"},
+		{Email: ada.Email, Username: "hopper"},
+	} {
+		response, err := s.CreateUser(context.Background(), &userproto.CreateUserRequest{User: user, Password: testPassword})
+		if err != nil || response.GetMessage() != signupReceived || response.GetUser() != nil {
+			t.Errorf("CreateUser(%s): got %v, %v, want only the message %q", user.Email, response, err, signupReceived)
+		}
+	}
+	_, err = s.CreateUser(context.Background(), &userproto.CreateUserRequest{
+		User:     &userproto.User{Email: "lovelace@example.com", Username: ada.Username},
+		Password: testPassword,
+	})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateUser with a taken username: got %v, want AlreadyExists", err)
+	}
+
+	// A locked account looks like a wrong password, not like a lockout.
+	if err := s.users.LockUntil(context.Background(), ada.Id, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("LockUntil: %s", err)
+	}
+	_, err = s.AuthenticateUser(context.Background(), &userproto.AuthenticateUserRequest{Identifier: ada.Email, Password: testPassword})
+	if status.Code(err) != codes.Unauthenticated || status.Convert(err).Message() != invalidCredentials {
+		t.Errorf("AuthenticateUser of a locked account: got %v, want Unauthenticated %q", err, invalidCredentials)
+	}
+}
+
+func TestAuthenticateUserUnverifiedEmailWhileHidingAccounts(t *testing.T) {
+	s := newTestService(t, store.NewMemoryUserStore())
+	s.email.Verification.Required = true
+	s.hideAccountExistence = true
+	var err error
+	if s.dummyHash, err = newDummyHash(s.passwords); err != nil {
+		t.Fatalf("newDummyHash: %s", err)
+	}
+	createTestUser(t, s, "ada")
+
+	// Without the password an unverified account looks like any other failed login.
+	for _, identifier := range []string{"ada@example.com", "nobody@example.com"} {
+		_, err := s.AuthenticateUser(context.Background(), &userproto.AuthenticateUserRequest{Identifier: identifier, Password: "wrong password"})
+		if status.Code(err) != codes.Unauthenticated || status.Convert(err).Message() != invalidCredentials {
+			t.Errorf("AuthenticateUser(%s) with a wrong password: got %v, want Unauthenticated %q", identifier, err, invalidCredentials)
+		}
+	}
+	// The owner learns why they can not log in.
+	_, err = s.AuthenticateUser(context.Background(), &userproto.AuthenticateUserRequest{Identifier: "ada@example.com", Password: testPassword})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("AuthenticateUser with the right password: got %v, want FailedPrecondition", err)
+	}
+}
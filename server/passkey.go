@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+// The state of a passkey registration or login is encrypted with one of these as associated data,
+// so the state of one can not be used to finish the other.
+const (
+	passkeyRegistration = "passkey-registration"
+	passkeyLogin        = "passkey-login"
+)
+
+// passkeyUser presents a user and their passkeys to the WebAuthn library.
+type passkeyUser struct {
+	user        model.User
+	credentials []model.Credential
+}
+
+// The user handle stored on the authenticator is the id of the user, which is how a passwordless
+// login finds the user without asking for a username.
+func (u passkeyUser) WebAuthnID() []byte {
+	return u.user.Id[:]
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	if u.user.Email != "" {
+		return u.user.Email
+	}
+	return u.user.Username
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	if name := strings.TrimSpace(u.user.FirstName + " " + u.user.LastName); name != "" {
+		return name
+	}
+	return u.WebAuthnName()
+}
+
+func (u passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, credential := range u.credentials {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(credential.Transports))
+		for _, transport := range credential.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              credential.CredentialId,
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: credential.BackupEligible,
+				BackupState:    credential.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    credential.AAGUID,
+				SignCount: credential.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+// sealCeremony encodes the options of a passkey ceremony for the browser, and encrypts its state
+// for the client to send back when it finishes, so the server does not have to store it.
+func (s *userService) sealCeremony(options any, session *webauthn.SessionData, ceremony string) (string, string, error) {
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return "", "", status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not encode passkey options: %s", err),
+		)
+	}
+	state, err := json.Marshal(session)
+	if err != nil {
+		return "", "", status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not encode passkey session: %s", err),
+		)
+	}
+	sealed, err := s.secrets.Seal(state, []byte(ceremony))
+	if err != nil {
+		return "", "", status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not encrypt passkey session: %s", err),
+		)
+	}
+	return string(encoded), sealed, nil
+}
+
+// openCeremony decrypts the state of a passkey ceremony sealed by sealCeremony, and makes sure it
+// has not expired or been used before.
+func (s *userService) openCeremony(ctx context.Context, sealed string, ceremony string) (webauthn.SessionData, error) {
+	invalid := status.Errorf(codes.Unauthenticated, "Invalid or expired passkey session, start again")
+	state, err := s.secrets.Open(sealed, []byte(ceremony))
+	if err != nil {
+		return webauthn.SessionData{}, invalid
+	}
+	var session webauthn.SessionData
+	if err := json.Unmarshal(state, &session); err != nil {
+		return webauthn.SessionData{}, invalid
+	}
+	now := time.Now()
+	if session.Expires.Before(now) {
+		return webauthn.SessionData{}, invalid
+	}
+	unused, err := s.useChallenge(ctx, ceremony, session.Challenge, session.Expires, now)
+	if err != nil {
+		return webauthn.SessionData{}, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not use passkey session: %s", err),
+		)
+	}
+	if !unused {
+		return webauthn.SessionData{}, invalid
+	}
+	return session, nil
+}
+
+// passkeyUserOf loads the passkeys of the user.
+func (s *userService) passkeyUserOf(ctx context.Context, user model.User) (passkeyUser, error) {
+	credentials, err := s.credentials.ListCredentials(ctx, user.Id)
+	if err != nil {
+		return passkeyUser{}, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not load passkeys: %s", err),
+		)
+	}
+	return passkeyUser{user: user, credentials: credentials}, nil
+}
+
+// requirePasskeys refuses passkey calls when no relying party is configured.
+func (s *userService) requirePasskeys() error {
+	if s.webauthn == nil {
+		return status.Errorf(codes.FailedPrecondition, "Passkeys are not configured")
+	}
+	return nil
+}
+
+// passkeyToProto converts a stored credential to the protobuf message shown to its owner.
+func passkeyToProto(credential model.Credential) *userproto.Passkey {
+	passkey := &userproto.Passkey{
+		Id:         credential.Id.Hex(),
+		CreatedAt:  timestamppb.New(credential.CreatedAt),
+		Transports: credential.Transports,
+	}
+	if credential.LastUsedAt != nil {
+		passkey.LastUsedAt = timestamppb.New(*credential.LastUsedAt)
+	}
+	return passkey
+}
+
+// Responsible for starting the registration of a passkey for the calling user.
+func (s *userService) BeginPasskeyRegistration(ctx context.Context, request *userproto.BeginPasskeyRegistrationRequest) (*userproto.BeginPasskeyRegistrationResponse, error) {
+	if err := s.requirePasskeys(); err != nil {
+		return nil, err
+	}
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.userFromSubject(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.requireFreshLogin(ctx, claims, "register a passkey"); err != nil {
+		return nil, err
+	}
+	owner, err := s.passkeyUserOf(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tell the authenticator which passkeys it already holds, so the same one is not registered twice.
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range owner.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	creation, session, err := s.webauthn.BeginRegistration(owner, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not start passkey registration: %s", err),
+		)
+	}
+	options, sealed, err := s.sealCeremony(creation, session, passkeyRegistration)
+	if err != nil {
+		return nil, err
+	}
+	return &userproto.BeginPasskeyRegistrationResponse{Options: options, Session: sealed}, nil
+}
+
+// Responsible for verifying and storing a passkey created by the authenticator of the calling user.
+func (s *userService) FinishPasskeyRegistration(ctx context.Context, request *userproto.FinishPasskeyRegistrationRequest) (*userproto.FinishPasskeyRegistrationResponse, error) {
+	if err := s.requirePasskeys(); err != nil {
+		return nil, err
+	}
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.userFromSubject(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.openCeremony(ctx, request.GetSession(), passkeyRegistration)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(strings.NewReader(request.GetCredential()))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Invalid passkey: %s", passkeyError(err)))
+	}
+	owner, err := s.passkeyUserOf(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	// Checks the session was started by the same user, and the attestation signature.
+	verified, err := s.webauthn.CreateCredential(owner, session, parsed)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Passkey could not be verified: %s", passkeyError(err)))
+	}
+
+	credential := model.Credential{
+		Id:              primitive.NewObjectID(),
+		UserId:          user.Id,
+		CredentialId:    verified.ID,
+		PublicKey:       verified.PublicKey,
+		AttestationType: verified.AttestationType,
+		AAGUID:          verified.Authenticator.AAGUID,
+		SignCount:       verified.Authenticator.SignCount,
+		BackupEligible:  verified.Flags.BackupEligible,
+		BackupState:     verified.Flags.BackupState,
+		CreatedAt:       time.Now().UTC(),
+	}
+	for _, transport := range parsed.Response.Transports {
+		credential.Transports = append(credential.Transports, string(transport))
+	}
+	err = s.credentials.CreateCredential(ctx, credential)
+	var duplicate *store.DuplicateError
+	if errors.As(err, &duplicate) {
+		return nil, status.Errorf(codes.AlreadyExists, "Passkey is already registered")
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not store passkey: %s", err),
+		)
+	}
+	log.Printf("User %s registered passkey %s", user.Id.Hex(), credential.Id.Hex())
+	return &userproto.FinishPasskeyRegistrationResponse{Passkey: passkeyToProto(credential)}, nil
+}
+
+// Responsible for starting a passwordless login. No user is named, the authenticator offers the
+// passkeys it holds for the service and the one picked tells who logs in.
+func (s *userService) BeginPasskeyLogin(ctx context.Context, request *userproto.BeginPasskeyLoginRequest) (*userproto.BeginPasskeyLoginResponse, error) {
+	if err := s.requirePasskeys(); err != nil {
+		return nil, err
+	}
+	assertion, session, err := s.webauthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not start passkey login: %s", err),
+		)
+	}
+	options, sealed, err := s.sealCeremony(assertion, session, passkeyLogin)
+	if err != nil {
+		return nil, err
+	}
+	return &userproto.BeginPasskeyLoginResponse{Options: options, Session: sealed}, nil
+}
+
+// Responsible for finishing a passwordless login with the signature of a passkey. The authenticator
+// verified the user with a PIN or biometrics, so no second factor is asked for.
+func (s *userService) FinishPasskeyLogin(ctx context.Context, request *userproto.FinishPasskeyLoginRequest) (*userproto.FinishPasskeyLoginResponse, error) {
+	if err := s.requirePasskeys(); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	ip := clientIP(ctx)
+	if retryAfter := s.ips.retryAfter(ctx, ip, now); retryAfter > 0 {
+		return nil, tooManyAttempts(retryAfter)
+	}
+
+	session, err := s.openCeremony(ctx, request.GetSession(), passkeyLogin)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(request.GetCredential()))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Invalid passkey: %s", passkeyError(err)))
+	}
+
+	// The user handle the authenticator returns is the id of the user the passkey was registered for.
+	var owner passkeyUser
+	findOwner := func(rawID []byte, userHandle []byte) (webauthn.User, error) {
+		if len(userHandle) != len(primitive.ObjectID{}) {
+			return nil, errors.New("unknown user handle")
+		}
+		user, err := s.users.GetByID(ctx, primitive.ObjectID(userHandle))
+		if err != nil {
+			return nil, err
+		}
+		if owner, err = s.passkeyUserOf(ctx, user); err != nil {
+			return nil, err
+		}
+		return owner, nil
+	}
+	verified, err := s.webauthn.ValidateDiscoverableLogin(findOwner, session, parsed)
+	if err != nil {
+		s.ips.fail(ctx, ip, now)
+		return nil, status.Errorf(codes.Unauthenticated, "Passkey could not be verified")
+	}
+	user := owner.user
+	if user.IsLocked(now) {
+		return nil, tooManyAttempts(user.LockedUntil.Sub(now))
+	}
+	if err := s.requireVerifiedEmail(user); err != nil {
+		return nil, err
+	}
+
+	var credential model.Credential
+	for _, candidate := range owner.credentials {
+		if string(candidate.CredentialId) == string(verified.ID) {
+			credential = candidate
+		}
+	}
+	// A counter that did not go up means two copies of the private key are in use.
+	if verified.Authenticator.CloneWarning {
+		log.Printf("Refusing passkey %s of user %s, its signature counter went back", credential.Id.Hex(), user.Id.Hex())
+		return nil, status.Errorf(codes.PermissionDenied, "Passkey may have been cloned, log in another way")
+	}
+	if err := s.credentials.UseCredential(ctx, credential.Id, verified.Authenticator.SignCount, verified.Flags.BackupState, now); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not update passkey: %s", err),
+		)
+	}
+
+	s.forgetFailedLogins(ctx, user)
+	tokens, err := s.startSession(ctx, user)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not issue tokens: %s", err),
+		)
+	}
+	return &userproto.FinishPasskeyLoginResponse{
+		AccessToken:           tokens.accessToken,
+		TokenType:             "Bearer",
+		ExpiresAt:             timestamppb.New(tokens.expiresAt),
+		RefreshToken:          tokens.refreshToken,
+		RefreshTokenExpiresAt: timestamppb.New(tokens.refreshTokenExpiresAt),
+	}, nil
+}
+
+// passkeyError returns the most helpful message of an error from the WebAuthn library.
+func passkeyError(err error) string {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) && protocolErr.DevInfo != "" {
+		return protocolErr.DevInfo
+	}
+	return err.Error()
+}
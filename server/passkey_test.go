@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/config"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+// Relying party of the passkey tests.
+const (
+	testRPID   = "localhost"
+	testOrigin = "https://localhost"
+)
+
+// Flags of authenticator data, WebAuthn section 6.1.
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+// softwareAuthenticator is a passkey authenticator holding one ECDSA P-256 key in memory. It attests
+// its credential with a packed self attestation and signs assertions like a security key would.
+type softwareAuthenticator struct {
+	t   *testing.T
+	key *ecdsa.PrivateKey
+	// forger, when set, signs instead of key, like somebody who copied everything but the key
+	forger       *ecdsa.PrivateKey
+	credentialId []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialId := make([]byte, 16)
+	rand.Read(credentialId)
+	return &softwareAuthenticator{t: t, key: key, credentialId: credentialId}
+}
+
+// challengeOf returns the challenge of the options of a ceremony.
+func challengeOf(t *testing.T, options string) string {
+	t.Helper()
+	var decoded struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal([]byte(options), &decoded); err != nil {
+		t.Fatalf("passkey options: %s", err)
+	}
+	return decoded.PublicKey.Challenge
+}
+
+// authenticatorData returns the authenticator data for the relying party, with the next signature
+// counter and, when attested is set, the credential and its public key.
+func (a *softwareAuthenticator) authenticatorData(attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(testRPID))
+	a.signCount++
+	data := append([]byte(nil), rpIdHash[:]...)
+	flags := byte(flagUserPresent | flagUserVerified)
+	if attested {
+		flags |= flagAttestedCredentialData
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !attested {
+		return data
+	}
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	data = append(data, make([]byte, 16)...) // AAGUID, all zeros for an unidentified authenticator
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialId)))
+	data = append(data, a.credentialId...)
+	return append(data, publicKey...)
+}
+
+// sign signs authenticator data and the hash of the client data, as both attestations and
+// assertions do.
+func (a *softwareAuthenticator) sign(authenticatorData []byte, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authenticatorData...), clientDataHash[:]...))
+	key := a.key
+	if a.forger != nil {
+		key = a.forger
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return signature
+}
+
+// clientData returns the client data JSON a browser on testOrigin would pass to the authenticator.
+func clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": testOrigin})
+	return data
+}
+
+// create answers the options of BeginPasskeyRegistration with a new credential for the user.
+func (a *softwareAuthenticator) create(options string, userHandle []byte) string {
+	a.userHandle = userHandle
+	data := clientData("webauthn.create", challengeOf(a.t, options))
+	authenticatorData := a.authenticatorData(true)
+	attestationObject, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "packed",
+		"attStmt":  map[string]any{"alg": int64(webauthncose.AlgES256), "sig": a.sign(authenticatorData, data)},
+		"authData": authenticatorData,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	credential, _ := json.Marshal(map[string]any{
+		"id":    encode(a.credentialId),
+		"rawId": encode(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(data),
+			"attestationObject": encode(attestationObject),
+		},
+	})
+	return string(credential)
+}
+
+// get answers the options of BeginPasskeyLogin with an assertion of the credential.
+func (a *softwareAuthenticator) get(options string) string {
+	data := clientData("webauthn.get", challengeOf(a.t, options))
+	authenticatorData := a.authenticatorData(false)
+	encode := base64.RawURLEncoding.EncodeToString
+	credential, _ := json.Marshal(map[string]any{
+		"id":    encode(a.credentialId),
+		"rawId": encode(a.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(data),
+			"authenticatorData": encode(authenticatorData),
+			"signature":         encode(a.sign(authenticatorData, data)),
+			"userHandle":        encode(a.userHandle),
+		},
+	})
+	return string(credential)
+}
+
+// newPasskeyTestService creates a test service whose relying party is testOrigin.
+func newPasskeyTestService(t *testing.T) *userService {
+	t.Helper()
+	s := newTestService(t, store.NewMemoryUserStore())
+	passkeys := config.Default().Passkeys
+	passkeys.RPID = testRPID
+	passkeys.Origins = []string{testOrigin}
+	var err error
+	if s.webauthn, err = passkeys.WebAuthn(); err != nil {
+		t.Fatalf("WebAuthn: %s", err)
+	}
+	return s
+}
+
+// registerPasskey registers a new passkey of authenticator for the user of ctx.
+func registerPasskey(t *testing.T, s *userService, ctx context.Context, authenticator *softwareAuthenticator, userHandle []byte) *userproto.FinishPasskeyRegistrationRequest {
+	t.Helper()
+	begin, err := s.BeginPasskeyRegistration(ctx, &userproto.BeginPasskeyRegistrationRequest{})
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration: %s", err)
+	}
+	request := &userproto.FinishPasskeyRegistrationRequest{
+		Session:    begin.Session,
+		Credential: authenticator.create(begin.Options, userHandle),
+	}
+	if _, err := s.FinishPasskeyRegistration(ctx, request); err != nil {
+		t.Fatalf("FinishPasskeyRegistration: %s", err)
+	}
+	return request
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	s := newPasskeyTestService(t)
+	user := createTestUser(t, s, "ada")
+	authenticator := newSoftwareAuthenticator(t)
+	registerPasskey(t, s, loggedIn(t, s, user), authenticator, user.Id[:])
+
+	passkeys, err := s.credentials.ListCredentials(context.Background(), user.Id)
+	if err != nil || len(passkeys) != 1 {
+		t.Fatalf("user has passkeys %v (err %v), want the registered one", passkeys, err)
+	}
+	if passkeys[0].AttestationType != "packed" {
+		t.Errorf("attestation type %q, want packed", passkeys[0].AttestationType)
+	}
+
+	// Nobody is named, the user handle of the passkey tells who logs in.
+	begin, err := s.BeginPasskeyLogin(context.Background(), &userproto.BeginPasskeyLoginRequest{})
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %s", err)
+	}
+	login, err := s.FinishPasskeyLogin(context.Background(), &userproto.FinishPasskeyLoginRequest{
+		Session:    begin.Session,
+		Credential: authenticator.get(begin.Options),
+	})
+	if err != nil {
+		t.Fatalf("FinishPasskeyLogin: %s", err)
+	}
+	claims, err := s.verifier.Verify(login.AccessToken)
+	if err != nil || claims.Subject != user.Id.Hex() {
+		t.Errorf("access token of the passkey login: claims %v (err %v), want subject %s", claims, err, user.Id.Hex())
+	}
+	if passkeys, _ := s.credentials.ListCredentials(context.Background(), user.Id); passkeys[0].SignCount != authenticator.signCount {
+		t.Errorf("stored signature counter %d, want %d", passkeys[0].SignCount, authenticator.signCount)
+	}
+}
+
+func TestPasskeyRejectsReplays(t *testing.T) {
+	s := newPasskeyTestService(t)
+	user := createTestUser(t, s, "ada")
+	ctx := loggedIn(t, s, user)
+	authenticator := newSoftwareAuthenticator(t)
+	registration := registerPasskey(t, s, ctx, authenticator, user.Id[:])
+
+	if _, err := s.FinishPasskeyRegistration(ctx, registration); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("FinishPasskeyRegistration sent again: got %v, want Unauthenticated", err)
+	}
+
+	begin, err := s.BeginPasskeyLogin(context.Background(), &userproto.BeginPasskeyLoginRequest{})
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %s", err)
+	}
+	login := &userproto.FinishPasskeyLoginRequest{Session: begin.Session, Credential: authenticator.get(begin.Options)}
+	if _, err := s.FinishPasskeyLogin(context.Background(), login); err != nil {
+		t.Fatalf("FinishPasskeyLogin: %s", err)
+	}
+	// A captured login can not be sent again, neither with its own session nor with a new one whose
+	// challenge it did not sign.
+	if _, err := s.FinishPasskeyLogin(context.Background(), login); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("FinishPasskeyLogin sent again: got %v, want Unauthenticated", err)
+	}
+	begin, err = s.BeginPasskeyLogin(context.Background(), &userproto.BeginPasskeyLoginRequest{})
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %s", err)
+	}
+	replayed := &userproto.FinishPasskeyLoginRequest{Session: begin.Session, Credential: login.Credential}
+	if _, err := s.FinishPasskeyLogin(context.Background(), replayed); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("FinishPasskeyLogin with the assertion of another challenge: got %v, want Unauthenticated", err)
+	}
+
+	// A signature by another key, of the right challenge, does not log in either.
+	begin, err = s.BeginPasskeyLogin(context.Background(), &userproto.BeginPasskeyLoginRequest{})
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %s", err)
+	}
+	authenticator.forger = newSoftwareAuthenticator(t).key
+	forged := &userproto.FinishPasskeyLoginRequest{Session: begin.Session, Credential: authenticator.get(begin.Options)}
+	if _, err := s.FinishPasskeyLogin(context.Background(), forged); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("FinishPasskeyLogin signed by another key: got %v, want Unauthenticated", err)
+	}
+}
+
+func TestPasskeyRegistrationChecksAttestation(t *testing.T) {
+	s := newPasskeyTestService(t)
+	user := createTestUser(t, s, "ada")
+	ctx := loggedIn(t, s, user)
+	authenticator := newSoftwareAuthenticator(t)
+	authenticator.forger = newSoftwareAuthenticator(t).key
+
+	begin, err := s.BeginPasskeyRegistration(ctx, &userproto.BeginPasskeyRegistrationRequest{})
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration: %s", err)
+	}
+	request := &userproto.FinishPasskeyRegistrationRequest{Session: begin.Session, Credential: authenticator.create(begin.Options, user.Id[:])}
+	if _, err := s.FinishPasskeyRegistration(ctx, request); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("FinishPasskeyRegistration attested by another key: got %v, want InvalidArgument", err)
+	}
+	if passkeys, _ := s.credentials.ListCredentials(ctx, user.Id); len(passkeys) != 0 {
+		t.Errorf("passkey with a forged attestation was stored")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"rahulchhabra.io/config"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/ratelimit"
+)
+
+// rateLimiter builds the interceptor that limits calls to the service as configured. Calls made
+// with a valid access token are limited per user as well as per IP.
+func (s *userService) rateLimiter(rateLimitConfig config.RateLimitConfig) (grpc.UnaryServerInterceptor, error) {
+	var backend ratelimit.Backend
+	switch rateLimitConfig.Backend {
+	case config.RateLimitMemory:
+		backend = ratelimit.NewMemoryBackend()
+	case config.RateLimitRedis:
+		client := redis.NewClient(&redis.Options{
+			Addr:     rateLimitConfig.Redis.Addr,
+			Password: rateLimitConfig.Redis.Password,
+			DB:       rateLimitConfig.Redis.DB,
+		})
+		backend = ratelimit.NewRedisBackend(client, "ratelimit:")
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend %q", rateLimitConfig.Backend)
+	}
+
+	rules := ratelimit.Rules{
+		Default: ratelimit.Limit(rateLimitConfig.Default),
+		Methods: make(map[string]ratelimit.Limit),
+	}
+	for name, limit := range rateLimitConfig.Methods {
+		method, err := fullMethodName(name)
+		if err != nil {
+			return nil, err
+		}
+		rules.Methods[method] = ratelimit.Limit(limit)
+	}
+
+	// Only the signature is checked, a call with the token of an ended session is refused later.
+	identify := func(ctx context.Context) string {
+		claims, err := s.verifyAccessToken(ctx)
+		if err != nil {
+			return ""
+		}
+		return claims.Subject
+	}
+	onError := func(err error) {
+		log.Printf("Rate limiting failed, letting the call through: %s", err)
+	}
+	return ratelimit.UnaryServerInterceptor(backend, rules, identify, onError), nil
+}
+
+// fullMethodName turns the name of a method of UserService, like "CreateUser", into the full name
+// gRPC gives it, like "/userproto.UserService/CreateUser".
+func fullMethodName(name string) (string, error) {
+	for _, method := range userproto.UserService_ServiceDesc.Methods {
+		if method.MethodName == name {
+			return "/" + userproto.UserService_ServiceDesc.ServiceName + "/" + name, nil
+		}
+	}
+	return "", fmt.Errorf("rate limit for unknown method %q", name)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+)
+
+// recoveryCodeAlphabet leaves out characters that are easily mistaken for each other, like 0 and o
+// or 1 and l, as recovery codes are often written down on paper.
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// recoveryCodeLength is the number of characters of a recovery code, about 50 bits of randomness.
+const recoveryCodeLength = 10
+
+// newRecoveryCodes returns n new recovery codes of the user, formatted like "abcde-fghjk", and their
+// hashes. The codes are random enough that a keyed digest protects them, they do not need a slow
+// password hash that would make checking one costly.
+func (s *userService) newRecoveryCodes(user model.User, n int) ([]string, []string, error) {
+	if s.secrets == nil {
+		return nil, nil, fmt.Errorf("no encryption key to hash recovery codes with")
+	}
+	recoveryCodes := make([]string, 0, n)
+	hashes := make([]string, 0, n)
+	alphabetSize := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	for i := 0; i < n; i++ {
+		code := make([]byte, recoveryCodeLength)
+		for j := range code {
+			index, err := rand.Int(rand.Reader, alphabetSize)
+			if err != nil {
+				return nil, nil, fmt.Errorf("generate recovery code: %w", err)
+			}
+			code[j] = recoveryCodeAlphabet[index.Int64()]
+		}
+		half := recoveryCodeLength / 2
+		recoveryCodes = append(recoveryCodes, string(code[:half])+"-"+string(code[half:]))
+		hashes = append(hashes, s.secrets.Digest(code, []byte(user.Id.Hex())))
+	}
+	return recoveryCodes, hashes, nil
+}
+
+// normalizeRecoveryCode undoes the formatting of a recovery code, and whatever users add when typing
+// it in.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
+
+// issueRecoveryCodes gives the user a new set of recovery codes, replacing the previous ones.
+func (s *userService) issueRecoveryCodes(ctx context.Context, user model.User) ([]string, error) {
+	recoveryCodes, hashes, err := s.newRecoveryCodes(user, s.mfa.RecoveryCodes)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not create recovery codes: %s", err),
+		)
+	}
+	if err := s.users.SetRecoveryCodes(ctx, user.Id, hashes); err != nil {
+		return nil, storeError(err, user)
+	}
+	return recoveryCodes, nil
+}
+
+// useRecoveryCode checks code against the unused recovery codes of the user and uses it up. It
+// reports false when the code is wrong or was used before.
+func (s *userService) useRecoveryCode(ctx context.Context, user model.User, code string) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeLength || s.secrets == nil {
+		return false, nil
+	}
+	for _, hash := range user.RecoveryCodes {
+		if s.secrets.DigestMatches(hash, []byte(code), []byte(user.Id.Hex())) {
+			// A code used by another login in the meantime is gone from the store.
+			return s.users.UseRecoveryCode(ctx, user.Id, hash)
+		}
+	}
+	return false, nil
+}
+
+// Responsible for replacing the recovery codes of the calling user. Recovery codes can stand in for
+// the second factor, so a stolen access token alone must not be enough to get new ones: the session
+// has to be a recent login.
+func (s *userService) RegenerateRecoveryCodes(ctx context.Context, request *userproto.RegenerateRecoveryCodesRequest) (*userproto.RegenerateRecoveryCodesResponse, error) {
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.userFromSubject(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if !user.HasTOTP() {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is not enabled")
+	}
+
+	if err := s.requireFreshLogin(ctx, claims, "regenerate recovery codes"); err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, err := s.issueRecoveryCodes(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return &userproto.RegenerateRecoveryCodesResponse{RecoveryCodes: recoveryCodes}, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"rahulchhabra.io/encryption"
+	"rahulchhabra.io/store"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	key := make([]byte, encryption.KeyLength)
+	rand.Read(key)
+	oldKeyring, err := encryption.NewKeyring("1", map[string][]byte{"1": key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, store.NewMemoryUserStore())
+	s.secrets = oldKeyring
+	ada := createTestUser(t, s, "ada")
+	bob := createTestUser(t, s, "bob")
+	_, recoveryCodes := enrollTOTP(t, s, ada)
+	ctx := context.Background()
+
+	// Codes made with a retired key keep working while the key stays configured.
+	newKey := make([]byte, encryption.KeyLength)
+	rand.Read(newKey)
+	if s.secrets, err = encryption.NewKeyring("2", map[string][]byte{"1": key, "2": newKey}); err != nil {
+		t.Fatal(err)
+	}
+	ada, _ = s.users.GetByID(ctx, ada.Id)
+	if used, err := s.useRecoveryCode(ctx, ada, recoveryCodes[0]); err != nil || !used {
+		t.Errorf("useRecoveryCode after a key rotation: got %v, %v, want true, nil", used, err)
+	}
+
+	ada, _ = s.users.GetByID(ctx, ada.Id)
+	for _, test := range []struct {
+		name string
+		code string
+	}{
+		{"a used code", recoveryCodes[0]},
+		{"a wrong code", "abcde-fghjk"},
+		{"a code of the wrong length", "abcde"},
+	} {
+		if used, err := s.useRecoveryCode(ctx, ada, test.code); err != nil || used {
+			t.Errorf("useRecoveryCode with %s: got %v, %v, want false, nil", test.name, used, err)
+		}
+	}
+
+	// The hashes are bound to the user, copying them to another account does not make its codes work.
+	if err := s.users.SetRecoveryCodes(ctx, bob.Id, ada.RecoveryCodes); err != nil {
+		t.Fatal(err)
+	}
+	bob, _ = s.users.GetByID(ctx, bob.Id)
+	if used, err := s.useRecoveryCode(ctx, bob, recoveryCodes[1]); err != nil || used {
+		t.Errorf("useRecoveryCode with the code of another user: got %v, %v, want false, nil", used, err)
+	}
+	// Typed in upper case with a space instead of the dash, the code still works for its owner.
+	typed := strings.ToUpper(strings.Replace(recoveryCodes[1], "-", " ", 1))
+	if used, err := s.useRecoveryCode(ctx, ada, typed); err != nil || !used {
+		t.Errorf("useRecoveryCode(%q): got %v, %v, want true, nil", typed, used, err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/mail"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+// passwordReset is the purpose of the tokens in password reset links.
+const passwordReset = "password-reset"
+
+// passwordResetSent answers every RequestPasswordReset, whether or not an email was sent.
+const passwordResetSent = "If this email address belongs to an account, a link to reset the password has been sent"
+
+// passwordFingerprint identifies the password hash a reset token was issued for. Once the password
+// changes, through the token or otherwise, the token no longer matches and can not be used again.
+func passwordFingerprint(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendPasswordResetEmail sends the user a link to choose a new password.
+func (s *userService) sendPasswordResetEmail(user model.User) {
+	if user.Email == "" {
+		return
+	}
+	ttl := s.email.PasswordReset.TTL
+	token, err := s.sealToken(passwordReset, emailToken{
+		UserId:   user.Id.Hex(),
+		Email:    user.Email,
+		Expires:  time.Now().Add(ttl).UTC(),
+		Password: passwordFingerprint(user.Password),
+	})
+	if err != nil {
+		log.Printf("Failed to create password reset link of user %s: %s", user.Id.Hex(), err)
+		return
+	}
+	s.sendEmail(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("%s\n\nChoose a new password with this link, within %s. It can only be used once:\n\n%s\n\nIf you did not ask to reset your password, you can ignore this email, your password stays the same.\n",
+			greeting(user), readableDuration(ttl), emailLink(s.email.PasswordReset.URL, token)),
+	})
+}
+
+// sendPasswordChangedEmail tells the user their password was reset, so they notice when it was not
+// them.
+func (s *userService) sendPasswordChangedEmail(user model.User) {
+	if user.Email == "" {
+		return
+	}
+	s.sendEmail(mail.Message{
+		To:      user.Email,
+		Subject: "Your password was changed",
+		Body: fmt.Sprintf("%s\n\nThe password of your account was just reset, and every device logged in to it was logged out.\n\nIf you did not do this, reset your password again right away and check the email address and two-factor settings of your account.\n",
+			greeting(user)),
+	})
+}
+
+// Responsible for emailing a link to reset a forgotten password. The answer is the same for every
+// address, so it does not tell which accounts exist.
+func (s *userService) RequestPasswordReset(ctx context.Context, request *userproto.RequestPasswordResetRequest) (*userproto.RequestPasswordResetResponse, error) {
+	if request.GetEmail() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Field \"email\" is required")
+	}
+	user, err := s.users.GetByEmail(ctx, request.GetEmail())
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not look up user: %s", err),
+		)
+	}
+	if err == nil {
+		s.sendPasswordResetEmail(user)
+	}
+	return &userproto.RequestPasswordResetResponse{Message: passwordResetSent}, nil
+}
+
+// Responsible for setting a new password with the token from a reset link. Every session of the
+// user is revoked, so whoever knew the old password is logged out.
+func (s *userService) ResetPassword(ctx context.Context, request *userproto.ResetPasswordRequest) (*userproto.ResetPasswordResponse, error) {
+	invalid := status.Errorf(codes.InvalidArgument, "Reset link is invalid or expired, ask for a new one")
+	token, err := s.openEmailToken(passwordReset, request.GetToken())
+	if err != nil {
+		return nil, invalid
+	}
+	oid, err := primitive.ObjectIDFromHex(token.UserId)
+	if err != nil {
+		return nil, invalid
+	}
+	user, err := s.users.GetByID(ctx, oid)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not load user: %s", err),
+		)
+	}
+	// A link sent before the email address or the password changed no longer resets anything.
+	if !strings.EqualFold(user.Email, token.Email) ||
+		subtle.ConstantTimeCompare([]byte(passwordFingerprint(user.Password)), []byte(token.Password)) != 1 {
+		return nil, invalid
+	}
+
+	newPassword := request.GetNewPassword()
+	if newPassword == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Field \"newPassword\" is required")
+	}
+	if err := s.checkPassword(newPassword, user.Email, user.Username, user.FirstName, user.LastName); err != nil {
+		return nil, err
+	}
+	hash, err := s.passwords.Hash(newPassword)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not hash password: %s", err),
+		)
+	}
+	// Two requests with the same token can both get here, only the first one replaces the hash.
+	err = s.users.ReplacePassword(ctx, oid, user.Password, hash)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not reset password: %s", err),
+		)
+	}
+
+	// The link reached the inbox of the user, which proves the address as much as a verification
+	// link would, and a user who got their password back should not stay locked out.
+	s.forgetFailedLogins(ctx, user)
+	if !user.EmailVerified {
+		if err := s.users.MarkEmailVerified(ctx, oid, user.Email); err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Printf("Failed to mark email of user %s verified: %s", oid.Hex(), err)
+		}
+	}
+	revoked, err := s.sessions.RevokeSessions(ctx, oid)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not revoke sessions: %s", err),
+		)
+	}
+	s.sendPasswordChangedEmail(user)
+	return &userproto.ResetPasswordResponse{RevokedSessions: revoked}, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+	"rahulchhabra.io/token"
+)
+
+// tokenPair is what a successful login or refresh hands back to the client.
+type tokenPair struct {
+	accessToken           string
+	expiresAt             time.Time
+	refreshToken          string
+	refreshTokenExpiresAt time.Time
+}
+
+// startSession records a new login session for the user and issues its first token pair.
+func (s *userService) startSession(ctx context.Context, user model.User) (*tokenPair, error) {
+	now := time.Now().UTC()
+	session := model.Session{
+		Id:         primitive.NewObjectID(),
+		UserId:     user.Id,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(s.refreshTTL),
+		ClientIP:   clientIP(ctx),
+		UserAgent:  userAgent(ctx),
+	}
+	if err := s.sessions.CreateSession(ctx, session); err != nil {
+		return nil, fmt.Errorf("store session: %w", err)
+	}
+	return s.issueTokens(ctx, user, session.Id)
+}
+
+// issueTokens creates an access token and a new refresh token in the given session for the user.
+func (s *userService) issueTokens(ctx context.Context, user model.User, sessionId primitive.ObjectID) (*tokenPair, error) {
+	accessToken, expiresAt, err := s.tokens.Issue(user.Id.Hex(), user.Email, user.Username, sessionId.Hex(), s.scopesOf(user.Id))
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshTokenHash, err := token.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	record := model.RefreshToken{
+		Id:        primitive.NewObjectID(),
+		UserId:    user.Id,
+		SessionId: sessionId,
+		TokenHash: refreshTokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.refreshTTL),
+	}
+	if err := s.sessions.CreateRefreshToken(ctx, record); err != nil {
+		return nil, fmt.Errorf("store refresh token: %w", err)
+	}
+	return &tokenPair{
+		accessToken:           accessToken,
+		expiresAt:             expiresAt,
+		refreshToken:          refreshToken,
+		refreshTokenExpiresAt: record.ExpiresAt,
+	}, nil
+}
+
+// Responsible for exchanging a refresh token for a new access and refresh token.
+func (s *userService) RefreshSession(ctx context.Context, request *userproto.RefreshSessionRequest) (*userproto.RefreshSessionResponse, error) {
+	tokenHash := token.HashRefreshToken(request.GetRefreshToken())
+	now := time.Now().UTC()
+
+	// Mark the token as used. A token can only be rotated once, even when two requests race with it.
+	current, err := s.sessions.RotateRefreshToken(ctx, tokenHash, now)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, s.rejectRefreshToken(ctx, tokenHash)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not rotate refresh token: %s", err),
+		)
+	}
+
+	// Record the use on the session, which must not have been revoked in the meantime.
+	err = s.sessions.TouchSession(ctx, current.SessionId, now, now.Add(s.refreshTTL), clientIP(ctx), userAgent(ctx))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid refresh token")
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not update session: %s", err),
+		)
+	}
+
+	// Load the user again so the new access token carries up to date claims.
+	user, err := s.users.GetByID(ctx, current.UserId)
+	if errors.Is(err, store.ErrNotFound) {
+		if _, err := s.sessions.RevokeSessions(ctx, current.UserId, current.SessionId); err != nil {
+			log.Printf("Failed to revoke session %s: %s", current.SessionId.Hex(), err)
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid refresh token")
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not load user: %s", err),
+		)
+	}
+
+	tokens, err := s.issueTokens(ctx, user, current.SessionId)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not issue tokens: %s", err),
+		)
+	}
+	return &userproto.RefreshSessionResponse{
+		AccessToken:           tokens.accessToken,
+		TokenType:             "Bearer",
+		ExpiresAt:             timestamppb.New(tokens.expiresAt),
+		RefreshToken:          tokens.refreshToken,
+		RefreshTokenExpiresAt: timestamppb.New(tokens.refreshTokenExpiresAt),
+	}, nil
+}
+
+// rejectRefreshToken works out why a refresh token could not be rotated. A token that was already
+// rotated is being replayed, which means it has leaked: the whole session gets revoked so neither the
+// attacker nor the legitimate client can keep using it.
+func (s *userService) rejectRefreshToken(ctx context.Context, tokenHash string) error {
+	presented, err := s.sessions.GetRefreshToken(ctx, tokenHash)
+	if errors.Is(err, store.ErrNotFound) {
+		return status.Errorf(codes.Unauthenticated, "Invalid refresh token")
+	}
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not look up refresh token: %s", err),
+		)
+	}
+	if presented.RotatedAt != nil && presented.RevokedAt == nil {
+		log.Printf("Refresh token reuse detected for user %s, revoking session %s", presented.UserId.Hex(), presented.SessionId.Hex())
+		if _, err := s.sessions.RevokeSessions(ctx, presented.UserId, presented.SessionId); err != nil {
+			return status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Could not revoke session: %s", err),
+			)
+		}
+	}
+	return status.Errorf(codes.Unauthenticated, "Invalid refresh token")
+}
+
+// Responsible for revoking one session of the calling user, by default the current one.
+func (s *userService) Logout(ctx context.Context, request *userproto.LogoutRequest) (*userproto.LogoutResponse, error) {
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userId, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid access token")
+	}
+	sessionHex := request.GetSessionId()
+	if sessionHex == "" {
+		sessionHex = claims.SessionId
+	}
+	sessionId, err := primitive.ObjectIDFromHex(sessionHex)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Invalid session id %s", sessionHex),
+		)
+	}
+
+	// Revoking by user id as well makes sure users can only revoke their own sessions.
+	if _, err := s.sessions.RevokeSessions(ctx, userId, sessionId); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not revoke session: %s", err),
+		)
+	}
+	return &userproto.LogoutResponse{}, nil
+}
+
+// Responsible for revoking every session of the calling user.
+func (s *userService) LogoutAll(ctx context.Context, request *userproto.LogoutAllRequest) (*userproto.LogoutAllResponse, error) {
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userId, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid access token")
+	}
+	revoked, err := s.sessions.RevokeSessions(ctx, userId)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not revoke sessions: %s", err),
+		)
+	}
+	return &userproto.LogoutAllResponse{RevokedSessions: revoked}, nil
+}
+
+// Responsible for listing the active sessions of the calling user.
+func (s *userService) ListSessions(ctx context.Context, request *userproto.ListSessionsRequest) (*userproto.ListSessionsResponse, error) {
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userId, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid access token")
+	}
+
+	sessions, err := s.sessions.ListActiveSessions(ctx, userId, time.Now().UTC())
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not list sessions: %s", err),
+		)
+	}
+
+	response := &userproto.ListSessionsResponse{}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, &userproto.Session{
+			Id:         session.Id.Hex(),
+			CreatedAt:  timestamppb.New(session.CreatedAt),
+			LastUsedAt: timestamppb.New(session.LastUsedAt),
+			ExpiresAt:  timestamppb.New(session.ExpiresAt),
+			ClientIp:   session.ClientIP,
+			UserAgent:  session.UserAgent,
+			Current:    session.Id.Hex() == claims.SessionId,
+		})
+	}
+	return response, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+func TestEndedSessionsRefuseAccessTokens(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		end  func(t *testing.T, s *userService, ctx context.Context) error
+	}{
+		{"Logout", func(t *testing.T, s *userService, ctx context.Context) error {
+			_, err := s.Logout(ctx, &userproto.LogoutRequest{})
+			return err
+		}},
+		{"LogoutAll", func(t *testing.T, s *userService, ctx context.Context) error {
+			_, err := s.LogoutAll(ctx, &userproto.LogoutAllRequest{})
+			return err
+		}},
+		{"ResetPassword", func(t *testing.T, s *userService, ctx context.Context) error {
+			user, err := s.users.GetByUsername(context.Background(), "alice")
+			if err != nil {
+				t.Fatalf("GetByUsername: %s", err)
+			}
+			resetToken, err := s.sealToken(passwordReset, emailToken{
+				UserId:   user.Id.Hex(),
+				Email:    user.Email,
+				Expires:  time.Now().Add(time.Hour).UTC(),
+				Password: passwordFingerprint(user.Password),
+			})
+			if err != nil {
+				t.Fatalf("sealToken: %s", err)
+			}
+			_, err = s.ResetPassword(context.Background(), &userproto.ResetPasswordRequest{Token: resetToken, NewPassword: "quince harbor lantern 77"})
+			return err
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestService(t, store.NewMemoryUserStore())
+			alice := createTestUser(t, s, "alice")
+			ctx := loggedIn(t, s, alice)
+			getAlice := &userproto.GetUserRequest{Lookup: &userproto.GetUserRequest_Id{Id: alice.Id.Hex()}}
+			if _, err := s.GetUser(ctx, getAlice); err != nil {
+				t.Fatalf("GetUser before %s: %s", test.name, err)
+			}
+
+			if err := test.end(t, s, ctx); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			// The access token is still validly signed and unexpired, but its session has ended.
+			if _, err := s.GetUser(ctx, getAlice); status.Code(err) != codes.Unauthenticated {
+				t.Errorf("GetUser after %s: got %v, want Unauthenticated", test.name, err)
+			}
+			if _, err := s.ListSessions(ctx, &userproto.ListSessionsRequest{}); status.Code(err) != codes.Unauthenticated {
+				t.Errorf("ListSessions after %s: got %v, want Unauthenticated", test.name, err)
+			}
+			if _, err := s.GetUser(loggedIn(t, s, alice), getAlice); err != nil {
+				t.Errorf("GetUser in a new session after %s: %s", test.name, err)
+			}
+		})
+	}
+}
+
+func TestLogoutKeepsOtherSessions(t *testing.T) {
+	s := newTestService(t, store.NewMemoryUserStore())
+	alice := createTestUser(t, s, "alice")
+	phone, laptop := loggedIn(t, s, alice), loggedIn(t, s, alice)
+	if _, err := s.Logout(phone, &userproto.LogoutRequest{}); err != nil {
+		t.Fatalf("Logout: %s", err)
+	}
+	if _, err := s.ListSessions(laptop, &userproto.ListSessionsRequest{}); err != nil {
+		t.Errorf("ListSessions in the other session: %s", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/config"
+	"rahulchhabra.io/model"
+	"rahulchhabra.io/store"
+)
+
+// stores are where the service keeps its data.
+type stores struct {
+	users       store.UserStore
+	sessions    store.SessionStore
+	credentials store.CredentialStore
+}
+
+// openStores creates the user, session and passkey stores of the configured backend.
+func openStores(ctx context.Context, storeConfig config.StoreConfig) (stores, error) {
+	switch storeConfig.Backend {
+	case config.StoreMemory:
+		return stores{
+			users:       store.NewMemoryUserStore(),
+			sessions:    store.NewMemorySessionStore(),
+			credentials: store.NewMemoryCredentialStore(),
+		}, nil
+	case config.StoreMongo:
+		// Connect to the MongoDB database
+		mongoConfig := storeConfig.Mongo
+		db, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoConfig.URI))
+		if err != nil {
+			return stores{}, fmt.Errorf("connect to MongoDB: %w", err)
+		}
+		database := db.Database(mongoConfig.Database)
+		users, err := store.NewMongoUserStore(ctx, database.Collection(mongoConfig.UsersCollection))
+		if err != nil {
+			return stores{}, fmt.Errorf("create user indexes: %w", err)
+		}
+		sessions, err := store.NewMongoSessionStore(ctx,
+			database.Collection(mongoConfig.SessionsCollection),
+			database.Collection(mongoConfig.RefreshTokensCollection),
+			database.Collection(mongoConfig.IPFailuresCollection),
+			database.Collection(mongoConfig.UsedChallengesCollection),
+		)
+		if err != nil {
+			return stores{}, fmt.Errorf("create session indexes: %w", err)
+		}
+		credentials, err := store.NewMongoCredentialStore(ctx, database.Collection(mongoConfig.CredentialsCollection))
+		if err != nil {
+			return stores{}, fmt.Errorf("create credential indexes: %w", err)
+		}
+		return stores{users: users, sessions: sessions, credentials: credentials}, nil
+	case config.StoreSQLite, config.StorePostgres:
+		dialect := store.SQLite
+		if storeConfig.Backend == config.StorePostgres {
+			dialect = store.Postgres
+		}
+		db, err := store.OpenSQL(ctx, dialect, storeConfig.DSN)
+		if err != nil {
+			return stores{}, fmt.Errorf("open %s database: %w", storeConfig.Backend, err)
+		}
+		return stores{
+			users:       store.NewSQLUserStore(db, dialect),
+			sessions:    store.NewSQLSessionStore(db, dialect),
+			credentials: store.NewSQLCredentialStore(db, dialect),
+		}, nil
+	}
+	return stores{}, fmt.Errorf("unknown store backend %q", storeConfig.Backend)
+}
+
+// storeError converts an error from writing user to the store into a gRPC status. Duplicates
+// become AlreadyExists with a field violation naming the field that collided.
+func storeError(err error, user model.User) error {
+	if errors.Is(err, store.ErrNotFound) {
+		return status.Errorf(codes.NotFound, "User not found")
+	}
+	var duplicate *store.DuplicateError
+	if !errors.As(err, &duplicate) {
+		return status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Internal error: %s", err),
+		)
+	}
+
+	value := user.Email
+	if duplicate.Field == "username" {
+		value = user.Username
+	}
+	st := status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("User with %s %s already exists", duplicate.Field, value),
+	)
+	detailed, detailsErr := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{
+				Field:       "user." + duplicate.Field,
+				Description: fmt.Sprintf("A user with this %s already exists", duplicate.Field),
+			},
+		},
+	})
+	if detailsErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
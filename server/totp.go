@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+	"rahulchhabra.io/totp"
+)
+
+// challengeAudienceSuffix turns the audience of access tokens into the audience of second factor
+// challenges, so a challenge is never accepted as an access token.
+const challengeAudienceSuffix = "/second-factor"
+
+// secondFactorLogin is the purpose under which the used challenges of second factor logins are kept.
+const secondFactorLogin = "second-factor-login"
+
+// useChallenge marks the single use challenge of purpose as used until expiresAt, and reports
+// whether it was unused. The session store remembers it, so no replica of the service accepts it
+// a second time.
+func (s *userService) useChallenge(ctx context.Context, purpose string, challenge string, expiresAt time.Time, now time.Time) (bool, error) {
+	return s.sessions.UseChallenge(ctx, purpose+":"+challenge, expiresAt, now)
+}
+
+// secondFactorChallenge answers a login with the right password by a user who has to give a
+// second factor as well.
+func (s *userService) secondFactorChallenge(user model.User) (*userproto.AuthenticateUserResponse, error) {
+	challenge, expiresAt, err := s.challenges.Issue(user.Id.Hex(), "", "", "", nil)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not issue challenge: %s", err),
+		)
+	}
+	return &userproto.AuthenticateUserResponse{
+		Message:              "Second factor required",
+		SecondFactorRequired: true,
+		ChallengeToken:       challenge,
+		ChallengeExpiresAt:   timestamppb.New(expiresAt),
+	}, nil
+}
+
+// Responsible for finishing a login with the TOTP code of the user. A challenge can be tried again
+// after a wrong code, but logs the user in only once.
+func (s *userService) VerifySecondFactor(ctx context.Context, request *userproto.VerifySecondFactorRequest) (*userproto.VerifySecondFactorResponse, error) {
+	now := time.Now().UTC()
+	ip := clientIP(ctx)
+	if retryAfter := s.ips.retryAfter(ctx, ip, now); retryAfter > 0 {
+		return nil, tooManyAttempts(retryAfter)
+	}
+
+	claims, err := s.challengeVerifier.Verify(request.GetChallengeToken())
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid or expired challenge, log in again")
+	}
+	user, err := s.userFromSubject(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user.IsLocked(now) {
+		return nil, tooManyAttempts(user.LockedUntil.Sub(now))
+	}
+	if !user.HasTOTP() {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is not enabled")
+	}
+
+	// Wrong codes count as failed logins, so guessing codes locks the account like guessing passwords.
+	var recoveryCodesLeft int32
+	if recoveryCode := request.GetRecoveryCode(); recoveryCode != "" {
+		used, err := s.useRecoveryCode(ctx, user, recoveryCode)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Could not use recovery code: %s", err),
+			)
+		}
+		if !used {
+			s.ips.fail(ctx, ip, now)
+			s.recordFailedLogin(ctx, user, now)
+			return nil, status.Errorf(codes.Unauthenticated, "Invalid recovery code")
+		}
+		recoveryCodesLeft = int32(len(user.RecoveryCodes) - 1)
+		log.Printf("User %s logged in with a recovery code, %d left", user.Id.Hex(), recoveryCodesLeft)
+	} else {
+		if err := s.checkTOTPCode(ctx, user, request.GetCode(), now); err != nil {
+			if status.Code(err) == codes.Unauthenticated {
+				s.ips.fail(ctx, ip, now)
+				s.recordFailedLogin(ctx, user, now)
+			}
+			return nil, err
+		}
+	}
+
+	// The code is used up either way, but a stolen challenge must not start a second session.
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid or expired challenge, log in again")
+	}
+	unused, err := s.useChallenge(ctx, secondFactorLogin, claims.ID, claims.ExpiresAt.Time, now)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not use challenge: %s", err),
+		)
+	}
+	if !unused {
+		return nil, status.Errorf(codes.Unauthenticated, "Challenge was already used, log in again")
+	}
+	s.forgetFailedLogins(ctx, user)
+	tokens, err := s.startSession(ctx, user)
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not issue tokens: %s", err),
+		)
+	}
+	return &userproto.VerifySecondFactorResponse{
+		AccessToken:           tokens.accessToken,
+		TokenType:             "Bearer",
+		ExpiresAt:             timestamppb.New(tokens.expiresAt),
+		RefreshToken:          tokens.refreshToken,
+		RefreshTokenExpiresAt: timestamppb.New(tokens.refreshTokenExpiresAt),
+		RecoveryCodesLeft:     recoveryCodesLeft,
+	}, nil
+}
+
+// checkTOTPCode checks a code from the authenticator of the user and makes sure it can not be used
+// again.
+func (s *userService) checkTOTPCode(ctx context.Context, user model.User, code string, now time.Time) error {
+	secret, err := s.openTOTPSecret(user, user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, code, now, s.mfa.TOTPSkew)
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "Invalid code")
+	}
+	fresh, err := s.users.UseTOTPStep(ctx, user.Id, step)
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not record code: %s", err),
+		)
+	}
+	if !fresh {
+		return status.Errorf(codes.Unauthenticated, "Code was already used, wait for the next one")
+	}
+	return nil
+}
+
+// Responsible for starting the enrollment of a TOTP authenticator for the calling user. The secret
+// is kept aside until ConfirmTotpEnrollment proves the authenticator was set up with it.
+func (s *userService) BeginTotpEnrollment(ctx context.Context, request *userproto.BeginTotpEnrollmentRequest) (*userproto.BeginTotpEnrollmentResponse, error) {
+	if s.secrets == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is not configured")
+	}
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.userFromSubject(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user.HasTOTP() {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is already enabled")
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not generate secret: %s", err),
+		)
+	}
+	sealed, err := s.secrets.Seal(secret, []byte(user.Id.Hex()))
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not encrypt secret: %s", err),
+		)
+	}
+	if err := s.users.SetPendingTOTP(ctx, user.Id, sealed); err != nil {
+		return nil, storeError(err, user)
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.Username
+	}
+	return &userproto.BeginTotpEnrollmentResponse{
+		Secret: totp.EncodeSecret(secret),
+		Uri:    totp.URI(s.mfa.Issuer, account, secret),
+	}, nil
+}
+
+// Responsible for turning on TOTP for the calling user once a code shows the authenticator works.
+func (s *userService) ConfirmTotpEnrollment(ctx context.Context, request *userproto.ConfirmTotpEnrollmentRequest) (*userproto.ConfirmTotpEnrollmentResponse, error) {
+	if s.secrets == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is not configured")
+	}
+	claims, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// A stolen access token must not be enough to put a second factor of the thief on the account.
+	if err := s.requireFreshLogin(ctx, claims, "turn on two-factor authentication"); err != nil {
+		return nil, err
+	}
+	user, err := s.userFromSubject(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPPendingSecret == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "No TOTP enrollment to confirm, call BeginTotpEnrollment first")
+	}
+
+	secret, err := s.openTOTPSecret(user, user.TOTPPendingSecret)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totp.Validate(secret, request.GetCode(), time.Now(), s.mfa.TOTPSkew)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid code, check the clock of the authenticator")
+	}
+	err = s.users.EnableTOTP(ctx, user.Id, user.TOTPPendingSecret, step)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, status.Errorf(codes.Aborted, "The enrollment was restarted, confirm the new one")
+	}
+	if err != nil {
+		return nil, storeError(err, user)
+	}
+
+	// Recovery codes get the user back in when the authenticator is lost.
+	recoveryCodes, err := s.issueRecoveryCodes(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err = s.userFromSubject(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	return &userproto.ConfirmTotpEnrollmentResponse{
+		User:          userToProto(user),
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+// openTOTPSecret decrypts a TOTP secret of the user.
+func (s *userService) openTOTPSecret(user model.User, sealed string) ([]byte, error) {
+	if s.secrets == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is not configured")
+	}
+	secret, err := s.secrets.Open(sealed, []byte(user.Id.Hex()))
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not decrypt TOTP secret: %s", err),
+		)
+	}
+	return secret, nil
+}
+
+// userFromSubject loads the user a verified token was issued to.
+func (s *userService) userFromSubject(ctx context.Context, subject string) (model.User, error) {
+	oid, err := primitive.ObjectIDFromHex(subject)
+	if err != nil {
+		return model.User{}, status.Errorf(codes.Unauthenticated, "Invalid token subject")
+	}
+	user, err := s.users.GetByID(ctx, oid)
+	if errors.Is(err, store.ErrNotFound) {
+		return model.User{}, status.Errorf(codes.Unauthenticated, "User no longer exists")
+	}
+	if err != nil {
+		return model.User{}, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not load user: %s", err),
+		)
+	}
+	return user, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"rahulchhabra.io/model"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+	"rahulchhabra.io/totp"
+)
+
+// enrollTOTP turns on TOTP for the user, confirming it with the code of the previous time step so
+// the codes of the current and the next one are left for logins. It returns the secret and the
+// recovery codes.
+func enrollTOTP(t *testing.T, s *userService, user model.User) ([]byte, []string) {
+	t.Helper()
+	ctx := loggedIn(t, s, user)
+	if _, err := s.BeginTotpEnrollment(ctx, &userproto.BeginTotpEnrollmentRequest{}); err != nil {
+		t.Fatalf("BeginTotpEnrollment: %s", err)
+	}
+	user, err := s.users.GetByID(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := s.openTOTPSecret(user, user.TOTPPendingSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := s.ConfirmTotpEnrollment(ctx, &userproto.ConfirmTotpEnrollmentRequest{
+		Code: totp.Code(secret, totp.Step(time.Now())-1),
+	})
+	if err != nil {
+		t.Fatalf("ConfirmTotpEnrollment: %s", err)
+	}
+	return secret, response.RecoveryCodes
+}
+
+// passwordChallenge logs in with the password of a user with TOTP and returns the challenge.
+func passwordChallenge(t *testing.T, s *userService, username string) string {
+	t.Helper()
+	response, err := s.AuthenticateUser(context.Background(), &userproto.AuthenticateUserRequest{Identifier: username, Password: testPassword})
+	if err != nil {
+		t.Fatalf("AuthenticateUser: %s", err)
+	}
+	if !response.SecondFactorRequired {
+		t.Fatal("AuthenticateUser did not ask for a second factor")
+	}
+	return response.ChallengeToken
+}
+
+func TestSecondFactorChallengeLogsInOnce(t *testing.T) {
+	s := newTestService(t, store.NewMemoryUserStore())
+	user := createTestUser(t, s, "ada")
+	secret, recoveryCodes := enrollTOTP(t, s, user)
+	challenge := passwordChallenge(t, s, "ada")
+	ctx := context.Background()
+
+	// A mistyped code can be corrected without giving the password again.
+	_, err := s.VerifySecondFactor(ctx, &userproto.VerifySecondFactorRequest{ChallengeToken: challenge, Code: "000000"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("VerifySecondFactor with a wrong code: got %v, want Unauthenticated", err)
+	}
+	step := totp.Step(time.Now())
+	if _, err := s.VerifySecondFactor(ctx, &userproto.VerifySecondFactorRequest{ChallengeToken: challenge, Code: totp.Code(secret, step)}); err != nil {
+		t.Fatalf("VerifySecondFactor with the right code: %s", err)
+	}
+
+	// Once it logged the user in, the challenge is worthless, even with the next valid code.
+	for _, request := range []*userproto.VerifySecondFactorRequest{
+		{ChallengeToken: challenge, Code: totp.Code(secret, step+1)},
+		{ChallengeToken: challenge, RecoveryCode: recoveryCodes[0]},
+	} {
+		if _, err := s.VerifySecondFactor(ctx, request); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("VerifySecondFactor with a used challenge: got %v, want Unauthenticated", err)
+		}
+	}
+	// A new login is not affected.
+	request := &userproto.VerifySecondFactorRequest{ChallengeToken: passwordChallenge(t, s, "ada"), RecoveryCode: recoveryCodes[1]}
+	if _, err := s.VerifySecondFactor(ctx, request); err != nil {
+		t.Errorf("VerifySecondFactor with a new challenge: %s", err)
+	}
+}
+
+func TestConfirmTotpEnrollmentRequiresFreshLogin(t *testing.T) {
+	s := newTestService(t, store.NewMemoryUserStore())
+	user := createTestUser(t, s, "ada")
+	ctx := loggedIn(t, s, user)
+	if _, err := s.BeginTotpEnrollment(ctx, &userproto.BeginTotpEnrollmentRequest{}); err != nil {
+		t.Fatalf("BeginTotpEnrollment: %s", err)
+	}
+	user, err := s.users.GetByID(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := s.openTOTPSecret(user, user.TOTPPendingSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every login is too old when no age is fresh enough.
+	s.mfa.FreshLogin = 0
+	request := &userproto.ConfirmTotpEnrollmentRequest{Code: totp.Code(secret, totp.Step(time.Now()))}
+	if _, err := s.ConfirmTotpEnrollment(ctx, request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ConfirmTotpEnrollment with an old login: got %v, want PermissionDenied", err)
+	}
+	if user, _ := s.users.GetByID(ctx, user.Id); user.HasTOTP() {
+		t.Error("TOTP was turned on without a fresh login")
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"rahulchhabra.io/model"
+	"rahulchhabra.io/password"
+	userproto "rahulchhabra.io/proto/user"
+	"rahulchhabra.io/store"
+)
+
+// invalidCredentials is the only error a failed login gets, whatever the reason.
+const invalidCredentials = "Invalid username/email or password"
+
+// errNotYourAccount refuses users acting on an account other than their own.
+var errNotYourAccount = status.Errorf(codes.PermissionDenied, "You can only access your own account")
+
+// userByIdentifier finds the user a login identifier refers to. Usernames can not contain "@", so
+// anything with one is an email address.
+func (s *userService) userByIdentifier(ctx context.Context, identifier string) (model.User, error) {
+	if strings.Contains(identifier, "@") {
+		return s.users.GetByEmail(ctx, identifier)
+	}
+	return s.users.GetByUsername(ctx, identifier)
+}
+
+// validateUsername makes sure a username is set and can never be mistaken for an email address when
+// logging in.
+func validateUsername(username string) error {
+	if username == "" {
+		return status.Errorf(codes.InvalidArgument, "Field \"username\" is required")
+	}
+	if strings.Contains(username, "@") {
+		return status.Errorf(codes.InvalidArgument, "Username can not contain @")
+	}
+	return nil
+}
+
+// validateEmail makes sure an email address is set and is a plain address, like "ada@example.com",
+// that verification and password reset emails can be sent to.
+func validateEmail(email string) error {
+	if email == "" {
+		return status.Errorf(codes.InvalidArgument, "Field \"email\" is required")
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Invalid email address %q", email),
+		)
+	}
+	return nil
+}
+
+// userToProto converts a stored user into its API representation. The password hash never leaves the server.
+func userToProto(user model.User) *userproto.User {
+	var lockedUntil *timestamppb.Timestamp
+	if user.IsLocked(time.Now()) {
+		lockedUntil = timestamppb.New(*user.LockedUntil)
+	}
+	return &userproto.User{
+		Id:        user.Id.Hex(),
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Email:     user.Email,
+		Username:  user.Username,
+		Status:    statusToProto(user.Status),
+		CreatedAt: timestamppb.New(user.Id.Timestamp()),
+
+		LockedUntil: lockedUntil,
+		TotpEnabled: user.HasTOTP(),
+
+		EmailVerified: user.EmailVerified,
+	}
+}
+
+// statusToProto converts a stored account status into its API representation.
+func statusToProto(accountStatus string) userproto.UserStatus {
+	switch accountStatus {
+	case model.UserStatusActive, "":
+		return userproto.UserStatus_USER_STATUS_ACTIVE
+	case model.UserStatusDisabled:
+		return userproto.UserStatus_USER_STATUS_DISABLED
+	}
+	return userproto.UserStatus_USER_STATUS_UNSPECIFIED
+}
+
+// parseUserId converts the hex id of a user sent by a client into an ObjectID.
+func parseUserId(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Invalid user id %q", id),
+		)
+	}
+	return oid, nil
+}
+
+// checkPassword makes sure a new password follows the password policy and does not appear in a
+// known data breach. personalInfo holds the email, username and names of the user.
+func (s *userService) checkPassword(plaintext string, personalInfo ...string) error {
+	violations := s.policy.Check(plaintext, personalInfo...)
+	if s.breached != nil {
+		found, err := s.breached.Contains(plaintext)
+		if err != nil {
+			return status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Could not check password: %s", err),
+			)
+		}
+		if found {
+			violations = append(violations, password.Violation{
+				Rule:        "breached",
+				Description: "Password has appeared in a data breach, choose another one",
+			})
+		}
+	}
+	if len(violations) > 0 {
+		return passwordPolicyError(violations)
+	}
+	return nil
+}
+
+// passwordPolicyError converts the ways a password breaks the policy into an InvalidArgument status.
+// Every rule gets a field violation the UI can show, and the ErrorInfo lists the rules for clients
+// that want to word them differently.
+func passwordPolicyError(violations []password.Violation) error {
+	badRequest := &errdetails.BadRequest{}
+	rules := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       "password",
+			Description: violation.Description,
+		})
+		rules = append(rules, violation.Rule)
+	}
+	st := status.New(codes.InvalidArgument, "Password does not meet the password policy")
+	detailed, err := st.WithDetails(badRequest, &errdetails.ErrorInfo{
+		Reason:   "PASSWORD_POLICY",
+		Domain:   "user-service",
+		Metadata: map[string]string{"rules": strings.Join(rules, ",")},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// rehashPassword replaces the stored password hash of the user with one made by the current
+// algorithm. Failing to do so does not fail the login, the hash is upgraded at a later one.
+func (s *userService) rehashPassword(ctx context.Context, user model.User, plaintext string) {
+	hash, err := s.passwords.Hash(plaintext)
+	if err != nil {
+		log.Printf("Failed to rehash password of user %s: %s", user.Id.Hex(), err)
+		return
+	}
+	if _, err := s.users.Update(ctx, user.Id, store.UserUpdate{Password: &hash}); err != nil {
+		log.Printf("Failed to store rehashed password of user %s: %s", user.Id.Hex(), err)
+	}
+}
+
+// Responsible for reading a user by id, email or username. Users can read their own account, admins
+// any account.
+func (s *userService) GetUser(ctx context.Context, request *userproto.GetUserRequest) (*userproto.GetUserResponse, error) {
+	c, err := s.identifyCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Look the user up by whichever field was set.
+	var user model.User
+	switch lookup := request.GetLookup().(type) {
+	case *userproto.GetUserRequest_Id:
+		oid, parseErr := parseUserId(lookup.Id)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		user, err = s.users.GetByID(ctx, oid)
+	case *userproto.GetUserRequest_Email:
+		user, err = s.users.GetByEmail(ctx, lookup.Email)
+	case *userproto.GetUserRequest_Username:
+		user, err = s.users.GetByUsername(ctx, lookup.Username)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "One of id, email or username is required")
+	}
+	// Other users get the same answer whether or not the account exists, so GetUser does not tell
+	// them which email addresses are registered.
+	if !c.admin && (err != nil || !c.mayAccess(user.Id)) {
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, status.Errorf(
+				codes.Internal,
+				fmt.Sprintf("Could not load user: %s", err),
+			)
+		}
+		return nil, errNotYourAccount
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "User not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not load user: %s", err),
+		)
+	}
+	return &userproto.GetUserResponse{User: userToProto(user)}, nil
+}
+
+// Responsible for changing the fields of a user selected by the update mask. Users can change their
+// own account, admins any account.
+func (s *userService) UpdateUser(ctx context.Context, request *userproto.UpdateUserRequest) (*userproto.UpdateUserResponse, error) {
+	c, err := s.identifyCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userdata := request.GetUser()
+	oid, err := parseUserId(userdata.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if !c.mayAccess(oid) {
+		return nil, errNotYourAccount
+	}
+
+	paths := request.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		// Without a mask every field that was sent is updated.
+		for path, value := range map[string]string{
+			"firstName": userdata.GetFirstName(),
+			"lastName":  userdata.GetLastName(),
+			"email":     userdata.GetEmail(),
+			"username":  userdata.GetUsername(),
+		} {
+			if value != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Nothing to update")
+	}
+
+	// Translate the mask paths of the User message into the fields of model.User.
+	var update store.UserUpdate
+	for _, path := range paths {
+		switch path {
+		case "firstName":
+			update.FirstName = &userdata.FirstName
+		case "lastName":
+			update.LastName = &userdata.LastName
+		case "email":
+			if err := validateEmail(userdata.GetEmail()); err != nil {
+				return nil, err
+			}
+			update.Email = &userdata.Email
+		case "username":
+			if userdata.GetUsername() == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "Field \"username\" can not be empty")
+			}
+			if err := validateUsername(userdata.GetUsername()); err != nil {
+				return nil, err
+			}
+			update.Username = &userdata.Username
+		default:
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Field %q can not be updated", path),
+			)
+		}
+	}
+
+	// Password resets are sent to the email address, so changing it takes over the account. A stolen
+	// access token alone must not be enough for that.
+	if update.Email != nil && !c.admin {
+		if err := s.requireFreshLogin(ctx, c.claims, "change your email address"); err != nil {
+			return nil, err
+		}
+	}
+
+	// A new email address has to be verified again.
+	if update.Email != nil {
+		current, err := s.users.GetByID(ctx, oid)
+		if err != nil {
+			return nil, storeError(err, model.User{})
+		}
+		if !strings.EqualFold(current.Email, *update.Email) {
+			unverified := false
+			update.EmailVerified = &unverified
+		}
+	}
+
+	// The store refuses to take over the email or username of another account.
+	user, err := s.users.Update(ctx, oid, update)
+	if err != nil {
+		return nil, storeError(err, model.User{Email: userdata.GetEmail(), Username: userdata.GetUsername()})
+	}
+	if update.EmailVerified != nil {
+		s.sendVerificationEmail(user)
+	}
+	return &userproto.UpdateUserResponse{User: userToProto(user)}, nil
+}
+
+// Responsible for deleting a user and revoking all of their sessions. Users can delete their own
+// account, admins any account.
+func (s *userService) DeleteUser(ctx context.Context, request *userproto.DeleteUserRequest) (*userproto.DeleteUserResponse, error) {
+	c, err := s.identifyCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	oid, err := parseUserId(request.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if !c.mayAccess(oid) {
+		return nil, errNotYourAccount
+	}
+	if err := s.users.Delete(ctx, oid); err != nil {
+		return nil, storeError(err, model.User{})
+	}
+	if _, err := s.sessions.RevokeSessions(ctx, oid); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not revoke sessions: %s", err),
+		)
+	}
+	if err := s.credentials.DeleteCredentials(ctx, oid); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not delete passkeys: %s", err),
+		)
+	}
+	return &userproto.DeleteUserResponse{}, nil
+}
@@ -0,0 +1,613 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"rahulchhabra.io/model"
+)
+
+// MemoryUserStore is a thread-safe UserStore that keeps users in memory. It is meant for tests and
+// local development: everything is lost when the process exits.
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[primitive.ObjectID]model.User
+}
+
+// NewMemoryUserStore creates an empty MemoryUserStore.
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: map[primitive.ObjectID]model.User{}}
+}
+
+// conflict returns the DuplicateError user would cause, ignoring the stored user with the same id.
+// It must be called with s.mu held.
+func (s *MemoryUserStore) conflict(user model.User) error {
+	for id, existing := range s.users {
+		if id == user.Id {
+			continue
+		}
+		if user.Email != "" && strings.EqualFold(existing.Email, user.Email) {
+			return &DuplicateError{Field: "email"}
+		}
+		if user.Username != "" && strings.EqualFold(existing.Username, user.Username) {
+			return &DuplicateError{Field: "username"}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) Create(ctx context.Context, user *model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user.Id.IsZero() {
+		user.Id = primitive.NewObjectID()
+	}
+	if _, exists := s.users[user.Id]; exists {
+		return &DuplicateError{Field: "id"}
+	}
+	if err := s.conflict(*user); err != nil {
+		return err
+	}
+	s.users[user.Id] = *user
+	return nil
+}
+
+func (s *MemoryUserStore) GetByID(ctx context.Context, id primitive.ObjectID) (model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[id]
+	if !ok {
+		return model.User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *MemoryUserStore) GetByEmail(ctx context.Context, email string) (model.User, error) {
+	if email == "" {
+		return model.User{}, ErrNotFound
+	}
+	return s.find(func(user model.User) bool { return strings.EqualFold(user.Email, email) })
+}
+
+func (s *MemoryUserStore) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	if username == "" {
+		return model.User{}, ErrNotFound
+	}
+	return s.find(func(user model.User) bool { return strings.EqualFold(user.Username, username) })
+}
+
+// find returns the first user match accepts.
+func (s *MemoryUserStore) find(match func(model.User) bool) (model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if match(user) {
+			return user, nil
+		}
+	}
+	return model.User{}, ErrNotFound
+}
+
+func (s *MemoryUserStore) Update(ctx context.Context, id primitive.ObjectID, update UserUpdate) (model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return model.User{}, ErrNotFound
+	}
+	for target, value := range map[*string]*string{
+		&user.FirstName: update.FirstName,
+		&user.LastName:  update.LastName,
+		&user.Email:     update.Email,
+		&user.Username:  update.Username,
+		&user.Password:  update.Password,
+		&user.Status:    update.Status,
+	} {
+		if value != nil {
+			*target = *value
+		}
+	}
+	if update.EmailVerified != nil {
+		user.EmailVerified = *update.EmailVerified
+	}
+	if err := s.conflict(user); err != nil {
+		return model.User{}, err
+	}
+	s.users[id] = user
+	return user, nil
+}
+
+func (s *MemoryUserStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.users, id)
+	return nil
+}
+
+func (s *MemoryUserStore) List(ctx context.Context, options ListOptions) ([]model.User, error) {
+	s.mu.RLock()
+	var users []model.User
+	for _, user := range s.users {
+		if matches(user, options.Filter) {
+			users = append(users, user)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		less := bytes.Compare(users[i].Id[:], users[j].Id[:]) < 0
+		if options.Descending {
+			return !less
+		}
+		return less
+	})
+	if !options.After.IsZero() {
+		start := sort.Search(len(users), func(i int) bool {
+			cmp := bytes.Compare(users[i].Id[:], options.After[:])
+			if options.Descending {
+				return cmp < 0
+			}
+			return cmp > 0
+		})
+		users = users[start:]
+	}
+	if options.Limit > 0 && int64(len(users)) > options.Limit {
+		users = users[:options.Limit]
+	}
+	return users, nil
+}
+
+func (s *MemoryUserStore) Count(ctx context.Context, filter UserFilter) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var count int64
+	for _, user := range s.users {
+		if matches(user, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryUserStore) RecordFailedLogin(ctx context.Context, id primitive.ObjectID, now time.Time, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if user.LastFailedLoginAt == nil || user.LastFailedLoginAt.Before(now.Add(-window)) {
+		user.FailedLogins = 0
+	}
+	user.FailedLogins++
+	user.LastFailedLoginAt = &now
+	s.users[id] = user
+	return user.FailedLogins, nil
+}
+
+func (s *MemoryUserStore) LockUntil(ctx context.Context, id primitive.ObjectID, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if user.LockedUntil == nil || user.LockedUntil.Before(until) {
+		user.LockedUntil = &until
+	}
+	s.users[id] = user
+	return nil
+}
+
+func (s *MemoryUserStore) ResetFailedLogins(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.FailedLogins = 0
+	user.LastFailedLoginAt = nil
+	user.LockedUntil = nil
+	s.users[id] = user
+	return nil
+}
+
+func (s *MemoryUserStore) SetPendingTOTP(ctx context.Context, id primitive.ObjectID, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.TOTPPendingSecret = secret
+	s.users[id] = user
+	return nil
+}
+
+func (s *MemoryUserStore) MarkEmailVerified(ctx context.Context, id primitive.ObjectID, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok || user.Email != email {
+		return ErrNotFound
+	}
+	user.EmailVerified = true
+	s.users[id] = user
+	return nil
+}
+
+func (s *MemoryUserStore) ReplacePassword(ctx context.Context, id primitive.ObjectID, current string, replacement string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok || user.Password != current {
+		return ErrNotFound
+	}
+	user.Password = replacement
+	s.users[id] = user
+	return nil
+}
+
+func (s *MemoryUserStore) EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok || user.TOTPPendingSecret != secret {
+		return ErrNotFound
+	}
+	user.TOTPSecret = secret
+	user.TOTPPendingSecret = ""
+	user.TOTPLastStep = step
+	s.users[id] = user
+	return nil
+}
+
+func (s *MemoryUserStore) UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if user.TOTPLastStep >= step {
+		return false, nil
+	}
+	user.TOTPLastStep = step
+	s.users[id] = user
+	return true, nil
+}
+
+func (s *MemoryUserStore) SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, hashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.RecoveryCodes = append([]string(nil), hashes...)
+	s.users[id] = user
+	return nil
+}
+
+func (s *MemoryUserStore) UseRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return false, ErrNotFound
+	}
+	for i, h := range user.RecoveryCodes {
+		if h == hash {
+			// Copy, the slice may be shared with users handed out before.
+			remaining := append([]string(nil), user.RecoveryCodes[:i]...)
+			user.RecoveryCodes = append(remaining, user.RecoveryCodes[i+1:]...)
+			s.users[id] = user
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matches reports whether user is selected by filter.
+func matches(user model.User, filter UserFilter) bool {
+	if filter.EmailDomain != "" && !strings.HasSuffix(strings.ToLower(user.Email), "@"+strings.ToLower(filter.EmailDomain)) {
+		return false
+	}
+	if filter.UsernamePrefix != "" && !strings.HasPrefix(user.Username, filter.UsernamePrefix) {
+		return false
+	}
+	createdAt := user.Id.Timestamp()
+	if !filter.CreatedAfter.IsZero() && createdAt.Before(filter.CreatedAfter.Truncate(time.Second)) {
+		return false
+	}
+	if !filter.CreatedBefore.IsZero() && !createdAt.Before(filter.CreatedBefore.Truncate(time.Second)) {
+		return false
+	}
+	if filter.Status != "" {
+		accountStatus := user.Status
+		if accountStatus == "" {
+			accountStatus = model.UserStatusActive
+		}
+		if accountStatus != filter.Status {
+			return false
+		}
+	}
+	return true
+}
+
+// maxTracked bounds the memory a MemorySessionStore uses for source IPs and for used challenges.
+// Past it, the expired ones are forgotten.
+const maxTracked = 100000
+
+// ipFailures are the failed logins in a row from one source IP.
+type ipFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+	// expiresAt is when the failures are too old to count and the lock is over.
+	expiresAt time.Time
+}
+
+// MemorySessionStore is a thread-safe SessionStore that keeps sessions in memory. Every replica of
+// the service using one has sessions, failed logins per IP and used challenges of its own.
+type MemorySessionStore struct {
+	mu             sync.Mutex
+	sessions       map[primitive.ObjectID]model.Session
+	refreshTokens  map[string]model.RefreshToken
+	ipFailures     map[string]*ipFailures
+	usedChallenges map[string]time.Time
+}
+
+// NewMemorySessionStore creates an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions:       map[primitive.ObjectID]model.Session{},
+		refreshTokens:  map[string]model.RefreshToken{},
+		ipFailures:     map[string]*ipFailures{},
+		usedChallenges: map[string]time.Time{},
+	}
+}
+
+func (s *MemorySessionStore) CreateSession(ctx context.Context, session model.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.Id] = session
+	return nil
+}
+
+func (s *MemorySessionStore) GetSession(ctx context.Context, id primitive.ObjectID) (model.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return model.Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s *MemorySessionStore) TouchSession(ctx context.Context, id primitive.ObjectID, usedAt time.Time, expiresAt time.Time, clientIP string, userAgent string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || session.RevokedAt != nil {
+		return ErrNotFound
+	}
+	session.LastUsedAt = usedAt
+	session.ExpiresAt = expiresAt
+	session.ClientIP = clientIP
+	session.UserAgent = userAgent
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *MemorySessionStore) ListActiveSessions(ctx context.Context, userId primitive.ObjectID, now time.Time) ([]model.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sessions []model.Session
+	for _, session := range s.sessions {
+		if session.UserId == userId && session.RevokedAt == nil && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) RevokeSessions(ctx context.Context, userId primitive.ObjectID, sessionIds ...primitive.ObjectID) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	selected := map[primitive.ObjectID]bool{}
+	for _, id := range sessionIds {
+		selected[id] = true
+	}
+
+	now := time.Now().UTC()
+	revoked := map[primitive.ObjectID]bool{}
+	for id, session := range s.sessions {
+		if session.UserId != userId || session.RevokedAt != nil || (len(selected) > 0 && !selected[id]) {
+			continue
+		}
+		session.RevokedAt = &now
+		s.sessions[id] = session
+		revoked[id] = true
+	}
+	for hash, refreshToken := range s.refreshTokens {
+		if revoked[refreshToken.SessionId] && refreshToken.RevokedAt == nil {
+			refreshToken.RevokedAt = &now
+			s.refreshTokens[hash] = refreshToken
+		}
+	}
+	return int64(len(revoked)), nil
+}
+
+func (s *MemorySessionStore) CreateRefreshToken(ctx context.Context, refreshToken model.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshTokens[refreshToken.TokenHash] = refreshToken
+	return nil
+}
+
+func (s *MemorySessionStore) GetRefreshToken(ctx context.Context, tokenHash string) (model.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refreshToken, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return model.RefreshToken{}, ErrNotFound
+	}
+	return refreshToken, nil
+}
+
+func (s *MemorySessionStore) RotateRefreshToken(ctx context.Context, tokenHash string, now time.Time) (model.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refreshToken, ok := s.refreshTokens[tokenHash]
+	if !ok || refreshToken.RotatedAt != nil || refreshToken.RevokedAt != nil || !refreshToken.ExpiresAt.After(now) {
+		return model.RefreshToken{}, ErrNotFound
+	}
+	rotated := refreshToken
+	rotated.RotatedAt = &now
+	s.refreshTokens[tokenHash] = rotated
+	return refreshToken, nil
+}
+
+func (s *MemorySessionStore) RecordIPFailure(ctx context.Context, ip string, now time.Time, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ipFailures) >= maxTracked {
+		for tracked, failures := range s.ipFailures {
+			if failures.expiresAt.Before(now) {
+				delete(s.ipFailures, tracked)
+			}
+		}
+	}
+	failures, ok := s.ipFailures[ip]
+	if !ok {
+		failures = &ipFailures{}
+		s.ipFailures[ip] = failures
+	}
+	if failures.lastFailure.Before(now.Add(-window)) {
+		failures.count = 0
+	}
+	failures.count++
+	failures.lastFailure = now
+	if expiresAt := now.Add(window); expiresAt.After(failures.expiresAt) {
+		failures.expiresAt = expiresAt
+	}
+	return failures.count, nil
+}
+
+func (s *MemorySessionStore) LockIP(ctx context.Context, ip string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures, ok := s.ipFailures[ip]
+	if !ok {
+		failures = &ipFailures{}
+		s.ipFailures[ip] = failures
+	}
+	failures.count = 0
+	if until.After(failures.lockedUntil) {
+		failures.lockedUntil = until
+	}
+	if until.After(failures.expiresAt) {
+		failures.expiresAt = until
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) IPLockedUntil(ctx context.Context, ip string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failures, ok := s.ipFailures[ip]; ok {
+		return failures.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+func (s *MemorySessionStore) UseChallenge(ctx context.Context, challenge string, expiresAt time.Time, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.usedChallenges) >= maxTracked {
+		for used, usedExpiresAt := range s.usedChallenges {
+			if usedExpiresAt.Before(now) {
+				delete(s.usedChallenges, used)
+			}
+		}
+	}
+	if _, ok := s.usedChallenges[challenge]; ok || !expiresAt.After(now) {
+		return false, nil
+	}
+	s.usedChallenges[challenge] = expiresAt
+	return true, nil
+}
+
+// MemoryCredentialStore is a thread-safe CredentialStore that keeps credentials in memory.
+type MemoryCredentialStore struct {
+	mu          sync.Mutex
+	credentials map[primitive.ObjectID]model.Credential
+}
+
+// NewMemoryCredentialStore creates an empty MemoryCredentialStore.
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{credentials: make(map[primitive.ObjectID]model.Credential)}
+}
+
+func (s *MemoryCredentialStore) CreateCredential(ctx context.Context, credential model.Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.credentials {
+		if bytes.Equal(existing.CredentialId, credential.CredentialId) {
+			return &DuplicateError{Field: "credential"}
+		}
+	}
+	s.credentials[credential.Id] = credential
+	return nil
+}
+
+func (s *MemoryCredentialStore) ListCredentials(ctx context.Context, userId primitive.ObjectID) ([]model.Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var credentials []model.Credential
+	for _, credential := range s.credentials {
+		if credential.UserId == userId {
+			credentials = append(credentials, credential)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return bytes.Compare(credentials[i].Id[:], credentials[j].Id[:]) < 0
+	})
+	return credentials, nil
+}
+
+func (s *MemoryCredentialStore) UseCredential(ctx context.Context, id primitive.ObjectID, signCount uint32, backupState bool, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credential, ok := s.credentials[id]
+	if !ok {
+		return ErrNotFound
+	}
+	credential.SignCount = signCount
+	credential.BackupState = backupState
+	credential.LastUsedAt = &usedAt
+	s.credentials[id] = credential
+	return nil
+}
+
+func (s *MemoryCredentialStore) DeleteCredentials(ctx context.Context, userId primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, credential := range s.credentials {
+		if credential.UserId == userId {
+			delete(s.credentials, id)
+		}
+	}
+	return nil
+}
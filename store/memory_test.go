@@ -0,0 +1,26 @@
+package store_test
+
+import (
+	"testing"
+
+	"rahulchhabra.io/store"
+	"rahulchhabra.io/store/storetest"
+)
+
+func TestMemoryUserStore(t *testing.T) {
+	storetest.TestUserStore(t, func(t *testing.T) store.UserStore {
+		return store.NewMemoryUserStore()
+	})
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	storetest.TestSessionStore(t, func(t *testing.T) store.SessionStore {
+		return store.NewMemorySessionStore()
+	})
+}
+
+func TestMemoryCredentialStore(t *testing.T) {
+	storetest.TestCredentialStore(t, func(t *testing.T) store.CredentialStore {
+		return store.NewMemoryCredentialStore()
+	})
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is one versioned step of the SQL schema. Statements are written in the subset of SQL
+// understood by both SQLite and PostgreSQL.
+type migration struct {
+	version    int
+	statements []string
+}
+
+// migrations must only ever be appended to: a version that was applied somewhere is never changed.
+var migrations = []migration{
+	{
+		version: 1,
+		statements: []string{
+			`CREATE TABLE users (
+				id TEXT PRIMARY KEY,
+				first_name TEXT,
+				last_name TEXT,
+				email TEXT,
+				username TEXT,
+				password TEXT,
+				status TEXT
+			)`,
+			`CREATE UNIQUE INDEX users_email_unique ON users (lower(email))`,
+			`CREATE UNIQUE INDEX users_username_unique ON users (lower(username))`,
+			`CREATE TABLE sessions (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				created_at BIGINT NOT NULL,
+				last_used_at BIGINT NOT NULL,
+				expires_at BIGINT NOT NULL,
+				client_ip TEXT,
+				user_agent TEXT,
+				revoked_at BIGINT
+			)`,
+			`CREATE INDEX sessions_user_id ON sessions (user_id)`,
+			`CREATE TABLE refresh_tokens (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				session_id TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				created_at BIGINT NOT NULL,
+				expires_at BIGINT NOT NULL,
+				rotated_at BIGINT,
+				revoked_at BIGINT
+			)`,
+			`CREATE INDEX refresh_tokens_session_id ON refresh_tokens (session_id)`,
+		},
+	},
+	{
+		version: 2,
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE users ADD COLUMN last_failed_login_at BIGINT`,
+			`ALTER TABLE users ADD COLUMN locked_until BIGINT`,
+			`CREATE TABLE ip_failures (
+				ip TEXT PRIMARY KEY,
+				failures INTEGER NOT NULL,
+				last_failure_at BIGINT,
+				locked_until BIGINT,
+				expires_at BIGINT NOT NULL
+			)`,
+			`CREATE INDEX ip_failures_expires_at ON ip_failures (expires_at)`,
+		},
+	},
+	{
+		version: 3,
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN totp_secret TEXT`,
+			`ALTER TABLE users ADD COLUMN totp_pending_secret TEXT`,
+			`ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0`,
+			`CREATE TABLE used_challenges (
+				challenge TEXT PRIMARY KEY,
+				expires_at BIGINT NOT NULL
+			)`,
+			`CREATE INDEX used_challenges_expires_at ON used_challenges (expires_at)`,
+		},
+	},
+	{
+		version: 4,
+		statements: []string{
+			// Space separated hashes, which never contain spaces.
+			`ALTER TABLE users ADD COLUMN recovery_codes TEXT`,
+		},
+	},
+	{
+		version: 5,
+		statements: []string{
+			// Binary values are stored base64 encoded, which both databases handle the same way.
+			`CREATE TABLE credentials (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				credential_id TEXT NOT NULL UNIQUE,
+				public_key TEXT NOT NULL,
+				attestation_type TEXT,
+				aaguid TEXT,
+				sign_count BIGINT NOT NULL,
+				transports TEXT,
+				backup_eligible BOOLEAN NOT NULL,
+				backup_state BOOLEAN NOT NULL,
+				created_at BIGINT NOT NULL,
+				last_used_at BIGINT
+			)`,
+			`CREATE INDEX credentials_user_id ON credentials (user_id)`,
+		},
+	},
+	{
+		version: 6,
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+}
+
+// Migrate brings the schema of db up to the latest version. Every migration runs in its own
+// transaction together with the row recording it in schema_migrations, so a failed migration leaves
+// the schema at the previous version.
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	row := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`)
+	if err := row.Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, db, dialect, m); err != nil {
+			return fmt.Errorf("migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs the statements of m and records it.
+func applyMigration(ctx context.Context, db *sql.DB, dialect Dialect, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		dialect.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+		m.version, time.Now().UTC().UnixMicro(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
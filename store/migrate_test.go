@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// openUnmigrated opens an empty SQLite database without migrating it.
+func openUnmigrated(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open(SQLite.driverName(), filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("open sqlite: %s", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// schemaVersions returns the versions recorded in schema_migrations, in order.
+func schemaVersions(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+	rows, err := db.Query(`SELECT version FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		t.Fatalf("read schema_migrations: %s", err)
+	}
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			t.Fatalf("scan version: %s", err)
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+func TestMigrationVersionsIncrease(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d has version %d, versions must count up from 1", i, m.version)
+		}
+	}
+}
+
+func TestMigrateAppliesEveryVersionOnce(t *testing.T) {
+	ctx := context.Background()
+	db := openUnmigrated(t)
+	for range 2 {
+		if err := Migrate(ctx, db, SQLite); err != nil {
+			t.Fatalf("Migrate: %s", err)
+		}
+	}
+	versions := schemaVersions(t, db)
+	if len(versions) != len(migrations) || versions[len(versions)-1] != migrations[len(migrations)-1].version {
+		t.Errorf("recorded versions %v, want 1 to %d once each", versions, len(migrations))
+	}
+}
+
+func TestMigrateUpgradesOldSchema(t *testing.T) {
+	ctx := context.Background()
+	db := openUnmigrated(t)
+
+	// A database left at version 1 by an old release, with a user in it.
+	if _, err := db.Exec(`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyMigration(ctx, db, SQLite, migrations[0]); err != nil {
+		t.Fatalf("apply version 1: %s", err)
+	}
+	const id = "65920e909c0dc60a0a1e6312"
+	if _, err := db.Exec(`INSERT INTO users (id, email, username, password) VALUES (?, 'ada@example.com', 'ada', 'hash')`, id); err != nil {
+		t.Fatalf("insert version 1 user: %s", err)
+	}
+
+	if err := Migrate(ctx, db, SQLite); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	user, err := NewSQLUserStore(db, SQLite).GetByEmail(ctx, "ada@example.com")
+	if err != nil {
+		t.Fatalf("read user after the upgrade: %s", err)
+	}
+	if user.Id.Hex() != id || user.Username != "ada" || user.FailedLogins != 0 || user.EmailVerified {
+		t.Errorf("user after the upgrade: %+v", user)
+	}
+}
+
+func TestMigrateRollsBackFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	db := openUnmigrated(t)
+	if err := Migrate(ctx, db, SQLite); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+	broken := migration{
+		version: latest + 1,
+		statements: []string{
+			`CREATE TABLE half_done (id TEXT)`,
+			`THIS IS NOT SQL`,
+		},
+	}
+	original := migrations
+	migrations = append(append([]migration(nil), original...), broken)
+	t.Cleanup(func() { migrations = original })
+
+	if err := Migrate(ctx, db, SQLite); err == nil {
+		t.Fatal("Migrate with a broken migration succeeded")
+	}
+	if versions := schemaVersions(t, db); versions[len(versions)-1] != latest {
+		t.Errorf("schema at version %d after a failed migration, want %d", versions[len(versions)-1], latest)
+	}
+	if _, err := db.Exec(`SELECT id FROM half_done`); err == nil {
+		t.Error("the statements before the failure were not rolled back")
+	}
+}
@@ -0,0 +1,722 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"rahulchhabra.io/model"
+)
+
+// Names of the unique indexes on users.
+const (
+	emailIndex    = "email_unique_ci"
+	usernameIndex = "username_unique_ci"
+)
+
+// caseInsensitive is the collation of the unique indexes. Queries on email or username use it too,
+// both to match regardless of case and to be able to use the indexes.
+var caseInsensitive = &options.Collation{Locale: "en", Strength: 2}
+
+// MongoUserStore is a UserStore backed by a MongoDB collection.
+type MongoUserStore struct {
+	collection *mongo.Collection
+}
+
+// NewMongoUserStore creates a MongoUserStore on collection and makes sure its indexes exist.
+func NewMongoUserStore(ctx context.Context, collection *mongo.Collection) (*MongoUserStore, error) {
+	s := &MongoUserStore{collection: collection}
+	if err := s.createIndexes(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// createIndexes makes emails and usernames unique. Users without one of the fields are left out of
+// the corresponding index.
+func (s *MongoUserStore) createIndexes(ctx context.Context) error {
+	// Drop the case-sensitive indexes created by earlier versions.
+	for _, legacy := range []string{"email_1", "username_1"} {
+		if _, err := s.collection.Indexes().DropOne(ctx, legacy); err != nil && !isIndexNotFound(err) {
+			return err
+		}
+	}
+
+	var indexes []mongo.IndexModel
+	for field, name := range map[string]string{"email": emailIndex, "username": usernameIndex} {
+		indexes = append(indexes, mongo.IndexModel{
+			Keys: bson.D{{Key: field, Value: 1}},
+			Options: options.Index().
+				SetName(name).
+				SetUnique(true).
+				SetCollation(caseInsensitive).
+				SetPartialFilterExpression(bson.M{field: bson.M{"$type": "string"}}),
+		})
+	}
+	_, err := s.collection.Indexes().CreateMany(ctx, indexes)
+	return err
+}
+
+// isIndexNotFound reports whether err says the index (or the whole collection) does not exist.
+func isIndexNotFound(err error) bool {
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) {
+		// 26 is NamespaceNotFound and 27 IndexNotFound.
+		return commandErr.Code == 26 || commandErr.Code == 27
+	}
+	return false
+}
+
+// duplicateError converts a duplicate key error on one of the unique indexes into a DuplicateError.
+func duplicateError(err error) error {
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	if strings.Contains(err.Error(), usernameIndex) {
+		return &DuplicateError{Field: "username"}
+	}
+	return &DuplicateError{Field: "email"}
+}
+
+func (s *MongoUserStore) Create(ctx context.Context, user *model.User) error {
+	if user.Id.IsZero() {
+		user.Id = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, user)
+	return duplicateError(err)
+}
+
+func (s *MongoUserStore) GetByID(ctx context.Context, id primitive.ObjectID) (model.User, error) {
+	return s.findOne(ctx, bson.M{"_id": id})
+}
+
+func (s *MongoUserStore) GetByEmail(ctx context.Context, email string) (model.User, error) {
+	if email == "" {
+		return model.User{}, ErrNotFound
+	}
+	return s.findOne(ctx, bson.M{"email": email})
+}
+
+func (s *MongoUserStore) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	if username == "" {
+		return model.User{}, ErrNotFound
+	}
+	return s.findOne(ctx, bson.M{"username": username})
+}
+
+// findOne returns the user matching filter. Filters are spelled out rather than built from a
+// model.User, whose omitempty fields would turn an empty value into a filter matching anyone.
+func (s *MongoUserStore) findOne(ctx context.Context, filter bson.M) (model.User, error) {
+	var user model.User
+	err := s.collection.FindOne(ctx, filter, options.FindOne().SetCollation(caseInsensitive)).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.User{}, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *MongoUserStore) Update(ctx context.Context, id primitive.ObjectID, update UserUpdate) (model.User, error) {
+	set := bson.M{}
+	unset := bson.M{}
+	for field, value := range map[string]*string{
+		"firstname": update.FirstName,
+		"lastname":  update.LastName,
+		"email":     update.Email,
+		"username":  update.Username,
+		"password":  update.Password,
+		"status":    update.Status,
+	} {
+		switch {
+		case value == nil:
+		case *value == "":
+			unset[field] = ""
+		default:
+			set[field] = *value
+		}
+	}
+	switch {
+	case update.EmailVerified == nil:
+	case *update.EmailVerified:
+		set["emailverified"] = true
+	default:
+		unset["emailverified"] = ""
+	}
+	changes := bson.M{}
+	if len(set) > 0 {
+		changes["$set"] = set
+	}
+	if len(unset) > 0 {
+		changes["$unset"] = unset
+	}
+	if len(changes) == 0 {
+		return s.GetByID(ctx, id)
+	}
+
+	var user model.User
+	err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, changes,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.User{}, ErrNotFound
+	}
+	if err != nil {
+		return model.User{}, duplicateError(err)
+	}
+	return user, nil
+}
+
+func (s *MongoUserStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) List(ctx context.Context, listOptions ListOptions) ([]model.User, error) {
+	filter := mongoUserFilter(listOptions.Filter)
+	order := 1
+	if listOptions.Descending {
+		order = -1
+	}
+	if !listOptions.After.IsZero() {
+		idFilter, _ := filter["_id"].(bson.M)
+		if idFilter == nil {
+			idFilter = bson.M{}
+		}
+		if order == 1 {
+			idFilter["$gt"] = listOptions.After
+		} else {
+			idFilter["$lt"] = listOptions.After
+		}
+		filter["_id"] = idFilter
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: order}})
+	if listOptions.Limit > 0 {
+		findOptions.SetLimit(listOptions.Limit)
+	}
+	cursor, err := s.collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var users []model.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *MongoUserStore) Count(ctx context.Context, filter UserFilter) (int64, error) {
+	if filter.IsEmpty() {
+		return s.collection.EstimatedDocumentCount(ctx)
+	}
+	return s.collection.CountDocuments(ctx, mongoUserFilter(filter))
+}
+
+func (s *MongoUserStore) RecordFailedLogin(ctx context.Context, id primitive.ObjectID, now time.Time, window time.Duration) (int, error) {
+	// An update pipeline increments the count and starts it over in one atomic step, so concurrent
+	// failures are all counted.
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failedlogins": bson.M{"$cond": bson.A{
+				bson.M{"$gte": bson.A{"$lastfailedloginat", now.Add(-window)}},
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failedlogins", 0}}, 1}},
+				1,
+			}},
+			"lastfailedloginat": now,
+		}}},
+	}
+	var user model.User
+	err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return user.FailedLogins, nil
+}
+
+func (s *MongoUserStore) LockUntil(ctx context.Context, id primitive.ObjectID, until time.Time) error {
+	// $max only ever moves the end of the lock later.
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$max": bson.M{"lockeduntil": until}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) ResetFailedLogins(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{
+		"failedlogins":      "",
+		"lastfailedloginat": "",
+		"lockeduntil":       "",
+	}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) SetPendingTOTP(ctx context.Context, id primitive.ObjectID, secret string) error {
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"totppendingsecret": secret}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) MarkEmailVerified(ctx context.Context, id primitive.ObjectID, email string) error {
+	// Matching the email keeps a link sent to an earlier address from verifying the current one.
+	result, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "email": email},
+		bson.M{"$set": bson.M{"emailverified": true}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) ReplacePassword(ctx context.Context, id primitive.ObjectID, current string, replacement string) error {
+	// Matching the current hash lets only one of two concurrent changes succeed.
+	result, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "password": current},
+		bson.M{"$set": bson.M{"password": replacement}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, step int64) error {
+	// Matching the pending secret keeps a concurrent new enrollment from being enabled unconfirmed.
+	result, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "totppendingsecret": secret},
+		bson.M{
+			"$set":   bson.M{"totpsecret": secret, "totplaststep": step},
+			"$unset": bson.M{"totppendingsecret": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) (bool, error) {
+	// Users without a step yet are matched by $not, which unlike $lt also matches a missing field.
+	result, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "totplaststep": bson.M{"$not": bson.M{"$gte": step}}},
+		bson.M{"$set": bson.M{"totplaststep": step}},
+	)
+	if err != nil {
+		return false, err
+	}
+	if result.MatchedCount == 0 {
+		return false, s.exists(ctx, id)
+	}
+	return true, nil
+}
+
+func (s *MongoUserStore) SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, hashes []string) error {
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"recoverycodes": hashes}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoUserStore) UseRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) (bool, error) {
+	// Only matching users that still have the hash makes using a code twice at once fail once.
+	result, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "recoverycodes": hash},
+		bson.M{"$pull": bson.M{"recoverycodes": hash}},
+	)
+	if err != nil {
+		return false, err
+	}
+	if result.MatchedCount == 0 {
+		return false, s.exists(ctx, id)
+	}
+	return true, nil
+}
+
+// exists returns ErrNotFound when there is no user with the id.
+func (s *MongoUserStore) exists(ctx context.Context, id primitive.ObjectID) error {
+	err := s.collection.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// mongoUserFilter turns a UserFilter into a MongoDB query.
+func mongoUserFilter(f UserFilter) bson.M {
+	filter := bson.M{}
+	if f.EmailDomain != "" {
+		filter["email"] = primitive.Regex{Pattern: "@" + regexp.QuoteMeta(f.EmailDomain) + "$", Options: "i"}
+	}
+	if f.UsernamePrefix != "" {
+		filter["username"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(f.UsernamePrefix)}
+	}
+
+	// ObjectIDs start with their creation time, so a creation date range is an _id range.
+	idFilter := bson.M{}
+	if !f.CreatedAfter.IsZero() {
+		idFilter["$gte"] = firstIDAt(f.CreatedAfter)
+	}
+	if !f.CreatedBefore.IsZero() {
+		idFilter["$lt"] = firstIDAt(f.CreatedBefore)
+	}
+	if len(idFilter) > 0 {
+		filter["_id"] = idFilter
+	}
+
+	switch f.Status {
+	case "":
+	case model.UserStatusActive:
+		filter["status"] = bson.M{"$in": bson.A{model.UserStatusActive, nil}}
+	default:
+		filter["status"] = f.Status
+	}
+	return filter
+}
+
+// MongoSessionStore is a SessionStore backed by four MongoDB collections.
+type MongoSessionStore struct {
+	sessions       *mongo.Collection
+	refreshTokens  *mongo.Collection
+	ipFailures     *mongo.Collection
+	usedChallenges *mongo.Collection
+}
+
+// NewMongoSessionStore creates a MongoSessionStore and makes sure its indexes exist.
+func NewMongoSessionStore(ctx context.Context, sessions *mongo.Collection, refreshTokens *mongo.Collection, ipFailures *mongo.Collection, usedChallenges *mongo.Collection) (*MongoSessionStore, error) {
+	s := &MongoSessionStore{sessions: sessions, refreshTokens: refreshTokens, ipFailures: ipFailures, usedChallenges: usedChallenges}
+	if err := s.createIndexes(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// createIndexes makes token lookups by hash fast and unique, and lets MongoDB remove sessions,
+// refresh tokens, failures per IP and used challenges once they have expired.
+func (s *MongoSessionStore) createIndexes(ctx context.Context) error {
+	_, err := s.sessions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "userid", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expiresat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.refreshTokens.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tokenhash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "sessionid", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expiresat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, collection := range []*mongo.Collection{s.ipFailures, s.usedChallenges} {
+		_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiresat", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MongoSessionStore) CreateSession(ctx context.Context, session model.Session) error {
+	_, err := s.sessions.InsertOne(ctx, session)
+	return err
+}
+
+func (s *MongoSessionStore) GetSession(ctx context.Context, id primitive.ObjectID) (model.Session, error) {
+	var session model.Session
+	err := s.sessions.FindOne(ctx, bson.M{"_id": id}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.Session{}, ErrNotFound
+	}
+	return session, err
+}
+
+func (s *MongoSessionStore) TouchSession(ctx context.Context, id primitive.ObjectID, usedAt time.Time, expiresAt time.Time, clientIP string, userAgent string) error {
+	err := s.sessions.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "revokedat": nil},
+		bson.M{"$set": bson.M{
+			"lastusedat": usedAt,
+			"expiresat":  expiresAt,
+			"clientip":   clientIP,
+			"useragent":  userAgent,
+		}},
+	).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MongoSessionStore) ListActiveSessions(ctx context.Context, userId primitive.ObjectID, now time.Time) ([]model.Session, error) {
+	cursor, err := s.sessions.Find(ctx,
+		bson.M{"userid": userId, "revokedat": nil, "expiresat": bson.M{"$gt": now}},
+		options.Find().SetSort(bson.D{{Key: "lastusedat", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []model.Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *MongoSessionStore) RevokeSessions(ctx context.Context, userId primitive.ObjectID, sessionIds ...primitive.ObjectID) (int64, error) {
+	filter := bson.M{"userid": userId, "revokedat": nil}
+	if len(sessionIds) > 0 {
+		filter["_id"] = bson.M{"$in": sessionIds}
+	}
+	cursor, err := s.sessions.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var sessions []model.Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return 0, err
+	}
+	if len(sessions) == 0 {
+		return 0, nil
+	}
+	var revokedIds []primitive.ObjectID
+	for _, session := range sessions {
+		revokedIds = append(revokedIds, session.Id)
+	}
+
+	now := time.Now().UTC()
+	result, err := s.sessions.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": revokedIds}, "revokedat": nil},
+		bson.M{"$set": bson.M{"revokedat": now}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.refreshTokens.UpdateMany(ctx,
+		bson.M{"sessionid": bson.M{"$in": revokedIds}, "revokedat": nil},
+		bson.M{"$set": bson.M{"revokedat": now}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (s *MongoSessionStore) CreateRefreshToken(ctx context.Context, refreshToken model.RefreshToken) error {
+	_, err := s.refreshTokens.InsertOne(ctx, refreshToken)
+	return err
+}
+
+func (s *MongoSessionStore) GetRefreshToken(ctx context.Context, tokenHash string) (model.RefreshToken, error) {
+	var refreshToken model.RefreshToken
+	err := s.refreshTokens.FindOne(ctx, bson.M{"tokenhash": tokenHash}).Decode(&refreshToken)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.RefreshToken{}, ErrNotFound
+	}
+	return refreshToken, err
+}
+
+func (s *MongoSessionStore) RotateRefreshToken(ctx context.Context, tokenHash string, now time.Time) (model.RefreshToken, error) {
+	// The filter makes this atomic, so a token can only be rotated once even when two requests race with it.
+	var refreshToken model.RefreshToken
+	err := s.refreshTokens.FindOneAndUpdate(ctx,
+		bson.M{
+			"tokenhash": tokenHash,
+			"rotatedat": nil,
+			"revokedat": nil,
+			"expiresat": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"rotatedat": now}},
+	).Decode(&refreshToken)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.RefreshToken{}, ErrNotFound
+	}
+	return refreshToken, err
+}
+
+// mongoIPFailures is the document of one source IP in the ip failures collection, whose id is the IP.
+type mongoIPFailures struct {
+	Failures      int       `bson:"failures"`
+	LastFailureAt time.Time `bson:"lastfailureat,omitempty"`
+	LockedUntil   time.Time `bson:"lockeduntil,omitempty"`
+	// ExpiresAt is when the failures are too old to count and the lock is over, and MongoDB removes
+	// the document.
+	ExpiresAt time.Time `bson:"expiresat"`
+}
+
+func (s *MongoSessionStore) RecordIPFailure(ctx context.Context, ip string, now time.Time, window time.Duration) (int, error) {
+	// Like MongoUserStore.RecordFailedLogin, an update pipeline counts concurrent failures atomically.
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				bson.M{"$gte": bson.A{"$lastfailureat", now.Add(-window)}},
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+				1,
+			}},
+			"lastfailureat": now,
+			"expiresat":     bson.M{"$max": bson.A{"$expiresat", now.Add(window)}},
+		}}},
+	}
+	var failures mongoIPFailures
+	err := s.ipFailures.FindOneAndUpdate(ctx, bson.M{"_id": ip}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&failures)
+	return failures.Failures, err
+}
+
+func (s *MongoSessionStore) LockIP(ctx context.Context, ip string, until time.Time) error {
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failures":    0,
+			"lockeduntil": bson.M{"$max": bson.A{"$lockeduntil", until}},
+			"expiresat":   bson.M{"$max": bson.A{"$expiresat", until}},
+		}}},
+	}
+	_, err := s.ipFailures.UpdateOne(ctx, bson.M{"_id": ip}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *MongoSessionStore) IPLockedUntil(ctx context.Context, ip string) (time.Time, error) {
+	var failures mongoIPFailures
+	err := s.ipFailures.FindOne(ctx, bson.M{"_id": ip}).Decode(&failures)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return failures.LockedUntil, nil
+}
+
+func (s *MongoSessionStore) UseChallenge(ctx context.Context, challenge string, expiresAt time.Time, now time.Time) (bool, error) {
+	if !expiresAt.After(now) {
+		return false, nil
+	}
+	// The unique id lets only one of concurrent uses insert the challenge.
+	_, err := s.usedChallenges.InsertOne(ctx, bson.M{"_id": challenge, "expiresat": expiresAt})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MongoCredentialStore is a CredentialStore backed by a MongoDB collection.
+type MongoCredentialStore struct {
+	collection *mongo.Collection
+}
+
+// NewMongoCredentialStore creates a MongoCredentialStore and makes sure its indexes exist.
+func NewMongoCredentialStore(ctx context.Context, collection *mongo.Collection) (*MongoCredentialStore, error) {
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "credentialid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userid", Value: 1}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MongoCredentialStore{collection: collection}, nil
+}
+
+func (s *MongoCredentialStore) CreateCredential(ctx context.Context, credential model.Credential) error {
+	_, err := s.collection.InsertOne(ctx, credential)
+	if mongo.IsDuplicateKeyError(err) {
+		return &DuplicateError{Field: "credential"}
+	}
+	return err
+}
+
+func (s *MongoCredentialStore) ListCredentials(ctx context.Context, userId primitive.ObjectID) ([]model.Credential, error) {
+	cursor, err := s.collection.Find(ctx, bson.M{"userid": userId}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var credentials []model.Credential
+	if err := cursor.All(ctx, &credentials); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func (s *MongoCredentialStore) UseCredential(ctx context.Context, id primitive.ObjectID, signCount uint32, backupState bool, usedAt time.Time) error {
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"signcount":   signCount,
+		"backupstate": backupState,
+		"lastusedat":  usedAt,
+	}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoCredentialStore) DeleteCredentials(ctx context.Context, userId primitive.ObjectID) error {
+	_, err := s.collection.DeleteMany(ctx, bson.M{"userid": userId})
+	return err
+}
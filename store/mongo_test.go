@@ -0,0 +1,78 @@
+package store_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"rahulchhabra.io/store"
+	"rahulchhabra.io/store/storetest"
+)
+
+// mongoDatabases returns a function creating a database on the server at MONGO_TEST_URI, e.g.
+// mongodb://localhost:27017, and skips the test when it is not set. Every database is dropped
+// afterwards.
+func mongoDatabases(t *testing.T) func(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connect to MongoDB: %s", err)
+	}
+	t.Cleanup(func() { client.Disconnect(ctx) })
+
+	return func(t *testing.T) *mongo.Database {
+		random := make([]byte, 8)
+		rand.Read(random)
+		database := client.Database("storetest_" + hex.EncodeToString(random))
+		t.Cleanup(func() { database.Drop(ctx) })
+		return database
+	}
+}
+
+func TestMongoUserStore(t *testing.T) {
+	newDatabase := mongoDatabases(t)
+	storetest.TestUserStore(t, func(t *testing.T) store.UserStore {
+		users, err := store.NewMongoUserStore(context.Background(), newDatabase(t).Collection("users"))
+		if err != nil {
+			t.Fatalf("NewMongoUserStore: %s", err)
+		}
+		return users
+	})
+}
+
+func TestMongoSessionStore(t *testing.T) {
+	newDatabase := mongoDatabases(t)
+	storetest.TestSessionStore(t, func(t *testing.T) store.SessionStore {
+		database := newDatabase(t)
+		sessions, err := store.NewMongoSessionStore(context.Background(),
+			database.Collection("sessions"),
+			database.Collection("refresh_tokens"),
+			database.Collection("ip_failures"),
+			database.Collection("used_challenges"),
+		)
+		if err != nil {
+			t.Fatalf("NewMongoSessionStore: %s", err)
+		}
+		return sessions
+	})
+}
+
+func TestMongoCredentialStore(t *testing.T) {
+	newDatabase := mongoDatabases(t)
+	storetest.TestCredentialStore(t, func(t *testing.T) store.CredentialStore {
+		credentials, err := store.NewMongoCredentialStore(context.Background(), newDatabase(t).Collection("credentials"))
+		if err != nil {
+			t.Fatalf("NewMongoCredentialStore: %s", err)
+		}
+		return credentials
+	})
+}
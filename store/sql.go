@@ -0,0 +1,930 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+	"rahulchhabra.io/model"
+)
+
+// Dialect is the SQL database a SQL store talks to.
+type Dialect string
+
+const (
+	// SQLite uses the pure-Go modernc.org/sqlite driver and needs no C toolchain.
+	SQLite Dialect = "sqlite"
+	// Postgres uses the pgx driver.
+	Postgres Dialect = "postgres"
+)
+
+// driverName returns the database/sql driver registered for the dialect.
+func (d Dialect) driverName() string {
+	if d == Postgres {
+		return "pgx"
+	}
+	return "sqlite"
+}
+
+// rebind rewrites the ? placeholders of query into $1, $2, ... for PostgreSQL.
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// OpenSQL connects to the database described by dsn and migrates its schema to the latest version.
+// For SQLite dsn is a file name such as "users.db", for PostgreSQL a connection URL.
+func OpenSQL(ctx context.Context, dialect Dialect, dsn string) (*sql.DB, error) {
+	if dialect == SQLite {
+		// Wait for locks instead of failing right away, and enforce foreign keys.
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + "_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+	}
+	db, err := sql.Open(dialect.driverName(), dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == SQLite {
+		// SQLite allows a single writer, serialize access instead of failing with SQLITE_BUSY.
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := Migrate(ctx, db, dialect); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// nullString stores empty strings as NULL, so the unique indexes ignore missing emails and usernames.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// unixMicro converts a time to the integer stored in the database.
+func unixMicro(t time.Time) int64 {
+	return t.UTC().UnixMicro()
+}
+
+// nullUnixMicro converts an optional time to the integer stored in the database.
+func nullUnixMicro(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: unixMicro(*t), Valid: true}
+}
+
+// fromUnixMicro converts an optional integer from the database back into a time.
+func fromUnixMicro(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.UnixMicro(v.Int64).UTC()
+	return &t
+}
+
+// parseObjectID converts an id column back into an ObjectID.
+func parseObjectID(hex string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("invalid id %q in database: %w", hex, err)
+	}
+	return id, nil
+}
+
+// sqlDuplicateError converts a unique constraint violation into a DuplicateError. Both SQLite and
+// PostgreSQL name the violated index in the error message.
+func sqlDuplicateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "users_username_unique"):
+		return &DuplicateError{Field: "username"}
+	case strings.Contains(message, "users_email_unique"):
+		return &DuplicateError{Field: "email"}
+	case strings.Contains(message, "users.id") || strings.Contains(message, "users_pkey"):
+		return &DuplicateError{Field: "id"}
+	case strings.Contains(message, "credential_id"):
+		return &DuplicateError{Field: "credential"}
+	}
+	return err
+}
+
+// SQLUserStore is a UserStore backed by a SQLite or PostgreSQL table.
+type SQLUserStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLUserStore creates a SQLUserStore on a database opened with OpenSQL.
+func NewSQLUserStore(db *sql.DB, dialect Dialect) *SQLUserStore {
+	return &SQLUserStore{db: db, dialect: dialect}
+}
+
+const userColumns = `id, first_name, last_name, email, username, password, status, failed_logins, last_failed_login_at, locked_until, totp_secret, totp_pending_secret, totp_last_step, recovery_codes, email_verified`
+
+// scanUser reads a row selected with userColumns.
+func scanUser(row interface{ Scan(...any) error }) (model.User, error) {
+	var id string
+	var firstName, lastName, email, username, password, accountStatus sql.NullString
+	var failedLogins int
+	var lastFailedLoginAt, lockedUntil sql.NullInt64
+	var totpSecret, totpPendingSecret, recoveryCodes sql.NullString
+	var totpLastStep int64
+	var emailVerified bool
+	if err := row.Scan(&id, &firstName, &lastName, &email, &username, &password, &accountStatus, &failedLogins, &lastFailedLoginAt, &lockedUntil, &totpSecret, &totpPendingSecret, &totpLastStep, &recoveryCodes, &emailVerified); err != nil {
+		return model.User{}, err
+	}
+	oid, err := parseObjectID(id)
+	if err != nil {
+		return model.User{}, err
+	}
+	return model.User{
+		Id:        oid,
+		FirstName: firstName.String,
+		LastName:  lastName.String,
+		Email:     email.String,
+		Username:  username.String,
+		Password:  password.String,
+		Status:    accountStatus.String,
+
+		EmailVerified: emailVerified,
+
+		FailedLogins:      failedLogins,
+		LastFailedLoginAt: fromUnixMicro(lastFailedLoginAt),
+		LockedUntil:       fromUnixMicro(lockedUntil),
+
+		TOTPSecret:        totpSecret.String,
+		TOTPPendingSecret: totpPendingSecret.String,
+		TOTPLastStep:      totpLastStep,
+		RecoveryCodes:     strings.Fields(recoveryCodes.String),
+	}, nil
+}
+
+func (s *SQLUserStore) Create(ctx context.Context, user *model.User) error {
+	if user.Id.IsZero() {
+		user.Id = primitive.NewObjectID()
+	}
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		user.Id.Hex(),
+		nullString(user.FirstName),
+		nullString(user.LastName),
+		nullString(user.Email),
+		nullString(user.Username),
+		nullString(user.Password),
+		nullString(user.Status),
+		user.FailedLogins,
+		nullUnixMicro(user.LastFailedLoginAt),
+		nullUnixMicro(user.LockedUntil),
+		nullString(user.TOTPSecret),
+		nullString(user.TOTPPendingSecret),
+		user.TOTPLastStep,
+		nullString(strings.Join(user.RecoveryCodes, " ")),
+		user.EmailVerified,
+	)
+	return sqlDuplicateError(err)
+}
+
+func (s *SQLUserStore) GetByID(ctx context.Context, id primitive.ObjectID) (model.User, error) {
+	return s.getOne(ctx, `id = ?`, id.Hex())
+}
+
+func (s *SQLUserStore) GetByEmail(ctx context.Context, email string) (model.User, error) {
+	if email == "" {
+		return model.User{}, ErrNotFound
+	}
+	return s.getOne(ctx, `lower(email) = lower(?)`, email)
+}
+
+func (s *SQLUserStore) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	if username == "" {
+		return model.User{}, ErrNotFound
+	}
+	return s.getOne(ctx, `lower(username) = lower(?)`, username)
+}
+
+// getOne returns the user matching the where clause.
+func (s *SQLUserStore) getOne(ctx context.Context, where string, args ...any) (model.User, error) {
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+userColumns+` FROM users WHERE `+where), args...)
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.User{}, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *SQLUserStore) Update(ctx context.Context, id primitive.ObjectID, update UserUpdate) (model.User, error) {
+	var assignments []string
+	var args []any
+	for _, field := range []struct {
+		column string
+		value  *string
+	}{
+		{"first_name", update.FirstName},
+		{"last_name", update.LastName},
+		{"email", update.Email},
+		{"username", update.Username},
+		{"password", update.Password},
+		{"status", update.Status},
+	} {
+		if field.value != nil {
+			assignments = append(assignments, field.column+` = ?`)
+			args = append(args, nullString(*field.value))
+		}
+	}
+	if update.EmailVerified != nil {
+		assignments = append(assignments, `email_verified = ?`)
+		args = append(args, *update.EmailVerified)
+	}
+	if len(assignments) == 0 {
+		return s.GetByID(ctx, id)
+	}
+
+	args = append(args, id.Hex())
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users SET `+strings.Join(assignments, ", ")+` WHERE id = ?`), args...)
+	if err != nil {
+		return model.User{}, sqlDuplicateError(err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return model.User{}, ErrNotFound
+	}
+	return s.GetByID(ctx, id)
+}
+
+func (s *SQLUserStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM users WHERE id = ?`), id.Hex())
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLUserStore) List(ctx context.Context, options ListOptions) ([]model.User, error) {
+	where, args := sqlUserFilter(options.Filter)
+	order := "ASC"
+	if !options.After.IsZero() {
+		// Hex ObjectIDs sort in the same order as the ObjectIDs themselves.
+		if options.Descending {
+			where = append(where, `id < ?`)
+		} else {
+			where = append(where, `id > ?`)
+		}
+		args = append(args, options.After.Hex())
+	}
+	if options.Descending {
+		order = "DESC"
+	}
+
+	query := `SELECT ` + userColumns + ` FROM users`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY id ` + order
+	if options.Limit > 0 {
+		query += ` LIMIT ` + strconv.FormatInt(options.Limit, 10)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []model.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLUserStore) Count(ctx context.Context, filter UserFilter) (int64, error) {
+	where, args := sqlUserFilter(filter)
+	query := `SELECT COUNT(*) FROM users`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	var count int64
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(query), args...).Scan(&count)
+	return count, err
+}
+
+func (s *SQLUserStore) RecordFailedLogin(ctx context.Context, id primitive.ObjectID, now time.Time, window time.Duration) (int, error) {
+	// Counting in the UPDATE itself makes concurrent failures all count.
+	var failedLogins int
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(`UPDATE users SET
+			failed_logins = CASE WHEN last_failed_login_at >= ? THEN failed_logins + 1 ELSE 1 END,
+			last_failed_login_at = ?
+		WHERE id = ?
+		RETURNING failed_logins`),
+		unixMicro(now.Add(-window)), unixMicro(now), id.Hex(),
+	).Scan(&failedLogins)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return failedLogins, err
+}
+
+func (s *SQLUserStore) LockUntil(ctx context.Context, id primitive.ObjectID, until time.Time) error {
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users
+		SET locked_until = CASE WHEN locked_until IS NULL OR locked_until < ? THEN ? ELSE locked_until END
+		WHERE id = ?`),
+		unixMicro(until), unixMicro(until), id.Hex(),
+	)
+	return sqlRowAffected(result, err)
+}
+
+func (s *SQLUserStore) ResetFailedLogins(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users
+		SET failed_logins = 0, last_failed_login_at = NULL, locked_until = NULL
+		WHERE id = ?`),
+		id.Hex(),
+	)
+	return sqlRowAffected(result, err)
+}
+
+func (s *SQLUserStore) SetPendingTOTP(ctx context.Context, id primitive.ObjectID, secret string) error {
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users SET totp_pending_secret = ? WHERE id = ?`),
+		secret, id.Hex(),
+	)
+	return sqlRowAffected(result, err)
+}
+
+func (s *SQLUserStore) MarkEmailVerified(ctx context.Context, id primitive.ObjectID, email string) error {
+	// Matching the email keeps a link sent to an earlier address from verifying the current one.
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users SET email_verified = ? WHERE id = ? AND email = ?`),
+		true, id.Hex(), email,
+	)
+	return sqlRowAffected(result, err)
+}
+
+func (s *SQLUserStore) ReplacePassword(ctx context.Context, id primitive.ObjectID, current string, replacement string) error {
+	// The WHERE on the old hash makes this a compare-and-swap.
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users SET password = ? WHERE id = ? AND password = ?`),
+		replacement, id.Hex(), current,
+	)
+	return sqlRowAffected(result, err)
+}
+
+func (s *SQLUserStore) EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, step int64) error {
+	// Matching the pending secret keeps a concurrent new enrollment from being enabled unconfirmed.
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users
+		SET totp_secret = totp_pending_secret, totp_pending_secret = NULL, totp_last_step = ?
+		WHERE id = ? AND totp_pending_secret = ?`),
+		step, id.Hex(), secret,
+	)
+	return sqlRowAffected(result, err)
+}
+
+func (s *SQLUserStore) UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) (bool, error) {
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users SET totp_last_step = ?
+		WHERE id = ? AND totp_last_step < ?`),
+		step, id.Hex(), step,
+	)
+	err = sqlRowAffected(result, err)
+	if errors.Is(err, ErrNotFound) {
+		// No row changed either because the step was used or because there is no such user.
+		return false, s.exists(ctx, id)
+	}
+	return err == nil, err
+}
+
+func (s *SQLUserStore) SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, hashes []string) error {
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users SET recovery_codes = ? WHERE id = ?`),
+		nullString(strings.Join(hashes, " ")), id.Hex(),
+	)
+	return sqlRowAffected(result, err)
+}
+
+func (s *SQLUserStore) UseRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) (bool, error) {
+	// The codes are replaced only if nobody changed them since they were read, and read again
+	// otherwise, so two codes used at once are both removed and a code used twice at once only once.
+	for {
+		var current sql.NullString
+		err := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT recovery_codes FROM users WHERE id = ?`), id.Hex()).Scan(&current)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNotFound
+		}
+		if err != nil {
+			return false, err
+		}
+		hashes := strings.Fields(current.String)
+		remaining := make([]string, 0, len(hashes))
+		for _, h := range hashes {
+			if h != hash {
+				remaining = append(remaining, h)
+			}
+		}
+		if len(remaining) == len(hashes) {
+			return false, nil
+		}
+		result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE users SET recovery_codes = ? WHERE id = ? AND recovery_codes = ?`),
+			nullString(strings.Join(remaining, " ")), id.Hex(), current.String,
+		)
+		err = sqlRowAffected(result, err)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+	}
+}
+
+// exists returns ErrNotFound when there is no user with the id.
+func (s *SQLUserStore) exists(ctx context.Context, id primitive.ObjectID) error {
+	var one int
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT 1 FROM users WHERE id = ?`), id.Hex()).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// sqlRowAffected returns ErrNotFound when a statement that targets a single row changed none.
+func sqlRowAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// sqlUserFilter turns a UserFilter into WHERE conditions and their arguments.
+func sqlUserFilter(f UserFilter) ([]string, []any) {
+	var where []string
+	var args []any
+	if f.EmailDomain != "" {
+		where = append(where, `lower(email) LIKE ? ESCAPE '\'`)
+		args = append(args, "%@"+escapeLike(strings.ToLower(f.EmailDomain)))
+	}
+	if f.UsernamePrefix != "" {
+		// substr keeps the comparison case-sensitive, unlike LIKE on SQLite. It counts characters,
+		// not bytes.
+		where = append(where, `substr(username, 1, `+strconv.Itoa(utf8.RuneCountInString(f.UsernamePrefix))+`) = ?`)
+		args = append(args, f.UsernamePrefix)
+	}
+	// ObjectIDs start with their creation time, so a creation date range is an id range.
+	if !f.CreatedAfter.IsZero() {
+		where = append(where, `id >= ?`)
+		args = append(args, firstIDAt(f.CreatedAfter).Hex())
+	}
+	if !f.CreatedBefore.IsZero() {
+		where = append(where, `id < ?`)
+		args = append(args, firstIDAt(f.CreatedBefore).Hex())
+	}
+	switch f.Status {
+	case "":
+	case model.UserStatusActive:
+		where = append(where, `(status = ? OR status IS NULL)`)
+		args = append(args, model.UserStatusActive)
+	default:
+		where = append(where, `status = ?`)
+		args = append(args, f.Status)
+	}
+	return where, args
+}
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SQLSessionStore is a SessionStore backed by SQLite or PostgreSQL tables.
+type SQLSessionStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLSessionStore creates a SQLSessionStore on a database opened with OpenSQL.
+func NewSQLSessionStore(db *sql.DB, dialect Dialect) *SQLSessionStore {
+	return &SQLSessionStore{db: db, dialect: dialect}
+}
+
+const sessionColumns = `id, user_id, created_at, last_used_at, expires_at, client_ip, user_agent, revoked_at`
+
+// scanSession reads a row selected with sessionColumns.
+func scanSession(row interface{ Scan(...any) error }) (model.Session, error) {
+	var id, userId string
+	var createdAt, lastUsedAt, expiresAt int64
+	var clientIP, userAgent sql.NullString
+	var revokedAt sql.NullInt64
+	if err := row.Scan(&id, &userId, &createdAt, &lastUsedAt, &expiresAt, &clientIP, &userAgent, &revokedAt); err != nil {
+		return model.Session{}, err
+	}
+	sessionId, err := parseObjectID(id)
+	if err != nil {
+		return model.Session{}, err
+	}
+	userOid, err := parseObjectID(userId)
+	if err != nil {
+		return model.Session{}, err
+	}
+	return model.Session{
+		Id:         sessionId,
+		UserId:     userOid,
+		CreatedAt:  time.UnixMicro(createdAt).UTC(),
+		LastUsedAt: time.UnixMicro(lastUsedAt).UTC(),
+		ExpiresAt:  time.UnixMicro(expiresAt).UTC(),
+		ClientIP:   clientIP.String,
+		UserAgent:  userAgent.String,
+		RevokedAt:  fromUnixMicro(revokedAt),
+	}, nil
+}
+
+func (s *SQLSessionStore) CreateSession(ctx context.Context, session model.Session) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		session.Id.Hex(),
+		session.UserId.Hex(),
+		unixMicro(session.CreatedAt),
+		unixMicro(session.LastUsedAt),
+		unixMicro(session.ExpiresAt),
+		nullString(session.ClientIP),
+		nullString(session.UserAgent),
+		nullUnixMicro(session.RevokedAt),
+	)
+	return err
+}
+
+func (s *SQLSessionStore) GetSession(ctx context.Context, id primitive.ObjectID) (model.Session, error) {
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`), id.Hex())
+	session, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Session{}, ErrNotFound
+	}
+	return session, err
+}
+
+func (s *SQLSessionStore) TouchSession(ctx context.Context, id primitive.ObjectID, usedAt time.Time, expiresAt time.Time, clientIP string, userAgent string) error {
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE sessions
+		SET last_used_at = ?, expires_at = ?, client_ip = ?, user_agent = ?
+		WHERE id = ? AND revoked_at IS NULL`),
+		unixMicro(usedAt), unixMicro(expiresAt), nullString(clientIP), nullString(userAgent), id.Hex(),
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLSessionStore) ListActiveSessions(ctx context.Context, userId primitive.ObjectID, now time.Time) ([]model.Session, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_used_at DESC`),
+		userId.Hex(), unixMicro(now),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []model.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLSessionStore) RevokeSessions(ctx context.Context, userId primitive.ObjectID, sessionIds ...primitive.ObjectID) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Select the sessions first so their refresh tokens can be revoked in the same transaction.
+	where := `user_id = ? AND revoked_at IS NULL`
+	args := []any{userId.Hex()}
+	if len(sessionIds) > 0 {
+		where += ` AND id IN (?` + strings.Repeat(`, ?`, len(sessionIds)-1) + `)`
+		for _, id := range sessionIds {
+			args = append(args, id.Hex())
+		}
+	}
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(`SELECT id FROM sessions WHERE `+where), args...)
+	if err != nil {
+		return 0, err
+	}
+	var revokedIds []any
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		revokedIds = append(revokedIds, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(revokedIds) == 0 {
+		return 0, nil
+	}
+
+	now := unixMicro(time.Now())
+	in := `(?` + strings.Repeat(`, ?`, len(revokedIds)-1) + `)`
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(`UPDATE sessions SET revoked_at = ? WHERE id IN `+in), append([]any{now}, revokedIds...)...)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(`UPDATE refresh_tokens SET revoked_at = ? WHERE revoked_at IS NULL AND session_id IN `+in), append([]any{now}, revokedIds...)...)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(revokedIds)), nil
+}
+
+const refreshTokenColumns = `id, user_id, session_id, token_hash, created_at, expires_at, rotated_at, revoked_at`
+
+// scanRefreshToken reads a row selected with refreshTokenColumns.
+func scanRefreshToken(row interface{ Scan(...any) error }) (model.RefreshToken, error) {
+	var id, userId, sessionId, tokenHash string
+	var createdAt, expiresAt int64
+	var rotatedAt, revokedAt sql.NullInt64
+	if err := row.Scan(&id, &userId, &sessionId, &tokenHash, &createdAt, &expiresAt, &rotatedAt, &revokedAt); err != nil {
+		return model.RefreshToken{}, err
+	}
+	refreshToken := model.RefreshToken{
+		TokenHash: tokenHash,
+		CreatedAt: time.UnixMicro(createdAt).UTC(),
+		ExpiresAt: time.UnixMicro(expiresAt).UTC(),
+		RotatedAt: fromUnixMicro(rotatedAt),
+		RevokedAt: fromUnixMicro(revokedAt),
+	}
+	var err error
+	if refreshToken.Id, err = parseObjectID(id); err != nil {
+		return model.RefreshToken{}, err
+	}
+	if refreshToken.UserId, err = parseObjectID(userId); err != nil {
+		return model.RefreshToken{}, err
+	}
+	if refreshToken.SessionId, err = parseObjectID(sessionId); err != nil {
+		return model.RefreshToken{}, err
+	}
+	return refreshToken, nil
+}
+
+func (s *SQLSessionStore) CreateRefreshToken(ctx context.Context, refreshToken model.RefreshToken) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO refresh_tokens (`+refreshTokenColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		refreshToken.Id.Hex(),
+		refreshToken.UserId.Hex(),
+		refreshToken.SessionId.Hex(),
+		refreshToken.TokenHash,
+		unixMicro(refreshToken.CreatedAt),
+		unixMicro(refreshToken.ExpiresAt),
+		nullUnixMicro(refreshToken.RotatedAt),
+		nullUnixMicro(refreshToken.RevokedAt),
+	)
+	return err
+}
+
+func (s *SQLSessionStore) GetRefreshToken(ctx context.Context, tokenHash string) (model.RefreshToken, error) {
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`), tokenHash)
+	refreshToken, err := scanRefreshToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.RefreshToken{}, ErrNotFound
+	}
+	return refreshToken, err
+}
+
+func (s *SQLSessionStore) RotateRefreshToken(ctx context.Context, tokenHash string, now time.Time) (model.RefreshToken, error) {
+	// The conditions make the update atomic, so a token can only be rotated once even when two
+	// requests race with it.
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE refresh_tokens SET rotated_at = ?
+		WHERE token_hash = ? AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > ?`),
+		unixMicro(now), tokenHash, unixMicro(now),
+	)
+	if err != nil {
+		return model.RefreshToken{}, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return model.RefreshToken{}, err
+	}
+	if affected == 0 {
+		return model.RefreshToken{}, ErrNotFound
+	}
+	return s.GetRefreshToken(ctx, tokenHash)
+}
+
+func (s *SQLSessionStore) RecordIPFailure(ctx context.Context, ip string, now time.Time, window time.Duration) (int, error) {
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM ip_failures WHERE expires_at < ?`), unixMicro(now)); err != nil {
+		return 0, err
+	}
+	// Counting in the upsert itself makes concurrent failures all count.
+	var failures int
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(`INSERT INTO ip_failures (ip, failures, last_failure_at, expires_at)
+		VALUES (?, 1, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET
+			failures = CASE WHEN ip_failures.last_failure_at >= ? THEN ip_failures.failures + 1 ELSE 1 END,
+			last_failure_at = excluded.last_failure_at,
+			expires_at = CASE WHEN ip_failures.expires_at > excluded.expires_at THEN ip_failures.expires_at ELSE excluded.expires_at END
+		RETURNING failures`),
+		ip, unixMicro(now), unixMicro(now.Add(window)), unixMicro(now.Add(-window)),
+	).Scan(&failures)
+	return failures, err
+}
+
+func (s *SQLSessionStore) LockIP(ctx context.Context, ip string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO ip_failures (ip, failures, locked_until, expires_at)
+		VALUES (?, 0, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET
+			failures = 0,
+			locked_until = CASE WHEN ip_failures.locked_until > excluded.locked_until THEN ip_failures.locked_until ELSE excluded.locked_until END,
+			expires_at = CASE WHEN ip_failures.expires_at > excluded.expires_at THEN ip_failures.expires_at ELSE excluded.expires_at END`),
+		ip, unixMicro(until), unixMicro(until),
+	)
+	return err
+}
+
+func (s *SQLSessionStore) IPLockedUntil(ctx context.Context, ip string) (time.Time, error) {
+	var lockedUntil sql.NullInt64
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT locked_until FROM ip_failures WHERE ip = ?`), ip).Scan(&lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !lockedUntil.Valid) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return *fromUnixMicro(lockedUntil), nil
+}
+
+func (s *SQLSessionStore) UseChallenge(ctx context.Context, challenge string, expiresAt time.Time, now time.Time) (bool, error) {
+	if !expiresAt.After(now) {
+		return false, nil
+	}
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM used_challenges WHERE expires_at < ?`), unixMicro(now)); err != nil {
+		return false, err
+	}
+	// The primary key lets only one of concurrent uses insert the challenge.
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO used_challenges (challenge, expires_at) VALUES (?, ?)
+		ON CONFLICT (challenge) DO NOTHING`),
+		challenge, unixMicro(expiresAt),
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// SQLCredentialStore is a CredentialStore backed by a SQLite or PostgreSQL table.
+type SQLCredentialStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLCredentialStore creates a SQLCredentialStore on a database opened with OpenSQL.
+func NewSQLCredentialStore(db *sql.DB, dialect Dialect) *SQLCredentialStore {
+	return &SQLCredentialStore{db: db, dialect: dialect}
+}
+
+const credentialColumns = `id, user_id, credential_id, public_key, attestation_type, aaguid, sign_count, transports, backup_eligible, backup_state, created_at, last_used_at`
+
+// scanCredential reads a row selected with credentialColumns.
+func scanCredential(row interface{ Scan(...any) error }) (model.Credential, error) {
+	var id, userId, credentialId, publicKey string
+	var attestationType, aaguid, transports sql.NullString
+	var signCount, createdAt int64
+	var backupEligible, backupState bool
+	var lastUsedAt sql.NullInt64
+	if err := row.Scan(&id, &userId, &credentialId, &publicKey, &attestationType, &aaguid, &signCount, &transports, &backupEligible, &backupState, &createdAt, &lastUsedAt); err != nil {
+		return model.Credential{}, err
+	}
+	credential := model.Credential{
+		AttestationType: attestationType.String,
+		SignCount:       uint32(signCount),
+		Transports:      strings.Fields(transports.String),
+		BackupEligible:  backupEligible,
+		BackupState:     backupState,
+		CreatedAt:       time.UnixMicro(createdAt).UTC(),
+		LastUsedAt:      fromUnixMicro(lastUsedAt),
+	}
+	var err error
+	if credential.Id, err = parseObjectID(id); err != nil {
+		return model.Credential{}, err
+	}
+	if credential.UserId, err = parseObjectID(userId); err != nil {
+		return model.Credential{}, err
+	}
+	if credential.CredentialId, err = base64.RawURLEncoding.DecodeString(credentialId); err != nil {
+		return model.Credential{}, fmt.Errorf("invalid credential id %q: %w", credentialId, err)
+	}
+	if credential.PublicKey, err = base64.RawURLEncoding.DecodeString(publicKey); err != nil {
+		return model.Credential{}, fmt.Errorf("invalid public key of credential %s: %w", id, err)
+	}
+	if credential.AAGUID, err = base64.RawURLEncoding.DecodeString(aaguid.String); err != nil {
+		return model.Credential{}, fmt.Errorf("invalid AAGUID of credential %s: %w", id, err)
+	}
+	return credential, nil
+}
+
+func (s *SQLCredentialStore) CreateCredential(ctx context.Context, credential model.Credential) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO credentials (`+credentialColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		credential.Id.Hex(),
+		credential.UserId.Hex(),
+		base64.RawURLEncoding.EncodeToString(credential.CredentialId),
+		base64.RawURLEncoding.EncodeToString(credential.PublicKey),
+		nullString(credential.AttestationType),
+		nullString(base64.RawURLEncoding.EncodeToString(credential.AAGUID)),
+		int64(credential.SignCount),
+		nullString(strings.Join(credential.Transports, " ")),
+		credential.BackupEligible,
+		credential.BackupState,
+		unixMicro(credential.CreatedAt),
+		nullUnixMicro(credential.LastUsedAt),
+	)
+	return sqlDuplicateError(err)
+}
+
+func (s *SQLCredentialStore) ListCredentials(ctx context.Context, userId primitive.ObjectID) ([]model.Credential, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`SELECT `+credentialColumns+` FROM credentials WHERE user_id = ? ORDER BY id`), userId.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var credentials []model.Credential
+	for rows.Next() {
+		credential, err := scanCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (s *SQLCredentialStore) UseCredential(ctx context.Context, id primitive.ObjectID, signCount uint32, backupState bool, usedAt time.Time) error {
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE credentials
+		SET sign_count = ?, backup_state = ?, last_used_at = ?
+		WHERE id = ?`),
+		int64(signCount), backupState, unixMicro(usedAt), id.Hex(),
+	)
+	return sqlRowAffected(result, err)
+}
+
+func (s *SQLCredentialStore) DeleteCredentials(ctx context.Context, userId primitive.ObjectID) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM credentials WHERE user_id = ?`), userId.Hex())
+	return err
+}
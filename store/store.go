@@ -0,0 +1,175 @@
+// Package store defines how the user service persists users and login sessions, with MongoDB,
+// SQLite, PostgreSQL and in-memory implementations.
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"rahulchhabra.io/model"
+)
+
+// ErrNotFound is returned when the requested record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// DuplicateError is returned when a write would give two users the same email or username, or
+// register the same WebAuthn credential twice.
+type DuplicateError struct {
+	// Field is "email", "username" or "credential".
+	Field string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("a user with this %s already exists", e.Field)
+}
+
+// UserStore persists users. Emails and usernames are unique regardless of case, and lookups by
+// email or username ignore case as well. Looking up an empty email or username finds nobody.
+// Every method given the id of a user that does not exist returns ErrNotFound.
+type UserStore interface {
+	// Create stores a new user, assigning it an id when it has none.
+	Create(ctx context.Context, user *model.User) error
+	GetByID(ctx context.Context, id primitive.ObjectID) (model.User, error)
+	GetByEmail(ctx context.Context, email string) (model.User, error)
+	GetByUsername(ctx context.Context, username string) (model.User, error)
+	// Update applies the non-nil fields of update and returns the updated user.
+	Update(ctx context.Context, id primitive.ObjectID, update UserUpdate) (model.User, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// List returns the users matching the options ordered by id.
+	List(ctx context.Context, options ListOptions) ([]model.User, error)
+	// Count returns the (possibly estimated) number of users matching filter.
+	Count(ctx context.Context, filter UserFilter) (int64, error)
+
+	// RecordFailedLogin counts a failed login at now and returns the number of failed logins in a
+	// row. The count starts over when the previous failure was more than window before now.
+	RecordFailedLogin(ctx context.Context, id primitive.ObjectID, now time.Time, window time.Duration) (int, error)
+	// LockUntil refuses logins to the user until the given time. An existing longer lock is kept.
+	LockUntil(ctx context.Context, id primitive.ObjectID, until time.Time) error
+	// ResetFailedLogins forgets the failed logins of the user and lifts any lock.
+	ResetFailedLogins(ctx context.Context, id primitive.ObjectID) error
+
+	// SetPendingTOTP stores the encrypted secret of a TOTP enrollment until it is confirmed,
+	// replacing any earlier unconfirmed one.
+	SetPendingTOTP(ctx context.Context, id primitive.ObjectID, secret string) error
+	// EnableTOTP makes the pending secret the TOTP secret of the user, the code of step having
+	// confirmed it. It returns ErrNotFound when secret is no longer the pending one.
+	EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, step int64) error
+	// UseTOTPStep records that a code of step was accepted, and reports false when a code of that
+	// or a later step was accepted before.
+	UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) (bool, error)
+	// SetRecoveryCodes replaces the recovery code hashes of the user.
+	SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, hashes []string) error
+	// UseRecoveryCode removes one recovery code hash of the user, and reports false when it was
+	// already gone because the code was used.
+	UseRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) (bool, error)
+
+	// MarkEmailVerified records that the user verified email. It returns ErrNotFound when email is
+	// no longer the email address of the user.
+	MarkEmailVerified(ctx context.Context, id primitive.ObjectID, email string) error
+	// ReplacePassword changes the password hash of the user from current to replacement. It returns
+	// ErrNotFound when current is no longer the hash of the user.
+	ReplacePassword(ctx context.Context, id primitive.ObjectID, current string, replacement string) error
+}
+
+// UserUpdate lists the fields to change. A nil field is left alone, a pointer to an empty string
+// clears the field.
+type UserUpdate struct {
+	FirstName *string
+	LastName  *string
+	Email     *string
+	Username  *string
+	Password  *string
+	Status    *string
+	// EmailVerified is usually cleared along with a change of Email.
+	EmailVerified *bool
+}
+
+// UserFilter selects users. Zero fields do not filter.
+type UserFilter struct {
+	// EmailDomain matches users whose email address is in the domain, ignoring case.
+	EmailDomain string
+	// UsernamePrefix matches users whose username starts with the prefix.
+	UsernamePrefix string
+	// CreatedAfter and CreatedBefore bound the creation time, taken from the id, as [after, before).
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Status matches the account status. Users without a status count as model.UserStatusActive.
+	Status string
+}
+
+// firstIDAt returns the smallest ObjectID created in the second of t. Unlike
+// primitive.NewObjectIDFromTimestamp, which fills the rest of the id with a counter, it sorts before
+// every id created in that second, so it can bound a creation time range.
+func firstIDAt(t time.Time) primitive.ObjectID {
+	var id primitive.ObjectID
+	binary.BigEndian.PutUint32(id[0:4], uint32(t.Unix()))
+	return id
+}
+
+// IsEmpty reports whether the filter matches every user.
+func (f UserFilter) IsEmpty() bool {
+	return f == UserFilter{}
+}
+
+// ListOptions control a List call.
+type ListOptions struct {
+	Filter UserFilter
+	// After skips every user up to and including this id, in the direction of the listing.
+	After primitive.ObjectID
+	// Descending lists the newest users first.
+	Descending bool
+	Limit      int64
+}
+
+// SessionStore persists login sessions and their refresh tokens, and what protects logins across
+// every replica of the service: the failed logins per source IP and the used single use challenges.
+type SessionStore interface {
+	CreateSession(ctx context.Context, session model.Session) error
+	GetSession(ctx context.Context, id primitive.ObjectID) (model.Session, error)
+	// TouchSession records a use of a session that has not been revoked and extends it until
+	// expiresAt. It returns ErrNotFound when the session is unknown or revoked.
+	TouchSession(ctx context.Context, id primitive.ObjectID, usedAt time.Time, expiresAt time.Time, clientIP string, userAgent string) error
+	// ListActiveSessions returns the sessions of the user that are neither revoked nor expired at
+	// now, most recently used first.
+	ListActiveSessions(ctx context.Context, userId primitive.ObjectID, now time.Time) ([]model.Session, error)
+	// RevokeSessions revokes the given sessions of the user, or all of them when no id is given,
+	// together with their refresh tokens. It returns the number of sessions revoked.
+	RevokeSessions(ctx context.Context, userId primitive.ObjectID, sessionIds ...primitive.ObjectID) (int64, error)
+
+	CreateRefreshToken(ctx context.Context, refreshToken model.RefreshToken) error
+	GetRefreshToken(ctx context.Context, tokenHash string) (model.RefreshToken, error)
+	// RotateRefreshToken atomically marks the refresh token as used, provided it has not been
+	// rotated, revoked or expired at now. Otherwise it returns ErrNotFound.
+	RotateRefreshToken(ctx context.Context, tokenHash string, now time.Time) (model.RefreshToken, error)
+
+	// RecordIPFailure counts a failed login from the source IP at now and returns the number of
+	// failed logins from it in a row. The count starts over when the previous failure was more than
+	// window before now.
+	RecordIPFailure(ctx context.Context, ip string, now time.Time, window time.Duration) (int, error)
+	// LockIP refuses logins from the source IP until the given time and starts its count over. An
+	// existing longer lock is kept.
+	LockIP(ctx context.Context, ip string, until time.Time) error
+	// IPLockedUntil returns until when logins from the source IP are refused, the zero time when
+	// they are not.
+	IPLockedUntil(ctx context.Context, ip string) (time.Time, error)
+
+	// UseChallenge records that a single use challenge was used at now, and reports false when it
+	// was used before or expired at expiresAt. It is only remembered until it expires.
+	UseChallenge(ctx context.Context, challenge string, expiresAt time.Time, now time.Time) (bool, error)
+}
+
+// CredentialStore persists the WebAuthn credentials of users. Credential ids are unique.
+type CredentialStore interface {
+	CreateCredential(ctx context.Context, credential model.Credential) error
+	// ListCredentials returns the credentials of the user, oldest first.
+	ListCredentials(ctx context.Context, userId primitive.ObjectID) ([]model.Credential, error)
+	// UseCredential records a login with the credential at usedAt, and the sign count and backup
+	// state the authenticator reported.
+	UseCredential(ctx context.Context, id primitive.ObjectID, signCount uint32, backupState bool, usedAt time.Time) error
+	// DeleteCredentials removes every credential of the user.
+	DeleteCredentials(ctx context.Context, userId primitive.ObjectID) error
+}
@@ -0,0 +1,147 @@
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"rahulchhabra.io/model"
+	"rahulchhabra.io/store"
+)
+
+// TestCredentialStore runs the suite of credential stores. newStore must return an empty store
+// every time it is called.
+func TestCredentialStore(t *testing.T, newStore func(t *testing.T) store.CredentialStore) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, credentials store.CredentialStore)
+	}{
+		{"CreateAndList", testCreateAndListCredentials},
+		{"Duplicates", testDuplicateCredentials},
+		{"Use", testUseCredential},
+		{"Delete", testDeleteCredentials},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newStore(t))
+		})
+	}
+}
+
+// createCredential stores a credential of the user with the given credential id, created at the
+// i-th hour of createdAt.
+func createCredential(t *testing.T, credentials store.CredentialStore, userId primitive.ObjectID, credentialId string, i int) model.Credential {
+	t.Helper()
+	credential := model.Credential{
+		Id:              primitive.NewObjectIDFromTimestamp(createdAt(i)),
+		UserId:          userId,
+		CredentialId:    []byte(credentialId),
+		PublicKey:       []byte("public key of " + credentialId),
+		AttestationType: "none",
+		AAGUID:          bytes.Repeat([]byte{byte(i)}, 16),
+		SignCount:       uint32(i),
+		Transports:      []string{"internal", "hybrid"},
+		BackupEligible:  true,
+		CreatedAt:       createdAt(i),
+	}
+	if err := credentials.CreateCredential(context.Background(), credential); err != nil {
+		t.Fatalf("CreateCredential %s: %s", credentialId, err)
+	}
+	return credential
+}
+
+// credentialIds returns the credential ids of credentials in order.
+func credentialIds(credentials []model.Credential) []string {
+	ids := make([]string, 0, len(credentials))
+	for _, credential := range credentials {
+		ids = append(ids, string(credential.CredentialId))
+	}
+	return ids
+}
+
+func testCreateAndListCredentials(t *testing.T, credentials store.CredentialStore) {
+	ctx := context.Background()
+	ada, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	// Created out of order, listed oldest first.
+	newer := createCredential(t, credentials, ada, "newer", 2)
+	older := createCredential(t, credentials, ada, "older", 1)
+	createCredential(t, credentials, bob, "bob", 0)
+
+	list, err := credentials.ListCredentials(ctx, ada)
+	if err != nil {
+		t.Fatalf("ListCredentials: %s", err)
+	}
+	if got := credentialIds(list); !equal(got, []string{"older", "newer"}) {
+		t.Fatalf("ListCredentials: got %v, want [older newer]", got)
+	}
+	for i, want := range []model.Credential{older, newer} {
+		got := list[i]
+		if got.Id != want.Id || got.UserId != want.UserId || !bytes.Equal(got.PublicKey, want.PublicKey) ||
+			got.AttestationType != want.AttestationType || !bytes.Equal(got.AAGUID, want.AAGUID) ||
+			got.SignCount != want.SignCount || !equal(got.Transports, want.Transports) ||
+			got.BackupEligible != want.BackupEligible || got.BackupState != want.BackupState ||
+			!got.CreatedAt.Equal(want.CreatedAt) || got.LastUsedAt != nil {
+			t.Errorf("ListCredentials: got %+v, want %+v", got, want)
+		}
+	}
+	if list, err := credentials.ListCredentials(ctx, primitive.NewObjectID()); err != nil || len(list) != 0 {
+		t.Errorf("ListCredentials of nobody: got %v, %v", list, err)
+	}
+}
+
+func testDuplicateCredentials(t *testing.T, credentials store.CredentialStore) {
+	ctx := context.Background()
+	ada := primitive.NewObjectID()
+	createCredential(t, credentials, ada, "passkey", 0)
+
+	// Not even another user can register a credential id again.
+	again := model.Credential{Id: primitive.NewObjectID(), UserId: primitive.NewObjectID(), CredentialId: []byte("passkey"), PublicKey: []byte("key")}
+	wantDuplicate(t, credentials.CreateCredential(ctx, again), "credential")
+	if list, err := credentials.ListCredentials(ctx, again.UserId); err != nil || len(list) != 0 {
+		t.Errorf("ListCredentials after a refused duplicate: got %v, %v", list, err)
+	}
+}
+
+func testUseCredential(t *testing.T, credentials store.CredentialStore) {
+	ctx := context.Background()
+	ada := primitive.NewObjectID()
+	credential := createCredential(t, credentials, ada, "passkey", 3)
+
+	usedAt := now()
+	if err := credentials.UseCredential(ctx, credential.Id, 7, true, usedAt); err != nil {
+		t.Fatalf("UseCredential: %s", err)
+	}
+	list, err := credentials.ListCredentials(ctx, ada)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("ListCredentials: got %v, %v", list, err)
+	}
+	if got := list[0]; got.SignCount != 7 || !got.BackupState || got.LastUsedAt == nil || !got.LastUsedAt.Equal(usedAt) {
+		t.Errorf("after UseCredential: got sign count %d, backup state %v, last used at %v", got.SignCount, got.BackupState, got.LastUsedAt)
+	}
+	wantNotFound(t, credentials.UseCredential(ctx, primitive.NewObjectID(), 1, false, usedAt))
+}
+
+func testDeleteCredentials(t *testing.T, credentials store.CredentialStore) {
+	ctx := context.Background()
+	ada, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	createCredential(t, credentials, ada, "ada-1", 0)
+	createCredential(t, credentials, ada, "ada-2", 1)
+	createCredential(t, credentials, bob, "bob", 2)
+
+	if err := credentials.DeleteCredentials(ctx, ada); err != nil {
+		t.Fatalf("DeleteCredentials: %s", err)
+	}
+	if list, err := credentials.ListCredentials(ctx, ada); err != nil || len(list) != 0 {
+		t.Errorf("ListCredentials after DeleteCredentials: got %v, %v", list, err)
+	}
+	if list, err := credentials.ListCredentials(ctx, bob); err != nil || !equal(credentialIds(list), []string{"bob"}) {
+		t.Errorf("ListCredentials of another user: got %v, %v", list, err)
+	}
+	// Deleting the credentials of a user without any is not an error.
+	if err := credentials.DeleteCredentials(ctx, ada); err != nil {
+		t.Errorf("DeleteCredentials without credentials: %s", err)
+	}
+	// The credential ids are free again.
+	createCredential(t, credentials, bob, "ada-1", 3)
+}
@@ -0,0 +1,314 @@
+package storetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"rahulchhabra.io/model"
+	"rahulchhabra.io/store"
+)
+
+// TestSessionStore runs the suite of session stores. newStore must return an empty store every
+// time it is called.
+func TestSessionStore(t *testing.T, newStore func(t *testing.T) store.SessionStore) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, sessions store.SessionStore)
+	}{
+		{"CreateAndGet", testCreateAndGetSession},
+		{"Touch", testTouchSession},
+		{"ListActive", testListActiveSessions},
+		{"Revoke", testRevokeSessions},
+		{"RefreshTokens", testRefreshTokens},
+		{"IPFailures", testIPFailures},
+		{"Challenges", testChallenges},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newStore(t))
+		})
+	}
+}
+
+// createSession stores a session of the user last used at usedAt and expiring a day later.
+func createSession(t *testing.T, sessions store.SessionStore, userId primitive.ObjectID, usedAt time.Time) model.Session {
+	t.Helper()
+	session := model.Session{
+		Id:         primitive.NewObjectID(),
+		UserId:     userId,
+		CreatedAt:  usedAt,
+		LastUsedAt: usedAt,
+		ExpiresAt:  usedAt.Add(24 * time.Hour),
+		ClientIP:   "192.0.2.1",
+		UserAgent:  "storetest",
+	}
+	if err := sessions.CreateSession(context.Background(), session); err != nil {
+		t.Fatalf("CreateSession: %s", err)
+	}
+	return session
+}
+
+// createRefreshToken stores a refresh token of the session expiring a day after now.
+func createRefreshToken(t *testing.T, sessions store.SessionStore, session model.Session, hash string, now time.Time) model.RefreshToken {
+	t.Helper()
+	refreshToken := model.RefreshToken{
+		Id:        primitive.NewObjectID(),
+		UserId:    session.UserId,
+		SessionId: session.Id,
+		TokenHash: hash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(24 * time.Hour),
+	}
+	if err := sessions.CreateRefreshToken(context.Background(), refreshToken); err != nil {
+		t.Fatalf("CreateRefreshToken: %s", err)
+	}
+	return refreshToken
+}
+
+// sessionIds returns the ids of sessions in order.
+func sessionIds(sessions []model.Session) []string {
+	ids := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		ids = append(ids, session.Id.Hex())
+	}
+	return ids
+}
+
+// now returns the current time at the precision every backend keeps.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+func testCreateAndGetSession(t *testing.T, sessions store.SessionStore) {
+	ctx := context.Background()
+	session := createSession(t, sessions, primitive.NewObjectID(), now())
+
+	got, err := sessions.GetSession(ctx, session.Id)
+	if err != nil {
+		t.Fatalf("GetSession: %s", err)
+	}
+	if got.Id != session.Id || got.UserId != session.UserId || !got.CreatedAt.Equal(session.CreatedAt) ||
+		!got.LastUsedAt.Equal(session.LastUsedAt) || !got.ExpiresAt.Equal(session.ExpiresAt) ||
+		got.ClientIP != session.ClientIP || got.UserAgent != session.UserAgent || got.RevokedAt != nil {
+		t.Errorf("GetSession: got %+v, want %+v", got, session)
+	}
+	_, err = sessions.GetSession(ctx, primitive.NewObjectID())
+	wantNotFound(t, err)
+}
+
+func testTouchSession(t *testing.T, sessions store.SessionStore) {
+	ctx := context.Background()
+	start := now()
+	session := createSession(t, sessions, primitive.NewObjectID(), start)
+
+	usedAt, expiresAt := start.Add(time.Minute), start.Add(48*time.Hour)
+	if err := sessions.TouchSession(ctx, session.Id, usedAt, expiresAt, "198.51.100.7", "other agent"); err != nil {
+		t.Fatalf("TouchSession: %s", err)
+	}
+	got, err := sessions.GetSession(ctx, session.Id)
+	if err != nil {
+		t.Fatalf("GetSession: %s", err)
+	}
+	if !got.LastUsedAt.Equal(usedAt) || !got.ExpiresAt.Equal(expiresAt) || got.ClientIP != "198.51.100.7" || got.UserAgent != "other agent" {
+		t.Errorf("after TouchSession: got %+v", got)
+	}
+
+	wantNotFound(t, sessions.TouchSession(ctx, primitive.NewObjectID(), usedAt, expiresAt, "", ""))
+	if _, err := sessions.RevokeSessions(ctx, session.UserId, session.Id); err != nil {
+		t.Fatalf("RevokeSessions: %s", err)
+	}
+	// A revoked session cannot be brought back by using it.
+	wantNotFound(t, sessions.TouchSession(ctx, session.Id, usedAt, expiresAt, "", ""))
+}
+
+func testListActiveSessions(t *testing.T, sessions store.SessionStore) {
+	ctx := context.Background()
+	start := now()
+	ada, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	older := createSession(t, sessions, ada, start.Add(-time.Hour))
+	newer := createSession(t, sessions, ada, start)
+	revoked := createSession(t, sessions, ada, start)
+	expired := createSession(t, sessions, ada, start.Add(-48*time.Hour))
+	createSession(t, sessions, bob, start)
+	if _, err := sessions.RevokeSessions(ctx, ada, revoked.Id); err != nil {
+		t.Fatalf("RevokeSessions: %s", err)
+	}
+
+	active, err := sessions.ListActiveSessions(ctx, ada, start)
+	if err != nil {
+		t.Fatalf("ListActiveSessions: %s", err)
+	}
+	if got, want := sessionIds(active), sessionIds([]model.Session{newer, older}); !equal(got, want) {
+		t.Errorf("ListActiveSessions: got %v, want %v without revoked %s and expired %s", got, want, revoked.Id.Hex(), expired.Id.Hex())
+	}
+	if active, err := sessions.ListActiveSessions(ctx, primitive.NewObjectID(), start); err != nil || len(active) != 0 {
+		t.Errorf("ListActiveSessions of nobody: got %v, %v", active, err)
+	}
+}
+
+func testRevokeSessions(t *testing.T, sessions store.SessionStore) {
+	ctx := context.Background()
+	start := now()
+	ada, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	phone := createSession(t, sessions, ada, start)
+	laptop := createSession(t, sessions, ada, start)
+	tablet := createSession(t, sessions, ada, start)
+	bobs := createSession(t, sessions, bob, start)
+	createRefreshToken(t, sessions, phone, "phone", start)
+	createRefreshToken(t, sessions, laptop, "laptop", start)
+	createRefreshToken(t, sessions, bobs, "bob", start)
+
+	// Nobody can revoke the sessions of another user.
+	if revoked, err := sessions.RevokeSessions(ctx, ada, bobs.Id); err != nil || revoked != 0 {
+		t.Errorf("RevokeSessions of a session of another user: got %d, %v, want 0", revoked, err)
+	}
+	if revoked, err := sessions.RevokeSessions(ctx, ada, phone.Id); err != nil || revoked != 1 {
+		t.Errorf("RevokeSessions of one session: got %d, %v, want 1", revoked, err)
+	}
+	if got, err := sessions.GetSession(ctx, phone.Id); err != nil || got.RevokedAt == nil {
+		t.Errorf("revoked session: got %+v, %v", got, err)
+	}
+	if got, err := sessions.GetRefreshToken(ctx, "phone"); err != nil || got.RevokedAt == nil {
+		t.Errorf("refresh token of the revoked session: got %+v, %v", got, err)
+	}
+	_, err := sessions.RotateRefreshToken(ctx, "phone", start)
+	wantNotFound(t, err)
+	if revoked, err := sessions.RevokeSessions(ctx, ada, phone.Id); err != nil || revoked != 0 {
+		t.Errorf("RevokeSessions of a revoked session: got %d, %v, want 0", revoked, err)
+	}
+
+	// Without ids every remaining session of the user is revoked.
+	if revoked, err := sessions.RevokeSessions(ctx, ada); err != nil || revoked != 2 {
+		t.Errorf("RevokeSessions of all sessions: got %d, %v, want 2", revoked, err)
+	}
+	for _, session := range []model.Session{laptop, tablet} {
+		if got, err := sessions.GetSession(ctx, session.Id); err != nil || got.RevokedAt == nil {
+			t.Errorf("session after RevokeSessions of all: got %+v, %v", got, err)
+		}
+	}
+	_, err = sessions.RotateRefreshToken(ctx, "laptop", start)
+	wantNotFound(t, err)
+
+	if got, err := sessions.GetSession(ctx, bobs.Id); err != nil || got.RevokedAt != nil {
+		t.Errorf("session of another user: got %+v, %v", got, err)
+	}
+	if _, err := sessions.RotateRefreshToken(ctx, "bob", start); err != nil {
+		t.Errorf("RotateRefreshToken of another user: %s", err)
+	}
+}
+
+func testRefreshTokens(t *testing.T, sessions store.SessionStore) {
+	ctx := context.Background()
+	start := now()
+	session := createSession(t, sessions, primitive.NewObjectID(), start)
+	refreshToken := createRefreshToken(t, sessions, session, "current", start)
+
+	got, err := sessions.GetRefreshToken(ctx, "current")
+	if err != nil {
+		t.Fatalf("GetRefreshToken: %s", err)
+	}
+	if got.Id != refreshToken.Id || got.UserId != refreshToken.UserId || got.SessionId != refreshToken.SessionId ||
+		!got.CreatedAt.Equal(refreshToken.CreatedAt) || !got.ExpiresAt.Equal(refreshToken.ExpiresAt) ||
+		got.RotatedAt != nil || got.RevokedAt != nil {
+		t.Errorf("GetRefreshToken: got %+v, want %+v", got, refreshToken)
+	}
+	_, err = sessions.GetRefreshToken(ctx, "missing")
+	wantNotFound(t, err)
+
+	// A refresh token is rotated once.
+	rotated, err := sessions.RotateRefreshToken(ctx, "current", start.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("RotateRefreshToken: %s", err)
+	}
+	if rotated.Id != refreshToken.Id || rotated.SessionId != session.Id {
+		t.Errorf("RotateRefreshToken returned %+v, want %+v", rotated, refreshToken)
+	}
+	_, err = sessions.RotateRefreshToken(ctx, "current", start.Add(time.Minute))
+	wantNotFound(t, err)
+	if got, err := sessions.GetRefreshToken(ctx, "current"); err != nil || got.RotatedAt == nil {
+		t.Errorf("rotated refresh token: got %+v, %v", got, err)
+	}
+
+	createRefreshToken(t, sessions, session, "expiring", start)
+	_, err = sessions.RotateRefreshToken(ctx, "expiring", start.Add(24*time.Hour))
+	wantNotFound(t, err)
+	_, err = sessions.RotateRefreshToken(ctx, "missing", start)
+	wantNotFound(t, err)
+}
+
+func testIPFailures(t *testing.T, sessions store.SessionStore) {
+	ctx := context.Background()
+	start := now()
+	const ip, other = "192.0.2.1", "2001:db8::1"
+
+	if until, err := sessions.IPLockedUntil(ctx, ip); err != nil || !until.IsZero() {
+		t.Errorf("IPLockedUntil of an unknown IP: got %v, %v, want the zero time", until, err)
+	}
+	for want := 1; want <= 3; want++ {
+		got, err := sessions.RecordIPFailure(ctx, ip, start, time.Hour)
+		if err != nil || got != want {
+			t.Fatalf("RecordIPFailure: got %d, %v, want %d", got, err, want)
+		}
+	}
+	if got, err := sessions.RecordIPFailure(ctx, other, start, time.Hour); err != nil || got != 1 {
+		t.Errorf("RecordIPFailure of another IP: got %d, %v, want 1", got, err)
+	}
+	// A failure long after the previous one starts counting again.
+	if got, err := sessions.RecordIPFailure(ctx, ip, start.Add(30*time.Minute), time.Minute); err != nil || got != 1 {
+		t.Errorf("RecordIPFailure after the window: got %d, %v, want 1", got, err)
+	}
+
+	// A shorter lock does not replace a longer one, and a lock starts the count over.
+	if err := sessions.LockIP(ctx, ip, start.Add(time.Hour)); err != nil {
+		t.Fatalf("LockIP: %s", err)
+	}
+	if err := sessions.LockIP(ctx, ip, start.Add(time.Minute)); err != nil {
+		t.Fatalf("LockIP: %s", err)
+	}
+	if until, err := sessions.IPLockedUntil(ctx, ip); err != nil || !until.Equal(start.Add(time.Hour)) {
+		t.Errorf("IPLockedUntil: got %v, %v, want %v", until, err, start.Add(time.Hour))
+	}
+	if got, err := sessions.RecordIPFailure(ctx, ip, start.Add(30*time.Minute), time.Hour); err != nil || got != 1 {
+		t.Errorf("RecordIPFailure after LockIP: got %d, %v, want 1", got, err)
+	}
+	if until, err := sessions.IPLockedUntil(ctx, other); err != nil || !until.IsZero() {
+		t.Errorf("IPLockedUntil of another IP: got %v, %v, want the zero time", until, err)
+	}
+
+	// An IP that was never seen can be locked.
+	if err := sessions.LockIP(ctx, "198.51.100.7", start.Add(time.Hour)); err != nil {
+		t.Fatalf("LockIP of a new IP: %s", err)
+	}
+	if until, err := sessions.IPLockedUntil(ctx, "198.51.100.7"); err != nil || !until.Equal(start.Add(time.Hour)) {
+		t.Errorf("IPLockedUntil of a new IP: got %v, %v, want %v", until, err, start.Add(time.Hour))
+	}
+}
+
+func testChallenges(t *testing.T, sessions store.SessionStore) {
+	ctx := context.Background()
+	start := now()
+	expiresAt := start.Add(5 * time.Minute)
+
+	for _, use := range []struct {
+		challenge string
+		expiresAt time.Time
+		now       time.Time
+		want      bool
+	}{
+		{"login:first", expiresAt, start, true},
+		{"login:first", expiresAt, start.Add(time.Minute), false},
+		{"login:second", expiresAt, start, true},
+		// The same challenge of another purpose is another challenge.
+		{"passkey:first", expiresAt, start, true},
+		{"login:expired", start, start, false},
+		{"login:expired", start.Add(-time.Minute), start, false},
+		// Forgetting expired challenges does not let them be used again.
+		{"login:first", expiresAt, expiresAt.Add(time.Minute), false},
+	} {
+		if ok, err := sessions.UseChallenge(ctx, use.challenge, use.expiresAt, use.now); err != nil || ok != use.want {
+			t.Errorf("UseChallenge(%q) at %v: got %v, %v, want %v", use.challenge, use.now, ok, err, use.want)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+// Package storetest is the conformance suite of the store backends. Every backend runs it from its
+// own tests, so they all agree on uniqueness, lookups, ErrNotFound, paging and which conditional
+// writes of users, sessions, refresh tokens, challenges and credentials succeed.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"rahulchhabra.io/model"
+	"rahulchhabra.io/store"
+)
+
+// TestUserStore runs the suite of user stores. newStore must return an empty store every time it is called.
+func TestUserStore(t *testing.T, newStore func(t *testing.T) store.UserStore) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, users store.UserStore)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"Duplicates", testDuplicates},
+		{"NotFound", testNotFound},
+		{"Update", testUpdate},
+		{"Delete", testDelete},
+		{"ListPages", testListPages},
+		{"ListFilters", testListFilters},
+		{"FailedLogins", testFailedLogins},
+		{"ConditionalWrites", testConditionalWrites},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newStore(t))
+		})
+	}
+}
+
+// createdAt is the creation time of the i-th user created by createUsers.
+func createdAt(i int) time.Time {
+	return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Hour)
+}
+
+// createUsers stores users named by usernames, created an hour apart in that order.
+func createUsers(t *testing.T, users store.UserStore, usernames ...string) []model.User {
+	t.Helper()
+	created := make([]model.User, 0, len(usernames))
+	for i, username := range usernames {
+		user := model.User{
+			Id:       primitive.NewObjectIDFromTimestamp(createdAt(i)),
+			Email:    username + "@example.com",
+			Username: username,
+			Password: "hash-of-" + username,
+			Status:   model.UserStatusActive,
+		}
+		if err := users.Create(context.Background(), &user); err != nil {
+			t.Fatalf("Create %s: %s", username, err)
+		}
+		created = append(created, user)
+	}
+	return created
+}
+
+// wantDuplicate fails the test unless err is a DuplicateError on field.
+func wantDuplicate(t *testing.T, err error, field string) {
+	t.Helper()
+	var duplicate *store.DuplicateError
+	if !errors.As(err, &duplicate) || duplicate.Field != field {
+		t.Errorf("got %v, want a duplicate %s", err, field)
+	}
+}
+
+// wantNotFound fails the test unless err is ErrNotFound.
+func wantNotFound(t *testing.T, err error) {
+	t.Helper()
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
+
+// usernames returns the usernames of users in order.
+func usernames(users []model.User) []string {
+	names := make([]string, 0, len(users))
+	for _, user := range users {
+		names = append(names, user.Username)
+	}
+	return names
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testCreateAndGet(t *testing.T, users store.UserStore) {
+	ctx := context.Background()
+	user := model.User{
+		FirstName: "Ada",
+		LastName:  "Lovelace",
+		Email:     "Ada@Example.com",
+		Username:  "Ada",
+		Password:  "hash",
+		Status:    model.UserStatusActive,
+	}
+	if err := users.Create(ctx, &user); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	if user.Id.IsZero() {
+		t.Fatal("Create did not assign an id")
+	}
+
+	for name, get := range map[string]func() (model.User, error){
+		"id":       func() (model.User, error) { return users.GetByID(ctx, user.Id) },
+		"email":    func() (model.User, error) { return users.GetByEmail(ctx, "ada@example.COM") },
+		"username": func() (model.User, error) { return users.GetByUsername(ctx, "ADA") },
+	} {
+		got, err := get()
+		if err != nil {
+			t.Errorf("get by %s: %s", name, err)
+			continue
+		}
+		if got.Id != user.Id || got.Email != user.Email || got.Username != user.Username ||
+			got.FirstName != user.FirstName || got.LastName != user.LastName || got.Password != user.Password {
+			t.Errorf("get by %s: got %+v, want %+v", name, got, user)
+		}
+	}
+}
+
+func testDuplicates(t *testing.T, users store.UserStore) {
+	ctx := context.Background()
+	createUsers(t, users, "ada")
+
+	sameEmail := model.User{Email: "ADA@example.com", Username: "other"}
+	wantDuplicate(t, users.Create(ctx, &sameEmail), "email")
+	sameUsername := model.User{Email: "other@example.com", Username: "ADA"}
+	wantDuplicate(t, users.Create(ctx, &sameUsername), "username")
+
+	if count, err := users.Count(ctx, store.UserFilter{}); err != nil || count != 1 {
+		t.Errorf("Count after refused duplicates: got %d, %v, want 1", count, err)
+	}
+}
+
+func testNotFound(t *testing.T, users store.UserStore) {
+	ctx := context.Background()
+	createUsers(t, users, "ada")
+	missing := primitive.NewObjectID()
+
+	_, err := users.GetByID(ctx, missing)
+	wantNotFound(t, err)
+	_, err = users.GetByEmail(ctx, "nobody@example.com")
+	wantNotFound(t, err)
+	_, err = users.GetByUsername(ctx, "nobody")
+	wantNotFound(t, err)
+	// Empty values must never match, whatever users exist.
+	_, err = users.GetByID(ctx, primitive.NilObjectID)
+	wantNotFound(t, err)
+	_, err = users.GetByEmail(ctx, "")
+	wantNotFound(t, err)
+	_, err = users.GetByUsername(ctx, "")
+	wantNotFound(t, err)
+
+	firstName := "Nobody"
+	_, err = users.Update(ctx, missing, store.UserUpdate{FirstName: &firstName})
+	wantNotFound(t, err)
+	wantNotFound(t, users.Delete(ctx, missing))
+	wantNotFound(t, users.Delete(ctx, primitive.NilObjectID))
+	wantNotFound(t, users.ResetFailedLogins(ctx, missing))
+	wantNotFound(t, users.MarkEmailVerified(ctx, missing, "nobody@example.com"))
+	wantNotFound(t, users.ReplacePassword(ctx, missing, "old", "new"))
+	_, err = users.RecordFailedLogin(ctx, missing, time.Now(), time.Hour)
+	wantNotFound(t, err)
+	wantNotFound(t, users.LockUntil(ctx, missing, time.Now()))
+	wantNotFound(t, users.SetPendingTOTP(ctx, missing, "pending"))
+	wantNotFound(t, users.EnableTOTP(ctx, missing, "pending", 1))
+	wantNotFound(t, users.SetRecoveryCodes(ctx, missing, []string{"a"}))
+	// A missing user is not mistaken for a used step or code.
+	_, err = users.UseTOTPStep(ctx, missing, 1)
+	wantNotFound(t, err)
+	_, err = users.UseRecoveryCode(ctx, missing, "a")
+	wantNotFound(t, err)
+}
+
+func testUpdate(t *testing.T, users store.UserStore) {
+	ctx := context.Background()
+	created := createUsers(t, users, "ada", "bob")
+	ada, bob := created[0], created[1]
+
+	firstName, email := "Ada", "ada@example.org"
+	updated, err := users.Update(ctx, ada.Id, store.UserUpdate{FirstName: &firstName, Email: &email})
+	if err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+	if updated.FirstName != firstName || updated.Email != email || updated.Username != ada.Username {
+		t.Errorf("Update returned %+v", updated)
+	}
+	if _, err := users.GetByEmail(ctx, email); err != nil {
+		t.Errorf("GetByEmail with the new address: %s", err)
+	}
+	_, err = users.GetByEmail(ctx, ada.Email)
+	wantNotFound(t, err)
+
+	// Nobody can take over the email or username of another user.
+	takenEmail, takenUsername := "BOB@example.com", "Bob"
+	_, err = users.Update(ctx, ada.Id, store.UserUpdate{Email: &takenEmail})
+	wantDuplicate(t, err, "email")
+	_, err = users.Update(ctx, ada.Id, store.UserUpdate{Username: &takenUsername})
+	wantDuplicate(t, err, "username")
+	// Changing the case of one's own username is not a conflict.
+	ownUsername := "BOB"
+	if _, err := users.Update(ctx, bob.Id, store.UserUpdate{Username: &ownUsername}); err != nil {
+		t.Errorf("Update to own username in another case: %s", err)
+	}
+
+	// An empty string clears a field.
+	empty := ""
+	updated, err = users.Update(ctx, ada.Id, store.UserUpdate{FirstName: &empty})
+	if err != nil || updated.FirstName != "" {
+		t.Errorf("clearing FirstName: got %q, %v", updated.FirstName, err)
+	}
+}
+
+func testDelete(t *testing.T, users store.UserStore) {
+	ctx := context.Background()
+	created := createUsers(t, users, "ada", "bob")
+	if err := users.Delete(ctx, created[0].Id); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	_, err := users.GetByID(ctx, created[0].Id)
+	wantNotFound(t, err)
+	wantNotFound(t, users.Delete(ctx, created[0].Id))
+	if _, err := users.GetByID(ctx, created[1].Id); err != nil {
+		t.Errorf("the other user is gone: %s", err)
+	}
+	// The email address and username are free again.
+	again := model.User{Email: created[0].Email, Username: created[0].Username}
+	if err := users.Create(ctx, &again); err != nil {
+		t.Errorf("Create with the email and username of a deleted user: %s", err)
+	}
+}
+
+func testListPages(t *testing.T, users store.UserStore) {
+	ctx := context.Background()
+	created := createUsers(t, users, "u0", "u1", "u2", "u3", "u4")
+
+	for _, descending := range []bool{false, true} {
+		var got []string
+		var after primitive.ObjectID
+		for pages := 0; ; pages++ {
+			if pages > len(created) {
+				t.Fatalf("descending %v: paging does not end", descending)
+			}
+			page, err := users.List(ctx, store.ListOptions{After: after, Descending: descending, Limit: 2})
+			if err != nil {
+				t.Fatalf("List: %s", err)
+			}
+			if len(page) > 2 {
+				t.Fatalf("List returned %d users, more than the limit of 2", len(page))
+			}
+			got = append(got, usernames(page)...)
+			if len(page) < 2 {
+				break
+			}
+			after = page[len(page)-1].Id
+		}
+		want := []string{"u0", "u1", "u2", "u3", "u4"}
+		if descending {
+			want = []string{"u4", "u3", "u2", "u1", "u0"}
+		}
+		if !equal(got, want) {
+			t.Errorf("descending %v: pages hold %v, want %v", descending, got, want)
+		}
+	}
+}
+
+func testListFilters(t *testing.T, users store.UserStore) {
+	ctx := context.Background()
+	created := createUsers(t, users, "alpha", "alpine", "beta", "ünal", "ünsal")
+	disabled := model.UserStatusDisabled
+	if _, err := users.Update(ctx, created[2].Id, store.UserUpdate{Status: &disabled}); err != nil {
+		t.Fatalf("Update status: %s", err)
+	}
+	otherDomain := "alpine@Example.ORG"
+	if _, err := users.Update(ctx, created[1].Id, store.UserUpdate{Email: &otherDomain}); err != nil {
+		t.Fatalf("Update email: %s", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		filter store.UserFilter
+		want   []string
+	}{
+		{"everyone", store.UserFilter{}, []string{"alpha", "alpine", "beta", "ünal", "ünsal"}},
+		{"email domain ignores case", store.UserFilter{EmailDomain: "EXAMPLE.org"}, []string{"alpine"}},
+		{"username prefix", store.UserFilter{UsernamePrefix: "alp"}, []string{"alpha", "alpine"}},
+		{"username prefix is case-sensitive", store.UserFilter{UsernamePrefix: "ALP"}, nil},
+		{"non-ASCII username prefix", store.UserFilter{UsernamePrefix: "ün"}, []string{"ünal", "ünsal"}},
+		{"created range", store.UserFilter{CreatedAfter: createdAt(1), CreatedBefore: createdAt(3)}, []string{"alpine", "beta"}},
+		{"active", store.UserFilter{Status: model.UserStatusActive}, []string{"alpha", "alpine", "ünal", "ünsal"}},
+		{"disabled", store.UserFilter{Status: model.UserStatusDisabled}, []string{"beta"}},
+	} {
+		page, err := users.List(ctx, store.ListOptions{Filter: test.filter})
+		if err != nil {
+			t.Errorf("%s: List: %s", test.name, err)
+			continue
+		}
+		if got := usernames(page); !equal(got, test.want) {
+			t.Errorf("%s: List returned %v, want %v", test.name, got, test.want)
+		}
+		if count, err := users.Count(ctx, test.filter); err != nil || count != int64(len(test.want)) {
+			t.Errorf("%s: Count returned %d, %v, want %d", test.name, count, err, len(test.want))
+		}
+	}
+}
+
+func testFailedLogins(t *testing.T, users store.UserStore) {
+	ctx := context.Background()
+	user := createUsers(t, users, "ada")[0]
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	for want := 1; want <= 3; want++ {
+		got, err := users.RecordFailedLogin(ctx, user.Id, now, time.Hour)
+		if err != nil || got != want {
+			t.Fatalf("RecordFailedLogin: got %d, %v, want %d", got, err, want)
+		}
+	}
+	// A failure long after the previous one starts counting again.
+	if got, err := users.RecordFailedLogin(ctx, user.Id, now.Add(2*time.Hour), time.Hour); err != nil || got != 1 {
+		t.Errorf("RecordFailedLogin after the window: got %d, %v, want 1", got, err)
+	}
+
+	// A shorter lock does not replace a longer one.
+	if err := users.LockUntil(ctx, user.Id, now.Add(time.Hour)); err != nil {
+		t.Fatalf("LockUntil: %s", err)
+	}
+	if err := users.LockUntil(ctx, user.Id, now.Add(time.Minute)); err != nil {
+		t.Fatalf("LockUntil: %s", err)
+	}
+	locked, err := users.GetByID(ctx, user.Id)
+	if err != nil || locked.LockedUntil == nil || !locked.LockedUntil.Equal(now.Add(time.Hour)) {
+		t.Errorf("locked until %v (err %v), want %v", locked.LockedUntil, err, now.Add(time.Hour))
+	}
+
+	if err := users.ResetFailedLogins(ctx, user.Id); err != nil {
+		t.Fatalf("ResetFailedLogins: %s", err)
+	}
+	reset, err := users.GetByID(ctx, user.Id)
+	if err != nil || reset.FailedLogins != 0 || reset.LockedUntil != nil {
+		t.Errorf("after ResetFailedLogins: %d failures, locked until %v, err %v", reset.FailedLogins, reset.LockedUntil, err)
+	}
+}
+
+func testConditionalWrites(t *testing.T, users store.UserStore) {
+	ctx := context.Background()
+	user := createUsers(t, users, "ada")[0]
+
+	// Only the current email address can be verified.
+	wantNotFound(t, users.MarkEmailVerified(ctx, user.Id, "old@example.com"))
+	if err := users.MarkEmailVerified(ctx, user.Id, user.Email); err != nil {
+		t.Errorf("MarkEmailVerified: %s", err)
+	}
+	if verified, err := users.GetByID(ctx, user.Id); err != nil || !verified.EmailVerified {
+		t.Errorf("email not verified after MarkEmailVerified (err %v)", err)
+	}
+
+	// Only one of two replacements of the same hash succeeds.
+	if err := users.ReplacePassword(ctx, user.Id, user.Password, "first"); err != nil {
+		t.Errorf("ReplacePassword: %s", err)
+	}
+	wantNotFound(t, users.ReplacePassword(ctx, user.Id, user.Password, "second"))
+
+	// TOTP steps only move forward.
+	if err := users.SetPendingTOTP(ctx, user.Id, "pending"); err != nil {
+		t.Fatalf("SetPendingTOTP: %s", err)
+	}
+	wantNotFound(t, users.EnableTOTP(ctx, user.Id, "other", 10))
+	if err := users.EnableTOTP(ctx, user.Id, "pending", 10); err != nil {
+		t.Fatalf("EnableTOTP: %s", err)
+	}
+	for _, step := range []struct {
+		step int64
+		want bool
+	}{{10, false}, {11, true}, {11, false}, {9, false}} {
+		if ok, err := users.UseTOTPStep(ctx, user.Id, step.step); err != nil || ok != step.want {
+			t.Errorf("UseTOTPStep(%d): got %v, %v, want %v", step.step, ok, err, step.want)
+		}
+	}
+
+	// Recovery codes are used once.
+	if err := users.SetRecoveryCodes(ctx, user.Id, []string{"a", "b"}); err != nil {
+		t.Fatalf("SetRecoveryCodes: %s", err)
+	}
+	for _, use := range []struct {
+		hash string
+		want bool
+	}{{"a", true}, {"a", false}, {"c", false}, {"b", true}} {
+		if ok, err := users.UseRecoveryCode(ctx, user.Id, use.hash); err != nil || ok != use.want {
+			t.Errorf("UseRecoveryCode(%q): got %v, %v, want %v", use.hash, ok, err, use.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RemoteKeySet is a KeySource backed by the JWKS endpoint of the user service. Services that only
+// need to verify access tokens use it so they never have to hold any secret.
+//
+// The key set is cached for refreshInterval. A token signed with a kid that is not in the cache
+// triggers an early refresh, at most once per minRefreshInterval, so freshly rotated keys are
+// picked up without hammering the endpoint with made-up key ids.
+type RemoteKeySet struct {
+	url    string
+	client *http.Client
+
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]JWK
+	fetchedAt time.Time
+}
+
+// NewRemoteKeySet creates a RemoteKeySet that reads the keys from url, e.g.
+// "http://user-service:8080/.well-known/jwks.json".
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		url:                url,
+		client:             &http.Client{Timeout: 10 * time.Second},
+		refreshInterval:    time.Hour,
+		minRefreshInterval: 30 * time.Second,
+	}
+}
+
+// PublicKey implements KeySource.
+func (r *RemoteKeySet) PublicKey(kid string) (crypto.PublicKey, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	age := time.Since(r.fetchedAt)
+	jwk, ok := r.keys[kid]
+	if age >= r.refreshInterval || (!ok && age >= r.minRefreshInterval) {
+		if err := r.refresh(context.Background()); err != nil {
+			return nil, "", err
+		}
+		jwk, ok = r.keys[kid]
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	public, err := jwk.PublicKey()
+	if err != nil {
+		return nil, "", err
+	}
+	return public, jwk.Alg, nil
+}
+
+// refresh downloads the key set. It must be called with r.mu held.
+func (r *RemoteKeySet) refresh(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := r.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: unexpected status %s", response.Status)
+	}
+	var set JWKS
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decode JWKS: %w", err)
+	}
+	keys := make(map[string]JWK, len(set.Keys))
+	for _, jwk := range set.Keys {
+		keys[jwk.Kid] = jwk
+	}
+	r.keys = keys
+	r.fetchedAt = time.Now()
+	return nil
+}
+
+// JWKSHandler serves the public keys of ks as a JSON Web Key Set.
+func JWKSHandler(ks *KeySet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(ks.JWKS())
+	})
+}
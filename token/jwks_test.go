@@ -0,0 +1,89 @@
+package token
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveJWKS serves the keys and counts the requests for them.
+func serveJWKS(t *testing.T, keys *KeySet) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	handler := JWKSHandler(keys)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestRemoteKeySetRefreshesForNewKeys(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeySet(t, ES256, time.Hour, &now)
+	server, requests := serveJWKS(t, keys)
+	remote := NewRemoteKeySet(server.URL)
+	remote.minRefreshInterval = 0
+	verifier := NewVerifier(remote, testIssuer, testAudience)
+
+	for i := 0; i < 2; i++ {
+		if _, err := verifier.Verify(issue(t, keys)); err != nil {
+			t.Fatalf("Verify: %s", err)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("fetched the keys %d times for one key, want 1", got)
+	}
+
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("Rotate: %s", err)
+	}
+	if _, err := verifier.Verify(issue(t, keys)); err != nil {
+		t.Fatalf("Verify with the rotated key: %s", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("fetched the keys %d times after a rotation, want 2", got)
+	}
+}
+
+func TestRemoteKeySetLimitsRefreshes(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeySet(t, ES256, time.Hour, &now)
+	server, requests := serveJWKS(t, keys)
+	remote := NewRemoteKeySet(server.URL)
+	verifier := NewVerifier(remote, testIssuer, testAudience)
+	if _, err := verifier.Verify(issue(t, keys)); err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+
+	// Made-up key ids do not make every verification fetch the keys again.
+	for i := 0; i < 3; i++ {
+		if _, _, err := remote.PublicKey("made-up"); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("PublicKey of an unknown key: got %v, want ErrUnknownKey", err)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("fetched the keys %d times, want 1", got)
+	}
+
+	// Once the cache is old, the keys are fetched again.
+	remote.fetchedAt = remote.fetchedAt.Add(-remote.refreshInterval)
+	if _, err := verifier.Verify(issue(t, keys)); err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("fetched the keys %d times after the refresh interval, want 2", got)
+	}
+}
+
+func TestRemoteKeySetUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	if _, _, err := NewRemoteKeySet(server.URL).PublicKey("kid"); err == nil {
+		t.Error("PublicKey succeeded without a JWKS")
+	}
+}
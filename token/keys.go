@@ -0,0 +1,343 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// ErrUnknownKey is returned when a token refers to a key id that is not (or no longer) published.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// ErrStaticKeySet is returned when rotating a KeySet whose keys are configured.
+var ErrStaticKeySet = errors.New("configured signing keys can not be rotated by the service")
+
+// KeySource looks up the public key a token was signed with by its key id (kid).
+type KeySource interface {
+	PublicKey(kid string) (crypto.PublicKey, string, error)
+}
+
+// SigningKey is one private key of a KeySet.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	CreatedAt time.Time
+	// RetiredAt is set once a newer key took over signing. The key is still published until every
+	// token it signed has expired.
+	RetiredAt *time.Time
+
+	private crypto.Signer
+}
+
+// KeySet holds the keys used to sign access tokens: the current one, which signs every new token,
+// and the retired ones that still verify tokens issued before the last rotation.
+//
+// The keys are either generated by the KeySet, and so only known to one process and lost when it
+// exits, or configured and shared by every replica of the service (see NewStaticKeySet).
+type KeySet struct {
+	algorithm string
+	// How long a retired key stays published. This must be at least the access token lifetime.
+	retention time.Duration
+	now       func() time.Time
+	// static is set when the keys are configured rather than generated.
+	static bool
+
+	mu   sync.RWMutex
+	keys []*SigningKey
+}
+
+// NewKeySet creates a KeySet with a freshly generated key for the algorithm.
+func NewKeySet(algorithm string, retention time.Duration) (*KeySet, error) {
+	ks := &KeySet{
+		algorithm: algorithm,
+		retention: retention,
+		now:       time.Now,
+	}
+	if err := ks.Rotate(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// NewStaticKeySet creates a KeySet from configured private keys, so every replica of the service
+// signs and publishes the same keys and tokens stay valid across restarts. keys maps key ids to
+// PKCS #8 DER encoded RSA, P-256 or Ed25519 private keys, and the algorithm of each follows from its
+// type. The key with id currentID signs new tokens; the others are published to verify the tokens
+// signed before it took over.
+//
+// A static KeySet is rotated by its configuration: add the new key to every replica first, then
+// make it current, and remove the old key once the tokens it signed have expired.
+func NewStaticKeySet(currentID string, keys map[string][]byte) (*KeySet, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("no signing key with id %q", currentID)
+	}
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		if id != currentID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	ids = append(ids, currentID)
+
+	ks := &KeySet{now: time.Now, static: true}
+	for _, id := range ids {
+		private, algorithm, err := parsePrivateKey(keys[id])
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q: %w", id, err)
+		}
+		ks.keys = append(ks.keys, &SigningKey{ID: id, Algorithm: algorithm, private: private})
+		ks.algorithm = algorithm
+	}
+	return ks, nil
+}
+
+// Rotate generates a new signing key, retires the current one and drops the retired keys whose
+// tokens have all expired. A static KeySet can not be rotated and returns ErrStaticKeySet.
+func (ks *KeySet) Rotate() error {
+	if ks.static {
+		return ErrStaticKeySet
+	}
+	private, err := generateKey(ks.algorithm)
+	if err != nil {
+		return err
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	now := ks.now()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	var keys []*SigningKey
+	for _, key := range ks.keys {
+		if key.RetiredAt == nil {
+			retiredAt := now
+			key.RetiredAt = &retiredAt
+		}
+		if now.Sub(*key.RetiredAt) < ks.retention {
+			keys = append(keys, key)
+		}
+	}
+	ks.keys = append(keys, &SigningKey{
+		ID:        id,
+		Algorithm: ks.algorithm,
+		CreatedAt: now,
+		private:   private,
+	})
+	return nil
+}
+
+// RotateEvery rotates the keys on every tick of interval until ctx is done.
+func (ks *KeySet) RotateEvery(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ks.Rotate(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// current returns the key that signs new tokens.
+func (ks *KeySet) current() *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[len(ks.keys)-1]
+}
+
+// PublicKey implements KeySource.
+func (ks *KeySet) PublicKey(kid string) (crypto.PublicKey, string, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	now := ks.now()
+	for _, key := range ks.keys {
+		if key.ID != kid {
+			continue
+		}
+		if key.RetiredAt != nil && now.Sub(*key.RetiredAt) >= ks.retention {
+			break
+		}
+		return key.private.Public(), key.Algorithm, nil
+	}
+	return nil, "", fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+}
+
+// JWKS returns the published public keys, newest first.
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	now := ks.now()
+	set := JWKS{Keys: []JWK{}}
+	for i := len(ks.keys) - 1; i >= 0; i-- {
+		key := ks.keys[i]
+		if key.RetiredAt != nil && now.Sub(*key.RetiredAt) >= ks.retention {
+			continue
+		}
+		set.Keys = append(set.Keys, newJWK(key.ID, key.Algorithm, key.private.Public()))
+	}
+	return set
+}
+
+// signingMethod returns the jwt signing method for the algorithm.
+func signingMethod(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case RS256:
+		return jwt.SigningMethodRS256, nil
+	case ES256:
+		return jwt.SigningMethodES256, nil
+	case EdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+}
+
+// generateKey creates a new private key for the algorithm.
+func generateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case RS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+}
+
+// parsePrivateKey decodes a PKCS #8 DER private key and returns the algorithm it signs with.
+func parsePrivateKey(der []byte) (crypto.Signer, string, error) {
+	private, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid PKCS #8 private key: %w", err)
+	}
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, "", fmt.Errorf("RSA keys must have at least 2048 bits, got %d", key.N.BitLen())
+		}
+		return key, RS256, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, "", fmt.Errorf("unsupported curve %s, only P-256 is supported", key.Curve.Params().Name)
+		}
+		return key, ES256, nil
+	case ed25519.PrivateKey:
+		return key, EdDSA, nil
+	}
+	return nil, "", fmt.Errorf("unsupported private key type %T", private)
+}
+
+// JWKS is a JSON Web Key Set (RFC 7517) as served on /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is a public JSON Web Key. Only the members needed for RSA, EC P-256 and Ed25519 keys are present.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// newJWK encodes a public key as a JWK.
+func newJWK(kid string, algorithm string, public crypto.PublicKey) JWK {
+	jwk := JWK{Kid: kid, Use: "sig", Alg: algorithm}
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encode(key.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = encode(key.X.FillBytes(make([]byte, 32)))
+		jwk.Y = encode(key.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encode(key)
+	}
+	return jwk
+}
+
+// PublicKey decodes the JWK back into a public key.
+func (jwk JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
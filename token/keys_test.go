@@ -0,0 +1,154 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRotatedKeyVerifiesWithinRetention(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeySet(t, ES256, 10*time.Minute, &now)
+	verifier := NewVerifier(keys, testIssuer, testAudience)
+	before := issue(t, keys)
+	retired := keys.current().ID
+
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("Rotate: %s", err)
+	}
+	if keys.current().ID == retired {
+		t.Fatal("Rotate kept the current key")
+	}
+	if _, err := verifier.Verify(before); err != nil {
+		t.Errorf("token of the retired key within the retention: %s", err)
+	}
+	if _, err := verifier.Verify(issue(t, keys)); err != nil {
+		t.Errorf("token of the new key: %s", err)
+	}
+	if got := len(keys.JWKS().Keys); got != 2 {
+		t.Errorf("published %d keys within the retention, want 2", got)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if _, err := verifier.Verify(before); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token of the retired key after the retention: got %v, want ErrInvalidToken", err)
+	}
+	if _, _, err := keys.PublicKey(retired); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("PublicKey of the retired key after the retention: got %v, want ErrUnknownKey", err)
+	}
+	jwks := keys.JWKS()
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != keys.current().ID {
+		t.Errorf("published %+v after the retention, want only the current key", jwks.Keys)
+	}
+
+	// The next rotation forgets the expired key.
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("Rotate: %s", err)
+	}
+	if got := len(keys.keys); got != 2 {
+		t.Errorf("holding %d keys, want the current and the one it replaced", got)
+	}
+}
+
+func TestJWKSPublishesPublicKeys(t *testing.T) {
+	for _, algorithm := range []string{RS256, ES256, EdDSA} {
+		now := time.Now()
+		keys := newTestKeySet(t, algorithm, time.Hour, &now)
+		if err := keys.Rotate(); err != nil {
+			t.Fatalf("%s: Rotate: %s", algorithm, err)
+		}
+		jwks := keys.JWKS()
+		if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != keys.current().ID {
+			t.Fatalf("%s: got %+v, want the current key first of 2", algorithm, jwks.Keys)
+		}
+		for _, jwk := range jwks.Keys {
+			if jwk.Alg != algorithm || jwk.Use != "sig" {
+				t.Errorf("%s: key %q has alg %q and use %q", algorithm, jwk.Kid, jwk.Alg, jwk.Use)
+			}
+			public, err := jwk.PublicKey()
+			if err != nil {
+				t.Fatalf("%s: decode JWK: %s", algorithm, err)
+			}
+			want, _, err := keys.PublicKey(jwk.Kid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(public, want) {
+				t.Errorf("%s: JWK %q decodes to another public key", algorithm, jwk.Kid)
+			}
+		}
+	}
+}
+
+// pkcs8 returns the PKCS #8 DER encoding of a private key.
+func pkcs8(t *testing.T, key interface{}) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestStaticKeySet(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured := map[string][]byte{"old": pkcs8(t, edKey), "new": pkcs8(t, mustGenerateECDSA(t, elliptic.P256()))}
+
+	// A replica still signing with the old key, and one that moved on to the new key.
+	oldKeys, err := NewStaticKeySet("old", configured)
+	if err != nil {
+		t.Fatalf("NewStaticKeySet: %s", err)
+	}
+	newKeys, err := NewStaticKeySet("new", configured)
+	if err != nil {
+		t.Fatalf("NewStaticKeySet: %s", err)
+	}
+	if got := newKeys.current(); got.ID != "new" || got.Algorithm != ES256 {
+		t.Errorf("signing with key %q and %s, want new and ES256", got.ID, got.Algorithm)
+	}
+	for _, verifier := range []*Verifier{NewVerifier(oldKeys, testIssuer, testAudience), NewVerifier(newKeys, testIssuer, testAudience)} {
+		for _, keys := range []*KeySet{oldKeys, newKeys} {
+			if _, err := verifier.Verify(issue(t, keys)); err != nil {
+				t.Errorf("token signed with %q: %s", keys.current().ID, err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(oldKeys.JWKS().Keys[1], newKeys.JWKS().Keys[0]) {
+		t.Error("replicas publish different keys")
+	}
+	if err := newKeys.Rotate(); !errors.Is(err, ErrStaticKeySet) {
+		t.Errorf("Rotate: got %v, want ErrStaticKeySet", err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		currentID string
+		keys      map[string][]byte
+	}{
+		{"an unknown current key", "missing", configured},
+		{"a key that is not PKCS #8", "new", map[string][]byte{"new": []byte("not a key")}},
+		{"a key of an unsupported curve", "new", map[string][]byte{"new": pkcs8(t, mustGenerateECDSA(t, elliptic.P384()))}},
+	} {
+		if _, err := NewStaticKeySet(test.currentID, test.keys); err == nil {
+			t.Errorf("NewStaticKeySet with %s succeeded", test.name)
+		}
+	}
+}
+
+func mustGenerateECDSA(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,27 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// NewRefreshToken generates a random opaque refresh token. It returns the token to hand to the
+// client and the hash to store in the database.
+func NewRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generate refresh token: %w", err)
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(b)
+	return refreshToken, HashRefreshToken(refreshToken), nil
+}
+
+// HashRefreshToken returns the hex encoded SHA-256 hash under which a refresh token is stored.
+// Refresh tokens carry 256 bits of randomness, so a fast unsalted hash is enough here.
+func HashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,142 @@
+// Package token issues and verifies the JWT access tokens handed out by the user service.
+// Other Go services can import this package and use a Verifier to check the tokens offline.
+package token
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalidToken is returned by Verify for any token that is malformed, badly signed, expired or
+// issued for somebody else.
+var ErrInvalidToken = errors.New("invalid access token")
+
+// Claims are the claims carried by an access token. The subject (sub) is the hex ObjectID of the user
+// and the session id (sid) the hex ObjectID of the login session the token belongs to. Scope is a
+// space separated list as in RFC 8693.
+type Claims struct {
+	Email     string `json:"email,omitempty"`
+	Username  string `json:"username,omitempty"`
+	SessionId string `json:"sid,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Issuer signs access tokens with the current key of a KeySet.
+type Issuer struct {
+	keys     *KeySet
+	issuer   string
+	audience string
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+// NewIssuer creates an Issuer that signs tokens with keys and makes them valid for ttl.
+func NewIssuer(keys *KeySet, issuer string, audience string, ttl time.Duration) *Issuer {
+	return &Issuer{
+		keys:     keys,
+		issuer:   issuer,
+		audience: audience,
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// Issue creates a signed access token for the user's session granting scopes and returns it together
+// with its expiry time.
+func (i *Issuer) Issue(subject string, email string, username string, sessionId string, scopes []string) (string, time.Time, error) {
+	jti, err := newID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	issuedAt := i.now().Truncate(time.Second)
+	expiresAt := issuedAt.Add(i.ttl)
+
+	claims := Claims{
+		Email:     email,
+		Username:  username,
+		SessionId: sessionId,
+		Scope:     strings.Join(scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   subject,
+			Issuer:    i.issuer,
+			Audience:  jwt.ClaimStrings{i.audience},
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			NotBefore: jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	key := i.keys.current()
+	method, err := signingMethod(key.Algorithm)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	unsigned := jwt.NewWithClaims(method, claims)
+	unsigned.Header["kid"] = key.ID
+	signed, err := unsigned.SignedString(key.private)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("sign access token: %w", err)
+	}
+	return signed, expiresAt, nil
+}
+
+// Verifier checks access tokens against the public keys of a KeySource.
+type Verifier struct {
+	keys   KeySource
+	parser *jwt.Parser
+}
+
+// NewVerifier creates a Verifier that accepts tokens signed by one of the keys of keys for the given
+// issuer and audience. Inside the user service keys is its KeySet, other services use a RemoteKeySet.
+func NewVerifier(keys KeySource, issuer string, audience string) *Verifier {
+	return &Verifier{
+		keys: keys,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{RS256, ES256, EdDSA}),
+			jwt.WithIssuer(issuer),
+			jwt.WithAudience(audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+		),
+	}
+}
+
+// Verify parses the token, checks its signature and registered claims and returns its claims.
+func (v *Verifier) Verify(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := v.parser.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		public, algorithm, err := v.keys.PublicKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// A key is only ever used with the algorithm it was generated for.
+		if t.Method.Alg() != algorithm {
+			return nil, fmt.Errorf("key %q is not used with %s", kid, t.Method.Alg())
+		}
+		return public, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// newID returns a random identifier used as the jti claim.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,114 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "user-service"
+	testAudience = "user-service"
+)
+
+// newTestKeySet creates a KeySet for algorithm whose clock is read from *now.
+func newTestKeySet(t *testing.T, algorithm string, retention time.Duration, now *time.Time) *KeySet {
+	t.Helper()
+	ks := &KeySet{algorithm: algorithm, retention: retention, now: func() time.Time { return *now }}
+	if err := ks.Rotate(); err != nil {
+		t.Fatalf("Rotate: %s", err)
+	}
+	return ks
+}
+
+// issue returns a token issued by keys for the subject "user".
+func issue(t *testing.T, keys *KeySet) string {
+	t.Helper()
+	signed, _, err := NewIssuer(keys, testIssuer, testAudience, time.Hour).Issue("user", "user@example.com", "user", "session", []string{"profile", "admin"})
+	if err != nil {
+		t.Fatalf("Issue: %s", err)
+	}
+	return signed
+}
+
+// sign signs claims with the private key, announcing kid and the algorithm of method.
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	now := time.Now()
+	unsigned := jwt.NewWithClaims(method, Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "user",
+		Issuer:    testIssuer,
+		Audience:  jwt.ClaimStrings{testAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}})
+	unsigned.Header["kid"] = kid
+	signed, err := unsigned.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+	return signed
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	for _, algorithm := range []string{RS256, ES256, EdDSA} {
+		now := time.Now()
+		keys := newTestKeySet(t, algorithm, time.Hour, &now)
+		claims, err := NewVerifier(keys, testIssuer, testAudience).Verify(issue(t, keys))
+		if err != nil {
+			t.Fatalf("%s: Verify: %s", algorithm, err)
+		}
+		if claims.Subject != "user" || claims.Email != "user@example.com" || claims.Username != "user" || claims.SessionId != "session" {
+			t.Errorf("%s: got claims %+v", algorithm, claims)
+		}
+		if claims.Scope != "profile admin" {
+			t.Errorf("%s: got scope %q, want %q", algorithm, claims.Scope, "profile admin")
+		}
+		if claims.ID == "" {
+			t.Errorf("%s: token has no jti", algorithm)
+		}
+	}
+}
+
+func TestVerifyRejectsTokens(t *testing.T) {
+	now := time.Now()
+	keys := newTestKeySet(t, ES256, time.Hour, &now)
+	otherKeys := newTestKeySet(t, ES256, time.Hour, &now)
+	edKeys := newTestKeySet(t, EdDSA, time.Hour, &now)
+	current := keys.current()
+	stranger, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := (&Issuer{keys: keys, issuer: testIssuer, audience: testAudience, ttl: time.Hour, now: func() time.Time { return now.Add(-2 * time.Hour) }}).Issue("user", "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := issue(t, keys)
+	parts := strings.Split(signed, ".")
+
+	for _, test := range []struct {
+		name     string
+		verifier *Verifier
+		token    string
+	}{
+		{"another audience", NewVerifier(keys, testIssuer, "another-service"), signed},
+		{"another issuer", NewVerifier(keys, "another-issuer", testAudience), signed},
+		{"an expired token", NewVerifier(keys, testIssuer, testAudience), expired},
+		{"a key of another key set", NewVerifier(keys, testIssuer, testAudience), issue(t, otherKeys)},
+		{"a kid of another key", NewVerifier(keys, testIssuer, testAudience), sign(t, jwt.SigningMethodES256, current.ID, stranger)},
+		{"a key used with another algorithm", NewVerifier(edKeys, testIssuer, testAudience), sign(t, jwt.SigningMethodES256, edKeys.current().ID, stranger)},
+		{"an unsigned token", NewVerifier(keys, testIssuer, testAudience), sign(t, jwt.SigningMethodNone, current.ID, jwt.UnsafeAllowNoneSignatureType)},
+		{"a tampered payload", NewVerifier(keys, testIssuer, testAudience), parts[0] + "." + strings.Split(issue(t, keys), ".")[1] + "." + parts[2]},
+	} {
+		if _, err := test.verifier.Verify(test.token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, want ErrInvalidToken", test.name, err)
+		}
+	}
+}
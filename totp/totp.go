@@ -0,0 +1,89 @@
+// Package totp implements the time-based one-time passwords of RFC 6238 as used by authenticator
+// apps: 6 digit codes derived with HMAC-SHA1 from a shared secret and the current 30 second step.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	// Digits is the length of a code.
+	Digits = 6
+	// Period is how long each code is valid.
+	Period = 30 * time.Second
+	// SecretLength is the length of a secret in bytes, the 160 bits RFC 4226 recommends.
+	SecretLength = 20
+)
+
+// encoding is how secrets are shown to users and put in otpauth URIs.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random secret.
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, SecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generate TOTP secret: %w", err)
+	}
+	return secret, nil
+}
+
+// EncodeSecret returns the secret in the base32 form authenticator apps let users type in.
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// URI returns the otpauth:// URI authenticator apps read from a QR code. issuer names the service
+// and account the user within it.
+func URI(issuer string, account string, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", EncodeSecret(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period/time.Second)))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Step returns the time step t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code of the secret for a time step.
+func Code(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	// Dynamic truncation, RFC 4226 section 5.3.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1000000)
+}
+
+// Validate checks code against the steps up to skew before and after the step of now, to allow
+// for clocks that drift, and returns the step it matched. Callers should refuse codes of a step
+// at or before the last one they accepted, so a code can not be used twice.
+func Validate(secret []byte, code string, now time.Time, skew int) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(now)
+	for offset := -int64(skew); offset <= int64(skew); offset++ {
+		step := current + offset
+		if subtle.ConstantTimeCompare([]byte(Code(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,118 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors of RFC 6238 appendix B.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCodeMatchesRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes, authenticator apps show their last 6 digits.
+	for _, vector := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		now := time.Unix(vector.unix, 0)
+		if got := Code(rfcSecret, Step(now)); got != vector.code {
+			t.Errorf("Code at %d: got %s, want %s", vector.unix, got, vector.code)
+		}
+		if step, ok := Validate(rfcSecret, vector.code, now, 0); !ok || step != Step(now) {
+			t.Errorf("Validate at %d: got step %d, %v, want %d", vector.unix, step, ok, Step(now))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	for _, test := range []struct {
+		name   string
+		offset int64
+		skew   int
+		want   bool
+	}{
+		{"the current step without skew", 0, 0, true},
+		{"the previous step without skew", -1, 0, false},
+		{"the previous step", -1, 1, true},
+		{"the next step", 1, 1, true},
+		{"two steps early", -2, 1, false},
+		{"two steps late", 2, 1, false},
+		{"two steps early with a skew of 2", -2, 2, true},
+	} {
+		step, ok := Validate(rfcSecret, Code(rfcSecret, current+test.offset), now, test.skew)
+		if ok != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, ok, test.want)
+		}
+		if ok && step != current+test.offset {
+			t.Errorf("%s: matched step %d, want %d", test.name, step, current+test.offset)
+		}
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "94287082", "287083", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now, 1); ok {
+			t.Errorf("Validate accepted %q", code)
+		}
+	}
+	if _, ok := Validate([]byte("another secret of 20"), "287082", now, 1); ok {
+		t.Error("Validate accepted the code of another secret")
+	}
+}
+
+func TestStepBoundaries(t *testing.T) {
+	if Step(time.Unix(29, 0)) != 0 || Step(time.Unix(30, 0)) != 1 || Step(time.Unix(59, 999)) != 1 {
+		t.Error("steps do not start every 30 seconds")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri, err := url.Parse(URI("User Service", "ada@example.com", rfcSecret))
+	if err != nil {
+		t.Fatalf("parse URI: %s", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/User Service:ada@example.com" {
+		t.Errorf("got %s, want otpauth://totp/ labelled with the issuer and account", uri)
+	}
+	query := uri.Query()
+	for key, want := range map[string]string{
+		"secret":    "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		"issuer":    "User Service",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	} {
+		if got := query.Get(key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+	if strings.Contains(query.Get("secret"), "=") {
+		t.Error("the secret is padded, which some authenticator apps refuse")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	first, err := NewSecret()
+	if err != nil {
+		t.Fatalf("NewSecret: %s", err)
+	}
+	second, err := NewSecret()
+	if err != nil {
+		t.Fatalf("NewSecret: %s", err)
+	}
+	if len(first) != SecretLength || string(first) == string(second) {
+		t.Errorf("got secrets %x and %x, want two different ones of %d bytes", first, second, SecretLength)
+	}
+}